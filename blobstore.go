@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+BlobStore stores the files attached to reports. Names are chosen by the server
+and never contain path separators.
+*/
+type BlobStore interface {
+	Put(name string, r io.Reader) (int64, error)
+	Open(name string) (io.ReadSeekCloser, time.Time, error)
+	Delete(name string) error
+}
+
+/*
+fsBlobStore is a BlobStore keeping files in a directory on the local disk.
+*/
+type fsBlobStore string
+
+var blobs BlobStore = fsBlobStore(imageDir)
+
+func (d fsBlobStore) path(name string) string {
+	return filepath.Join(string(d), filepath.Base(name))
+}
+
+func (d fsBlobStore) Put(name string, r io.Reader) (int64, error) {
+	out, err := os.Create(d.path(name))
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(d.path(name))
+	}
+	return n, err
+}
+
+func (d fsBlobStore) Open(name string) (io.ReadSeekCloser, time.Time, error) {
+	f, err := os.Open(d.path(name))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+	return f, fi.ModTime(), nil
+}
+
+func (d fsBlobStore) Delete(name string) error {
+	return os.Remove(d.path(name))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+BoundarySet is a named collection of areas dividing the map, such as wards,
+neighborhoods or districts. Each report is assigned to at most one area of every
+set.
+*/
+type BoundarySet struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedBy   int       `json:"createdBy"`
+	Date        time.Time `json:"created"`
+	Active      int       `json:"-"`
+	Areas       int       `json:"areas"`
+}
+
+/*
+BoundaryArea is one area of a boundary set. Code is an optional identifier from
+the uploaded data, such as a ward number.
+*/
+type BoundaryArea struct {
+	ID       int       `json:"id"`
+	SetID    int       `json:"setId"`
+	Name     string    `json:"name"`
+	Code     string    `json:"code,omitempty"`
+	Geometry *Geometry `json:"-"`
+
+	polygons []polygon
+	box      bbox
+}
+
+/*
+prepare decodes the geometry of an area for point in polygon tests.
+*/
+func (a *BoundaryArea) prepare() error {
+	ps, err := a.Geometry.polygons()
+	if err != nil {
+		return err
+	}
+	a.polygons = ps
+	a.box = polygonsBBox(ps)
+	return nil
+}
+
+func (a *BoundaryArea) contains(lat, lng float64) bool {
+	return a.box.contains(lat, lng) && polygonsContain(a.polygons, lat, lng)
+}
+
+/*
+boundaryIndex holds the areas of the active boundary sets in memory, loaded on
+first use and reloaded after sets change.
+*/
+type boundaryIndex struct {
+	mu   sync.Mutex
+	sets map[int][]*BoundaryArea
+}
+
+var boundaries = &boundaryIndex{}
+
+func (b *boundaryIndex) load() (map[int][]*BoundaryArea, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sets != nil {
+		return b.sets, nil
+	}
+	areas, err := getActiveBoundaryAreas()
+	if err != nil {
+		return nil, err
+	}
+	sets := map[int][]*BoundaryArea{}
+	for i := range areas {
+		a := &areas[i]
+		if err := a.prepare(); err != nil {
+			log.Println("boundary area", a.ID, "has an invalid geometry:", err)
+			continue
+		}
+		sets[a.SetID] = append(sets[a.SetID], a)
+	}
+	b.sets = sets
+	return sets, nil
+}
+
+func (b *boundaryIndex) reset() {
+	b.mu.Lock()
+	b.sets = nil
+	b.mu.Unlock()
+}
+
+/*
+areaOf returns the first area containing a point, or nil.
+*/
+func areaOf(areas []*BoundaryArea, lat, lng float64) *BoundaryArea {
+	for _, a := range areas {
+		if a.contains(lat, lng) {
+			return a
+		}
+	}
+	return nil
+}
+
+/*
+assignReportAreas records the area of every boundary set a report lies in.
+Failures are logged; the report stays without areas.
+*/
+func assignReportAreas(r *Report) {
+	lat, lng, err := r.point()
+	if err != nil {
+		return
+	}
+	sets, err := boundaries.load()
+	if err != nil {
+		log.Println("loading boundaries:", err)
+		return
+	}
+	for setID, areas := range sets {
+		if a := areaOf(areas, lat, lng); a != nil {
+			if err := insertReportArea(int64(r.ID), setID, a.ID); err != nil {
+				log.Println("assigning report area:", err)
+			}
+		}
+	}
+}
+
+/*
+assignSetAreas assigns the existing reports to the areas of a new boundary set.
+Hidden reports are assigned too so they are counted once they are restored.
+*/
+func assignSetAreas(areas []*BoundaryArea) (int, error) {
+	if len(areas) == 0 {
+		return 0, nil
+	}
+	var all []polygon
+	for _, a := range areas {
+		all = append(all, a.polygons...)
+	}
+	box := polygonsBBox(all)
+	assigned := map[int64]int{}
+	err := eachStoredReport(&reportFilter{Box: &box}, func(r *Report) error {
+		lat, lng, err := r.point()
+		if err != nil {
+			return nil
+		}
+		if a := areaOf(areas, lat, lng); a != nil {
+			assigned[int64(r.ID)] = a.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(assigned), insertReportAreas(areas[0].SetID, assigned)
+}
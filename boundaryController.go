@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxBoundaryUpload = 50 << 20
+	maxBoundaryAreas  = 5000
+)
+
+/*
+boundaryUpload is the body of BoundaryCreate. Boundaries is a GeoJSON
+FeatureCollection of Polygon and MultiPolygon features. The areas are named by
+the feature property nameProperty, "name" unless given, and get a code from
+codeProperty if given.
+*/
+type boundaryUpload struct {
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	NameProperty string `json:"nameProperty"`
+	CodeProperty string `json:"codeProperty"`
+	Boundaries   struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+			Geometry   *Geometry              `json:"geometry"`
+		} `json:"features"`
+	} `json:"boundaries"`
+}
+
+/*
+propertyString returns a feature property as text. Numbers such as ward numbers
+are written without a fraction where they have none.
+*/
+func propertyString(props map[string]interface{}, name string) string {
+	switch v := props[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+/*
+areas validates the upload and returns its areas ready for point in polygon
+tests.
+*/
+func (b *boundaryUpload) areas() ([]*BoundaryArea, error) {
+	b.Name = strings.TrimSpace(b.Name)
+	if b.Name == "" || len(b.Name) > 255 {
+		return nil, errors.New("A boundary set needs a name of up to 255 characters")
+	}
+	if len(b.Description) > 1024 {
+		return nil, errors.New("The description can have up to 1024 characters")
+	}
+	if b.Boundaries.Type != "FeatureCollection" {
+		return nil, errors.New("boundaries must be a GeoJSON FeatureCollection")
+	}
+	features := b.Boundaries.Features
+	if len(features) == 0 || len(features) > maxBoundaryAreas {
+		return nil, errors.New("A boundary set needs between 1 and " + strconv.Itoa(maxBoundaryAreas) + " areas")
+	}
+	if b.NameProperty == "" {
+		b.NameProperty = "name"
+	}
+
+	names := map[string]bool{}
+	var areas []*BoundaryArea
+	for i, f := range features {
+		a := &BoundaryArea{
+			Name:     propertyString(f.Properties, b.NameProperty),
+			Geometry: f.Geometry,
+		}
+		if b.CodeProperty != "" {
+			a.Code = propertyString(f.Properties, b.CodeProperty)
+		}
+		switch {
+		case a.Name == "" || len(a.Name) > 255:
+			return nil, fmt.Errorf("feature %d needs a %s of up to 255 characters", i+1, b.NameProperty)
+		case names[a.Name]:
+			return nil, fmt.Errorf("feature %d: there is more than one area named %s", i+1, a.Name)
+		case len(a.Code) > 64:
+			return nil, fmt.Errorf("feature %d: %s can have up to 64 characters", i+1, b.CodeProperty)
+		case a.Geometry == nil:
+			return nil, fmt.Errorf("feature %d has no geometry", i+1)
+		}
+		if err := a.prepare(); err != nil {
+			return nil, fmt.Errorf("feature %d: geometry must be a Polygon or MultiPolygon", i+1)
+		}
+		names[a.Name] = true
+		areas = append(areas, a)
+	}
+	return areas, nil
+}
+
+/*
+BoundaryIndex lists the boundary sets.
+*/
+func BoundaryIndex(w http.ResponseWriter, r *http.Request) {
+	sets, err := getBoundarySets()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(sets); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+BoundaryCreate adds a boundary set uploaded as GeoJSON and assigns the existing
+reports to its areas. The response tells how many reports were assigned.
+*/
+func BoundaryCreate(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	var upload boundaryUpload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBoundaryUpload)).Decode(&upload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	areas, err := upload.areas()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	set := &BoundarySet{
+		Name:        upload.Name,
+		Description: upload.Description,
+		CreatedBy:   u.ID,
+		Date:        time.Now(),
+		Areas:       len(areas),
+	}
+	if err := insertBoundarySet(set, areas); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	boundaries.reset()
+	assigned, err := assignSetAreas(areas)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		*BoundarySet
+		AssignedReports int `json:"assignedReports"`
+	}{set, assigned}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+boundarySetFromRoute loads the boundary set named in the route.
+*/
+func boundarySetFromRoute(w http.ResponseWriter, r *http.Request) (*BoundarySet, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["setId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	set, err := getBoundarySet(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Boundary set not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return set, true
+}
+
+/*
+BoundaryDetails returns the areas of a boundary set as a GeoJSON
+FeatureCollection, with the id, name and code of each area as properties.
+*/
+func BoundaryDetails(w http.ResponseWriter, r *http.Request) {
+	set, ok := boundarySetFromRoute(w, r)
+	if !ok {
+		return
+	}
+	areas, err := getBoundaryAreas(int64(set.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type feature struct {
+		Type       string        `json:"type"`
+		ID         int           `json:"id"`
+		Properties *BoundaryArea `json:"properties"`
+		Geometry   *Geometry     `json:"geometry"`
+	}
+	resp := struct {
+		Type     string       `json:"type"`
+		Set      *BoundarySet `json:"set"`
+		Features []feature    `json:"features"`
+	}{"FeatureCollection", set, []feature{}}
+	for i := range areas {
+		resp.Features = append(resp.Features, feature{"Feature", areas[i].ID, &areas[i], areas[i].Geometry})
+	}
+	w.Header().Set("Content-Type", "application/geo+json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+BoundaryDelete removes a boundary set.
+*/
+func BoundaryDelete(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["setId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := deleteBoundarySet(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "Boundary set not found", http.StatusNotFound)
+		return
+	}
+	boundaries.reset()
+	w.WriteHeader(http.StatusNoContent)
+}
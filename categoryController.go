@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+/*
+Category is a kind of problem which can be reported, such as "pothole". Each
+category is handled by a department of the city. AckHours and ResolveHours are
+the SLA targets for acknowledging and resolving reports, 0 meaning none.
+Severity from 0 to 5 is how urgent reports in the category are, which weighs
+into their priority.
+*/
+type Category struct {
+	Code         string `json:"code"`
+	Name         string `json:"name"`
+	Department   string `json:"department"`
+	AckHours     int    `json:"ackHours"`
+	ResolveHours int    `json:"resolveHours"`
+	Severity     int    `json:"severity"`
+}
+
+/*
+CategoryIndex lists the categories reports can be filed under.
+*/
+func CategoryIndex(w http.ResponseWriter, r *http.Request) {
+	categories, err := getCategories()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if categories == nil {
+		categories = []Category{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(categories); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+CategorySave creates or updates a category. Admins only. The priorities of the
+reports in the category are rescored in the background.
+*/
+func CategorySave(w http.ResponseWriter, r *http.Request) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !u.isAdmin() {
+		http.Error(w, "Admins only", http.StatusForbidden)
+		return
+	}
+	var c Category
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(body, &c); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if c.Code == "" || c.Name == "" {
+		http.Error(w, "Category needs a code and a name", http.StatusUnprocessableEntity)
+		return
+	}
+	if c.AckHours < 0 || c.ResolveHours < 0 {
+		http.Error(w, "SLA targets can't be negative", http.StatusUnprocessableEntity)
+		return
+	}
+	if c.Severity < 0 || c.Severity > maxSeverity {
+		http.Error(w, "Severity must be between 0 and 5", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := saveCategory(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	go refreshPriorities(&reportFilter{Categories: map[string]bool{c.Code: true}})
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
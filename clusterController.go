@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// clusterGrid is the number of cells per tile side for clusters, making
+	// cells of 64 pixels on 256 pixel tiles.
+	clusterGrid        = 4
+	defaultHeatmapGrid = 32
+	maxHeatmapGrid     = 128
+	maxClusterTiles    = 64
+)
+
+/*
+gridCell counts the reports in one cell of the grid laid over a tile. X and Y
+count from the west and north edge. Lat and Lng are the mean position of the
+reports. ReportID is set for cells holding a single report.
+*/
+type gridCell struct {
+	X          int            `json:"-"`
+	Y          int            `json:"-"`
+	Count      int            `json:"count"`
+	Lat        float64        `json:"lat"`
+	Lng        float64        `json:"long"`
+	ReportID   int            `json:"reportId,omitempty"`
+	Categories map[string]int `json:"categories"`
+}
+
+/*
+gridCount is a row of getTileGrid: the reports of one category in one cell.
+*/
+type gridCount struct {
+	Col, Row int
+	Category string
+	Count    int
+	Lat, Lng float64
+	MinID    int
+}
+
+/*
+filterVariant identifies the filters of a request in cache keys.
+*/
+func filterVariant(r *http.Request) string {
+	q := r.URL.Query()
+	v := url.Values{}
+	for _, name := range []string{"status", "category", "department", "since", "until"} {
+		if s := q.Get(name); s != "" {
+			v.Set(name, s)
+		}
+	}
+	return v.Encode()
+}
+
+/*
+tileGrid counts the reports matching the filter in an n by n grid over a tile.
+Rows of the grid are equally high on the map, so their latitude ranges differ.
+Results are cached per tile.
+*/
+func tileGrid(k tileKey, n int, f *reportFilter, variant string) ([]gridCell, error) {
+	cacheVariant := "grid" + strconv.Itoa(n) + "?" + variant
+	if v, ok := tiles.get(k, cacheVariant); ok {
+		return v.([]gridCell), nil
+	}
+
+	b := tileBBox(k.z, k.x, k.y)
+	// Latitudes between the rows, from south to north.
+	edges := make([]float64, n-1)
+	for i := range edges {
+		edges[i] = tileLat(k.z, float64(k.y)+float64(n-1-i)/float64(n))
+	}
+	counts, err := getTileGrid(b, n, edges, f)
+	if err != nil {
+		return nil, err
+	}
+
+	byCell := map[[2]int]*gridCell{}
+	var cells []gridCell
+	var order [][2]int
+	for _, c := range counts {
+		key := [2]int{c.Col, n - 1 - c.Row}
+		cell, ok := byCell[key]
+		if !ok {
+			cell = &gridCell{X: key[0], Y: key[1], Categories: map[string]int{}, ReportID: c.MinID}
+			byCell[key] = cell
+			order = append(order, key)
+		}
+		cell.Lat += c.Lat * float64(c.Count)
+		cell.Lng += c.Lng * float64(c.Count)
+		cell.Count += c.Count
+		cell.Categories[c.Category] += c.Count
+		if c.MinID < cell.ReportID {
+			cell.ReportID = c.MinID
+		}
+	}
+	for _, key := range order {
+		cell := byCell[key]
+		cell.Lat /= float64(cell.Count)
+		cell.Lng /= float64(cell.Count)
+		if cell.Count > 1 {
+			cell.ReportID = 0
+		}
+		cells = append(cells, *cell)
+	}
+
+	tiles.put(k, cacheVariant, cells)
+	return cells, nil
+}
+
+/*
+tileParams reads the z, x and y route variables.
+*/
+func tileParams(r *http.Request) (tileKey, error) {
+	v := mux.Vars(r)
+	z, err1 := strconv.Atoi(v["z"])
+	x, err2 := strconv.Atoi(v["x"])
+	y, err3 := strconv.Atoi(v["y"])
+	if err1 != nil || err2 != nil || err3 != nil || !validTile(z, x, y) {
+		return tileKey{}, errors.New("Invalid tile")
+	}
+	return tileKey{z, x, y}, nil
+}
+
+/*
+ReportClusters groups the reports in bbox for a map at zoom level zoom. Reports
+are clustered on a grid of 64 pixel cells aligned to the map tiles, so the
+clusters of a tile can be cached and reused by other viewports. Each cluster
+has its report count, mean position and counts per category. The filters of
+the report list apply, except bbox which is the viewport.
+*/
+func ReportClusters(w http.ResponseWriter, r *http.Request) {
+	zoom, err := strconv.Atoi(r.URL.Query().Get("zoom"))
+	if err != nil || zoom < 0 || zoom > maxTileZoom {
+		http.Error(w, "zoom must be between 0 and "+strconv.Itoa(maxTileZoom), http.StatusBadRequest)
+		return
+	}
+	f, err := reportFilterFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.Box == nil {
+		http.Error(w, errInvalidBBox.Error(), http.StatusBadRequest)
+		return
+	}
+	view := *f.Box
+	f.Box = nil
+
+	minX, minY := tileOf(view.MaxLat, view.MinLng, zoom)
+	maxX, maxY := tileOf(view.MinLat, view.MaxLng, zoom)
+	if (maxX-minX+1)*(maxY-minY+1) > maxClusterTiles {
+		http.Error(w, "bbox too large for this zoom level", http.StatusBadRequest)
+		return
+	}
+
+	variant := filterVariant(r)
+	clusters := []gridCell{}
+	for x := minX; x <= maxX; x++ {
+		for y := minY; y <= maxY; y++ {
+			cells, err := tileGrid(tileKey{zoom, x, y}, clusterGrid, f, variant)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			clusters = append(clusters, cells...)
+		}
+	}
+
+	resp := struct {
+		Zoom     int        `json:"zoom"`
+		Clusters []gridCell `json:"clusters"`
+	}{zoom, clusters}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+ReportHeatmap returns the report counts on a grid of grid by grid cells over a
+map tile, for drawing heatmaps. Cells without reports are left out. The filters
+of the report list apply.
+*/
+func ReportHeatmap(w http.ResponseWriter, r *http.Request) {
+	k, err := tileParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n := defaultHeatmapGrid
+	if s := r.URL.Query().Get("grid"); s != "" {
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxHeatmapGrid {
+			http.Error(w, "grid must be between 1 and "+strconv.Itoa(maxHeatmapGrid), http.StatusBadRequest)
+			return
+		}
+	}
+	f, err := reportFilterFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Box = nil
+
+	cells, err := tileGrid(k, n, f, filterVariant(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type heatCell struct {
+		X     int `json:"x"`
+		Y     int `json:"y"`
+		Count int `json:"count"`
+	}
+	resp := struct {
+		Z     int        `json:"z"`
+		X     int        `json:"x"`
+		Y     int        `json:"y"`
+		Grid  int        `json:"grid"`
+		Max   int        `json:"max"`
+		Cells []heatCell `json:"cells"`
+	}{Z: k.z, X: k.x, Y: k.y, Grid: n, Cells: []heatCell{}}
+	for _, c := range cells {
+		resp.Cells = append(resp.Cells, heatCell{c.X, c.Y, c.Count})
+		if c.Count > resp.Max {
+			resp.Max = c.Count
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
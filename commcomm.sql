@@ -2,8 +2,66 @@ CREATE DATABASE IF NOT EXISTS commcomm CHARACTER SET utf8 COLLATE utf8_unicode_c
 
 GRANT ALL PRIVILEGES ON commcomm.* TO 'commadmin'@'localhost' IDENTIFIED BY 'CommComm20!6';
 
-CREATE TABLE IF NOT EXISTS commcomm.users (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, username varchar(255) NOT NULL, password varchar(255) NOT NULL, created_date DATETIME NOT NULL, active int NOT NULL,UNIQUE(id), UNIQUE(username), PRIMARY KEY(id));
+CREATE TABLE IF NOT EXISTS commcomm.users (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, username varchar(255) NOT NULL, password varchar(255) NOT NULL, created_date DATETIME NOT NULL, active int NOT NULL, role varchar(32) NOT NULL DEFAULT 'resident',UNIQUE(id), UNIQUE(username), PRIMARY KEY(id));
 
-CREATE TABLE IF NOT EXISTS commcomm.reports (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, reporter_id BIGINT(20) NOT NULL, report_date DATETIME NOT NULL, longitude decimal(10,6) NOT NULL, latitude decimal(10,6) NOT NULL, description varchar(255) NOT NULL, location_info varchar(255), image_location varchar(255), active int NOT NULL, UNIQUE(id), PRIMARY KEY(id));
+CREATE TABLE IF NOT EXISTS commcomm.reports (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, reporter_id BIGINT(20) NOT NULL, report_date DATETIME NOT NULL, longitude decimal(10,6) NOT NULL, latitude decimal(10,6) NOT NULL, description varchar(255) NOT NULL, location_info varchar(255), image_location varchar(255), active int NOT NULL, status varchar(32) NOT NULL DEFAULT 'open', category varchar(64) NOT NULL DEFAULT '', accuracy double NULL, altitude double NULL, UNIQUE(id), PRIMARY KEY(id), INDEX(category), INDEX(latitude, longitude));
 
-CREATE TABLE IF NOT EXISTS commcomm.comments (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, report_id BIGINT(20) UNSIGNED NOT NULL, author_id BIGINT(20) UNSIGNED NOT NULL, comment_date DATETIME NOT NULL, message varchar(255) NOT NULL, active int NOT NULL, UNIQUE(id), PRIMARY KEY(id), FOREIGN KEY(report_id) REFERENCES commcomm.reports(id));
\ No newline at end of file
+CREATE TABLE IF NOT EXISTS commcomm.comments (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, report_id BIGINT(20) UNSIGNED NOT NULL, author_id BIGINT(20) UNSIGNED NOT NULL, comment_date DATETIME NOT NULL, message varchar(255) NOT NULL, active int NOT NULL, parent_id BIGINT(20) UNSIGNED NOT NULL DEFAULT 0, edited_date DATETIME NULL, visibility varchar(16) NOT NULL DEFAULT 'public', UNIQUE(id), PRIMARY KEY(id), INDEX(parent_id), FOREIGN KEY(report_id) REFERENCES commcomm.reports(id));
+
+CREATE TABLE IF NOT EXISTS commcomm.attachments (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, report_id BIGINT(20) UNSIGNED NOT NULL, uploader_id BIGINT(20) UNSIGNED NOT NULL, filename varchar(255) NOT NULL, visibility varchar(16) NOT NULL DEFAULT 'public', created_date DATETIME NOT NULL, active int NOT NULL, UNIQUE(id), PRIMARY KEY(id), FOREIGN KEY(report_id) REFERENCES commcomm.reports(id));
+
+CREATE TABLE IF NOT EXISTS commcomm.upload_sessions (id varchar(32) NOT NULL, report_id BIGINT(20) UNSIGNED NOT NULL, uploader_id BIGINT(20) UNSIGNED NOT NULL, filename varchar(255) NOT NULL, visibility varchar(16) NOT NULL, upload_length BIGINT(20) NOT NULL, upload_offset BIGINT(20) NOT NULL, checksum varchar(128) NOT NULL, created_date DATETIME NOT NULL, expires_date DATETIME NOT NULL, PRIMARY KEY(id), INDEX(expires_date));
+
+CREATE TABLE IF NOT EXISTS commcomm.comment_edits (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, comment_id BIGINT(20) UNSIGNED NOT NULL, editor_id BIGINT(20) UNSIGNED NOT NULL, message varchar(255) NOT NULL, edited_date DATETIME NOT NULL, UNIQUE(id), PRIMARY KEY(id), FOREIGN KEY(comment_id) REFERENCES commcomm.comments(id));
+
+CREATE TABLE IF NOT EXISTS commcomm.flags (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, target_type varchar(16) NOT NULL, target_id BIGINT(20) UNSIGNED NOT NULL, flagger_id BIGINT(20) UNSIGNED NOT NULL, reason varchar(32) NOT NULL, note varchar(255) NOT NULL, created_date DATETIME NOT NULL, status varchar(16) NOT NULL, UNIQUE(id), PRIMARY KEY(id), UNIQUE(target_type, target_id, flagger_id), INDEX(status));
+
+CREATE TABLE IF NOT EXISTS commcomm.moderation_log (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, moderator_id BIGINT(20) UNSIGNED NOT NULL, target_type varchar(16) NOT NULL, target_id BIGINT(20) UNSIGNED NOT NULL, action varchar(16) NOT NULL, note varchar(255) NOT NULL, created_date DATETIME NOT NULL, UNIQUE(id), PRIMARY KEY(id));
+
+CREATE TABLE IF NOT EXISTS commcomm.mentions (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, comment_id BIGINT(20) UNSIGNED NOT NULL, report_id BIGINT(20) UNSIGNED NOT NULL, author_id BIGINT(20) UNSIGNED NOT NULL, user_id BIGINT(20) UNSIGNED NOT NULL, created_date DATETIME NOT NULL, read_date DATETIME NULL, UNIQUE(id), PRIMARY KEY(id), UNIQUE(comment_id, user_id), INDEX(user_id, created_date), FOREIGN KEY(comment_id) REFERENCES commcomm.comments(id));
+
+CREATE TABLE IF NOT EXISTS commcomm.status_history (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, report_id BIGINT(20) UNSIGNED NOT NULL, status varchar(32) NOT NULL, changed_by BIGINT(20) UNSIGNED NOT NULL, note varchar(255) NOT NULL, changed_date DATETIME NOT NULL, UNIQUE(id), PRIMARY KEY(id), INDEX(report_id, changed_date), FOREIGN KEY(report_id) REFERENCES commcomm.reports(id));
+
+CREATE TABLE IF NOT EXISTS commcomm.follows (report_id BIGINT(20) UNSIGNED NOT NULL, user_id BIGINT(20) UNSIGNED NOT NULL, created_date DATETIME NOT NULL, PRIMARY KEY(report_id, user_id), INDEX(user_id), FOREIGN KEY(report_id) REFERENCES commcomm.reports(id));
+
+CREATE TABLE IF NOT EXISTS commcomm.notification_preferences (user_id BIGINT(20) UNSIGNED NOT NULL, channel varchar(16) NOT NULL, event_type varchar(32) NOT NULL, enabled int NOT NULL, PRIMARY KEY(user_id, channel, event_type));
+
+CREATE TABLE IF NOT EXISTS commcomm.categories (code varchar(64) NOT NULL, name varchar(255) NOT NULL, department varchar(255) NOT NULL, ack_hours int NOT NULL DEFAULT 0, resolve_hours int NOT NULL DEFAULT 0, severity int NOT NULL DEFAULT 0, PRIMARY KEY(code));
+
+CREATE TABLE IF NOT EXISTS commcomm.subscriptions (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, user_id BIGINT(20) UNSIGNED NOT NULL, name varchar(255) NOT NULL, lat double NOT NULL, lng double NOT NULL, radius double NOT NULL, area MEDIUMTEXT NULL, min_lat double NOT NULL, min_lng double NOT NULL, max_lat double NOT NULL, max_lng double NOT NULL, categories varchar(1024) NOT NULL, delivery varchar(16) NOT NULL, created_date DATETIME NOT NULL, active int NOT NULL, UNIQUE(id), PRIMARY KEY(id), INDEX(user_id), INDEX(min_lat, max_lat));
+
+CREATE TABLE IF NOT EXISTS commcomm.subscription_digest (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, user_id BIGINT(20) UNSIGNED NOT NULL, subscription_id BIGINT(20) UNSIGNED NOT NULL, report_id BIGINT(20) UNSIGNED NOT NULL, created_date DATETIME NOT NULL, UNIQUE(id), PRIMARY KEY(id), UNIQUE(user_id, report_id));
+
+CREATE TABLE IF NOT EXISTS commcomm.notifications (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, user_id BIGINT(20) UNSIGNED NOT NULL, type varchar(32) NOT NULL, report_id BIGINT(20) UNSIGNED NOT NULL, comment_id BIGINT(20) UNSIGNED NOT NULL, title varchar(255) NOT NULL, body TEXT NOT NULL, created_date DATETIME NOT NULL, read_date DATETIME NULL, UNIQUE(id), PRIMARY KEY(id), INDEX(user_id, created_date), INDEX(created_date));
+
+CREATE TABLE IF NOT EXISTS commcomm.devices (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, user_id BIGINT(20) UNSIGNED NOT NULL, platform varchar(16) NOT NULL, token varchar(1024) CHARACTER SET ascii NOT NULL, p256dh varchar(128) NOT NULL, auth varchar(64) NOT NULL, created_date DATETIME NOT NULL, last_used DATETIME NOT NULL, active TINYINT(1) NOT NULL, UNIQUE(id), PRIMARY KEY(id), UNIQUE(platform, token), INDEX(user_id));
+
+CREATE TABLE IF NOT EXISTS commcomm.webhooks (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, url varchar(2048) NOT NULL, secret varchar(128) NOT NULL, events varchar(255) NOT NULL, description varchar(255) NOT NULL, created_by BIGINT(20) UNSIGNED NOT NULL, created_date DATETIME NOT NULL, active TINYINT(1) NOT NULL, failures INT NOT NULL, disabled_date DATETIME NULL, UNIQUE(id), PRIMARY KEY(id));
+
+CREATE TABLE IF NOT EXISTS commcomm.webhook_deliveries (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, webhook_id BIGINT(20) UNSIGNED NOT NULL, event varchar(64) NOT NULL, payload MEDIUMTEXT NOT NULL, status varchar(16) NOT NULL, attempts INT NOT NULL, response_code INT NOT NULL, response varchar(1024) NOT NULL, next_attempt DATETIME NULL, last_attempt DATETIME NULL, created_date DATETIME NOT NULL, UNIQUE(id), PRIMARY KEY(id), INDEX(webhook_id, id), INDEX(status, next_attempt));
+
+CREATE TABLE IF NOT EXISTS commcomm.events (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, type varchar(64) NOT NULL, report_id BIGINT(20) UNSIGNED NOT NULL, payload MEDIUMTEXT NOT NULL, staff_only TINYINT(1) NOT NULL, located TINYINT(1) NOT NULL, lat DOUBLE NOT NULL, lng DOUBLE NOT NULL, category varchar(64) NOT NULL, department varchar(255) NOT NULL, created_date DATETIME NOT NULL, UNIQUE(id), PRIMARY KEY(id), INDEX(created_date));
+
+CREATE TABLE IF NOT EXISTS commcomm.open311_tokens (token varchar(64) NOT NULL, report_id BIGINT(20) UNSIGNED NOT NULL, created_date DATETIME NOT NULL, PRIMARY KEY(token));
+
+CREATE TABLE IF NOT EXISTS commcomm.imports (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, user_id BIGINT(20) UNSIGNED NOT NULL, format varchar(16) NOT NULL, dry_run TINYINT(1) NOT NULL, total INT NOT NULL, imported INT NOT NULL, rejected INT NOT NULL, error_report varchar(255) NOT NULL, created_date DATETIME NOT NULL, aborted varchar(1024) NOT NULL DEFAULT '', UNIQUE(id), PRIMARY KEY(id));
+
+CREATE TABLE IF NOT EXISTS commcomm.votes (report_id BIGINT(20) UNSIGNED NOT NULL, user_id BIGINT(20) UNSIGNED NOT NULL, created_date DATETIME NOT NULL, PRIMARY KEY(report_id, user_id), INDEX(user_id), FOREIGN KEY(report_id) REFERENCES commcomm.reports(id));
+
+CREATE TABLE IF NOT EXISTS commcomm.boundary_sets (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, name varchar(255) NOT NULL, description varchar(1024) NOT NULL, created_by BIGINT(20) UNSIGNED NOT NULL, created_date DATETIME NOT NULL, active int NOT NULL, UNIQUE(id), PRIMARY KEY(id));
+
+CREATE TABLE IF NOT EXISTS commcomm.boundary_areas (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, set_id BIGINT(20) UNSIGNED NOT NULL, name varchar(255) NOT NULL, code varchar(64) NOT NULL, geometry LONGTEXT NOT NULL, min_lat double NOT NULL, min_lng double NOT NULL, max_lat double NOT NULL, max_lng double NOT NULL, UNIQUE(id), PRIMARY KEY(id), INDEX(set_id), FOREIGN KEY(set_id) REFERENCES commcomm.boundary_sets(id));
+
+CREATE TABLE IF NOT EXISTS commcomm.report_areas (report_id BIGINT(20) UNSIGNED NOT NULL, set_id BIGINT(20) UNSIGNED NOT NULL, area_id BIGINT(20) UNSIGNED NOT NULL, PRIMARY KEY(report_id, set_id), INDEX(set_id, area_id), FOREIGN KEY(report_id) REFERENCES commcomm.reports(id));
+
+CREATE TABLE IF NOT EXISTS commcomm.sla_escalations (report_id BIGINT(20) UNSIGNED NOT NULL, stage varchar(16) NOT NULL, escalated_date DATETIME NOT NULL, PRIMARY KEY(report_id, stage), FOREIGN KEY(report_id) REFERENCES commcomm.reports(id));
+
+CREATE TABLE IF NOT EXISTS commcomm.address_points (id BIGINT(20) UNSIGNED AUTO_INCREMENT NOT NULL, number varchar(32) NOT NULL, street varchar(255) NOT NULL, city varchar(255) NOT NULL, postcode varchar(32) NOT NULL, latitude double NOT NULL, longitude double NOT NULL, search varchar(600) NOT NULL, UNIQUE(id), PRIMARY KEY(id), INDEX(latitude, longitude));
+
+CREATE TABLE IF NOT EXISTS commcomm.email_verifications (user_id BIGINT(20) UNSIGNED NOT NULL, email varchar(255) NOT NULL, token varchar(64) NOT NULL, sent_date DATETIME NOT NULL, verified_date DATETIME NULL, PRIMARY KEY(user_id), UNIQUE(token));
+
+CREATE TABLE IF NOT EXISTS commcomm.user_trust (user_id BIGINT(20) UNSIGNED NOT NULL, computed INT NOT NULL, updated_date DATETIME NOT NULL, PRIMARY KEY(user_id));
+
+CREATE TABLE IF NOT EXISTS commcomm.trust_overrides (user_id BIGINT(20) UNSIGNED NOT NULL, score INT NOT NULL, note varchar(255) NOT NULL, set_by BIGINT(20) UNSIGNED NOT NULL, set_date DATETIME NOT NULL, PRIMARY KEY(user_id));
+
+CREATE TABLE IF NOT EXISTS commcomm.report_priority (report_id BIGINT(20) UNSIGNED NOT NULL, score double NOT NULL, factors TEXT NOT NULL, updated_date DATETIME NOT NULL, PRIMARY KEY(report_id), INDEX(score), FOREIGN KEY(report_id) REFERENCES commcomm.reports(id));
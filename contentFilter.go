@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+Actions a content rule can take when it matches. Reject refuses the content,
+hold stores it hidden until a moderator looks at it and mask replaces the
+matched text with asterisks.
+*/
+const (
+	FilterReject = "reject"
+	FilterHold   = "hold"
+	FilterMask   = "mask"
+)
+
+const flagReasonFilter = "filter"
+
+/*
+Policies for anonymous content, see FilterConfig.
+*/
+const (
+	AnonymousAllow  = "allow"
+	AnonymousHold   = FilterHold
+	AnonymousReject = FilterReject
+)
+
+var anonymousPolicy = AnonymousHold
+
+/*
+FilterConfig configures the content filter run on reports and comments.
+WordLists maps a locale such as "en" to the words to filter for requests in that
+locale, DefaultLocale is used for requests without a known locale. Phone, Email
+and LicensePlate set the action for the corresponding personal information and
+are off when empty. LicensePlatePattern overrides the built in plate format.
+Links sets the action for links posted by accounts younger than
+LinkMinAccountDays or with a trust score below LinkMinTrust, which is off at 0.
+Anonymous says what happens to reports and comments posted without an account:
+they are held for moderation by default, "allow" publishes them and "reject"
+requires authentication.
+*/
+type FilterConfig struct {
+	WordLists           map[string]WordList `json:"wordLists"`
+	DefaultLocale       string              `json:"defaultLocale"`
+	Phone               string              `json:"phone"`
+	Email               string              `json:"email"`
+	LicensePlate        string              `json:"licensePlate"`
+	LicensePlatePattern string              `json:"licensePlatePattern"`
+	Links               string              `json:"links"`
+	LinkMinAccountDays  int                 `json:"linkMinAccountDays"`
+	LinkMinTrust        int                 `json:"linkMinTrust"`
+	Anonymous           string              `json:"anonymous"`
+}
+
+/*
+WordList is a list of words filtered with the same action.
+*/
+type WordList struct {
+	Words  []string `json:"words"`
+	Action string   `json:"action"`
+}
+
+/*
+FilterContext describes who wrote the content being filtered. Author is nil for
+anonymous content.
+*/
+type FilterContext struct {
+	Author *User
+	Locale string
+}
+
+/*
+ContentRule is a single check of the content filter. Match returns the byte
+ranges of text the rule objects to, in the form of regexp.FindAllStringIndex.
+*/
+type ContentRule interface {
+	Name() string
+	Action() string
+	Match(text string, ctx *FilterContext) [][]int
+}
+
+/*
+FilterResult is the outcome of running the content filter. Text is the content
+with all masks applied and Rules names the rules which matched.
+*/
+type FilterResult struct {
+	Text     string
+	Action   string
+	Rules    []string
+	Rejected bool
+	Held     bool
+}
+
+type regexpRule struct {
+	name    string
+	action  string
+	pattern *regexp.Regexp
+	applies func(ctx *FilterContext) bool
+}
+
+func (r *regexpRule) Name() string   { return r.name }
+func (r *regexpRule) Action() string { return r.action }
+
+func (r *regexpRule) Match(text string, ctx *FilterContext) [][]int {
+	if r.applies != nil && !r.applies(ctx) {
+		return nil
+	}
+	return r.pattern.FindAllStringIndex(text, -1)
+}
+
+/*
+wordRule finds the words of a word list. The pattern captures the word between
+a boundary on either side, anything but a letter or digit, which unlike \b works
+for all scripts. Matching resumes after the word so a boundary can be shared by
+two words.
+*/
+type wordRule struct {
+	regexpRule
+}
+
+func (r *wordRule) Match(text string, ctx *FilterContext) [][]int {
+	if r.applies != nil && !r.applies(ctx) {
+		return nil
+	}
+	var matches [][]int
+	for start := 0; start < len(text); {
+		m := r.pattern.FindStringSubmatchIndex(text[start:])
+		if m == nil {
+			break
+		}
+		matches = append(matches, []int{start + m[2], start + m[3]})
+		start += m[3]
+	}
+	return matches
+}
+
+/*
+emailRule finds email addresses, except those used as the handle of an
+@mention such as "@jane@example.com", which names a user.
+*/
+type emailRule struct {
+	regexpRule
+}
+
+func (r *emailRule) Match(text string, ctx *FilterContext) [][]int {
+	matches := r.regexpRule.Match(text, ctx)
+	if len(matches) == 0 {
+		return nil
+	}
+	handles := map[int]bool{}
+	for _, m := range mentionPattern.FindAllStringSubmatchIndex(text, -1) {
+		handles[m[2]] = true
+	}
+	var addresses [][]int
+	for _, m := range matches {
+		if !handles[m[0]] {
+			addresses = append(addresses, m)
+		}
+	}
+	return addresses
+}
+
+const defaultLicensePlatePattern = `\b(?:[A-Z]{3}[- ]?[0-9]{3,4}|[0-9]{3}[- ]?[A-Z]{3})\b`
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	phonePattern = regexp.MustCompile(`(?:\+?[0-9]{1,3}[\s.-]?)?\(?[0-9]{3}\)?[\s.-]?[0-9]{3}[\s.-]?[0-9]{4}\b`)
+	linkPattern  = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+)
+
+var contentRules []ContentRule
+
+/*
+registerContentRule adds a rule to the content filter. Rules run in the order
+they were registered.
+*/
+func registerContentRule(r ContentRule) {
+	contentRules = append(contentRules, r)
+}
+
+func validFilterAction(action string) bool {
+	return action == FilterReject || action == FilterHold || action == FilterMask
+}
+
+/*
+checkFilterActions makes sure every rule switched on in the configuration has
+an action the filter knows, so a typo doesn't silently let content through.
+*/
+func checkFilterActions(c FilterConfig) error {
+	for locale, list := range c.WordLists {
+		if len(list.Words) > 0 && !validFilterAction(list.Action) {
+			return fmt.Errorf("unknown filter action %q for the %s word list", list.Action, locale)
+		}
+	}
+	rules := []struct{ name, action string }{
+		{"email", c.Email}, {"phone", c.Phone}, {"licensePlate", c.LicensePlate}, {"links", c.Links},
+	}
+	for _, r := range rules {
+		if r.action != "" && !validFilterAction(r.action) {
+			return fmt.Errorf("unknown filter action %q for %s", r.action, r.name)
+		}
+	}
+	return nil
+}
+
+/*
+initContentFilter registers the rules described by the configuration.
+*/
+func initContentFilter(c FilterConfig) error {
+	switch c.Anonymous {
+	case "":
+	case AnonymousAllow, AnonymousHold, AnonymousReject:
+		anonymousPolicy = c.Anonymous
+	default:
+		return errors.New("unknown anonymous content policy " + c.Anonymous)
+	}
+	if err := checkFilterActions(c); err != nil {
+		return err
+	}
+	for locale, list := range c.WordLists {
+		var words []string
+		for _, word := range list.Words {
+			if word != "" {
+				words = append(words, regexp.QuoteMeta(word))
+			}
+		}
+		if len(words) == 0 {
+			continue
+		}
+		// Longest first, so a phrase wins over a word it starts with.
+		sort.SliceStable(words, func(i, j int) bool { return len(words[i]) > len(words[j]) })
+		pattern, err := regexp.Compile(`(?i)(?:^|[^\p{L}\p{N}])(` + strings.Join(words, "|") + `)(?:$|[^\p{L}\p{N}])`)
+		if err != nil {
+			return err
+		}
+		l, def := locale, c.DefaultLocale
+		registerContentRule(&wordRule{regexpRule{"words:" + locale, list.Action, pattern, func(ctx *FilterContext) bool {
+			if _, ok := c.WordLists[ctx.Locale]; ok {
+				return ctx.Locale == l
+			}
+			return l == def
+		}}})
+	}
+	if c.Email != "" {
+		registerContentRule(&emailRule{regexpRule{"email", c.Email, emailPattern, nil}})
+	}
+	if c.Phone != "" {
+		registerContentRule(&regexpRule{"phone", c.Phone, phonePattern, nil})
+	}
+	if c.LicensePlate != "" {
+		p := c.LicensePlatePattern
+		if p == "" {
+			p = defaultLicensePlatePattern
+		}
+		pattern, err := regexp.Compile(p)
+		if err != nil {
+			return err
+		}
+		registerContentRule(&regexpRule{"licensePlate", c.LicensePlate, pattern, nil})
+	}
+	if c.Links != "" {
+		minAge := time.Duration(c.LinkMinAccountDays) * 24 * time.Hour
+		registerContentRule(&regexpRule{"links", c.Links, linkPattern, func(ctx *FilterContext) bool {
+			return ctx.Author == nil || time.Since(ctx.Author.Date) < minAge ||
+				c.LinkMinTrust > 0 && trustScore(int64(ctx.Author.ID)) < c.LinkMinTrust
+		}})
+	}
+	return nil
+}
+
+/*
+requestLocale returns the primary language of the Accept-Language header.
+*/
+func requestLocale(r *http.Request) string {
+	lang := r.Header.Get("Accept-Language")
+	if i := strings.IndexAny(lang, ",;"); i >= 0 {
+		lang = lang[:i]
+	}
+	if i := strings.Index(lang, "-"); i >= 0 {
+		lang = lang[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(lang))
+}
+
+func maskRanges(text string, ranges [][]int) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range ranges {
+		if m[0] < last {
+			continue
+		}
+		b.WriteString(text[last:m[0]])
+		b.WriteString(strings.Repeat("*", utf8.RuneCountInString(text[m[0]:m[1]])))
+		last = m[1]
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+/*
+filterContent runs text through all content rules. Masks are applied to the
+returned text even when another rule rejects or holds the content. Anonymous
+content is held unless the anonymous policy allows it.
+*/
+func filterContent(text string, ctx *FilterContext) FilterResult {
+	res := FilterResult{Text: text}
+	for _, rule := range contentRules {
+		matches := rule.Match(res.Text, ctx)
+		if len(matches) == 0 {
+			continue
+		}
+		res.Rules = append(res.Rules, rule.Name())
+		switch rule.Action() {
+		case FilterReject:
+			res.Rejected = true
+		case FilterHold:
+			res.Held = true
+		case FilterMask:
+			res.Text = maskRanges(res.Text, matches)
+		}
+	}
+	if ctx.Author == nil && anonymousPolicy != AnonymousAllow {
+		res.Rules = append(res.Rules, "anonymous")
+		res.Held = true
+	}
+	switch {
+	case res.Rejected:
+		res.Action = FilterReject
+	case res.Held:
+		res.Action = FilterHold
+	case len(res.Rules) > 0:
+		res.Action = FilterMask
+	}
+	return res
+}
+
+/*
+contentFilterRequest builds the filter context for a request by author, which
+may be nil.
+*/
+func contentFilterRequest(r *http.Request, author *User) *FilterContext {
+	return &FilterContext{Author: author, Locale: requestLocale(r)}
+}
+
+/*
+contentActive is the active state held content is stored with, so it is never
+visible before a moderator looked at it.
+*/
+func contentActive(res FilterResult) int {
+	if res.Held {
+		return activeHidden
+	}
+	return activeVisible
+}
+
+/*
+holdForModeration puts content stored hidden in the moderation queue with the
+names of the rules which caught it.
+*/
+func holdForModeration(targetType string, id int64, res FilterResult) error {
+	note := strings.Join(res.Rules, ",")
+	_, err := insertFlag(&Flag{TargetType: targetType, TargetID: int(id), Reason: flagReasonFilter, Note: note})
+	if err == errAlreadyFlagged {
+		// Held before, e.g. when an edit trips the filter again.
+		return reopenFlag(targetType, id, 0, note)
+	}
+	return err
+}
+
+/*
+writeRejected answers a request whose content the filter refused.
+*/
+func writeRejected(w http.ResponseWriter, res FilterResult) {
+	http.Error(w, "Content rejected by filter: "+strings.Join(res.Rules, ", "), http.StatusUnprocessableEntity)
+}
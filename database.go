@@ -2,6 +2,11 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -106,7 +111,7 @@ func GetUserByEmail(username string) (*User, error) {
 		return &u, err
 	}
 
-	err = row.Scan(&u.ID, &u.Email, &u.Password, &u.Date, &u.Active)
+	err = row.Scan(&u.ID, &u.Email, &u.Password, &u.Date, &u.Active, &u.Role)
 	if err != nil {
 		return nil, err
 	}
@@ -129,7 +134,7 @@ func GetUserByID(id int64) (*User, error) {
 		return &u, err
 	}
 
-	err = row.Scan(&u.ID, &u.Email, &u.Password, &u.Date, &u.Active)
+	err = row.Scan(&u.ID, &u.Email, &u.Password, &u.Date, &u.Active, &u.Role)
 	if err != nil {
 		return nil, err
 	}
@@ -150,7 +155,7 @@ func GetAllUsers() ([]User, error) {
 
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Email, &u.Password, &u.Date, &u.Active); err != nil {
+		if err := rows.Scan(&u.ID, &u.Email, &u.Password, &u.Date, &u.Active, &u.Role); err != nil {
 			return nil, err
 		}
 		u.Password = ""
@@ -160,20 +165,57 @@ func GetAllUsers() ([]User, error) {
 	return users, nil
 }
 
-func getAllReports() ([]Report, error) {
-	rows, err := db.Query("SELECT * FROM reports where active=1")
+/*
+eachReport calls fn for every visible report matching the filter, in order of
+id, while reading them from the database. It stops at the first error.
+*/
+func eachReport(f *reportFilter, fn func(r *Report) error) error {
+	return queryEachReport("r.active=1", f, fn)
+}
+
+/*
+eachStoredReport is eachReport including hidden reports, such as those held for
+moderation, which can still be restored. Only deactivated reports are left out.
+*/
+func eachStoredReport(f *reportFilter, fn func(r *Report) error) error {
+	return queryEachReport("r.active<>-1", f, fn)
+}
+
+func queryEachReport(active string, f *reportFilter, fn func(r *Report) error) error {
+	cond, args := f.where()
+	stmt, err := db.Prepare("SELECT r.* FROM reports r where " + active + cond + " ORDER BY r.id")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var reports []Report
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var r Report
-		if err := rows.Scan(&r.ID, &r.ReporterID, &r.Date, &r.Long, &r.Lat, &r.Description, &r.LocationInfo, &r.ImageLocation, &r.Active); err != nil {
-			return nil, err
+		if err := scanReport(rows, &r); err != nil {
+			return err
 		}
-		reports = append(reports, r)
+		if err := fn(&r); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func getReports(f *reportFilter) ([]Report, error) {
+	var reports []Report
+
+	err := eachReport(f, func(r *Report) error {
+		reports = append(reports, *r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return reports, nil
@@ -194,7 +236,7 @@ func getReportsByUser(id int64) ([]Report, error) {
 
 	for rows.Next() {
 		var r Report
-		if err := rows.Scan(&r.ID, &r.ReporterID, &r.Date, &r.Long, &r.Lat, &r.Description, &r.LocationInfo, &r.ImageLocation, &r.Active); err != nil {
+		if err := scanReport(rows, &r); err != nil {
 			return nil, err
 		}
 		reports = append(reports, r)
@@ -215,24 +257,45 @@ func getSpecificReport(id int64) (*Report, error) {
 	}
 
 	var r Report
-	if err := row.Scan(&r.ID, &r.ReporterID, &r.Date, &r.Long, &r.Lat, &r.Description, &r.LocationInfo, &r.ImageLocation, &r.Active); err != nil {
+	if err := scanReport(row, &r); err != nil {
 		return nil, err
 	}
 
 	return &r, nil
 }
 
+/*
+rowScanner is implemented by both *sql.Row and *sql.Rows.
+*/
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanReport(s rowScanner, r *Report) error {
+	return s.Scan(&r.ID, &r.ReporterID, &r.Date, &r.Long, &r.Lat, &r.Description, &r.LocationInfo, &r.ImageLocation, &r.Active, &r.Status, &r.Category, &r.Accuracy, &r.Altitude)
+}
+
+func scanComment(s rowScanner, c *Comment) error {
+	err := s.Scan(&c.ID, &c.ReportID, &c.AuthorID, &c.Date, &c.Message, &c.Active, &c.ParentID, &c.EditedDate, &c.Visibility)
+	c.Edited = c.EditedDate != nil
+	return err
+}
+
 func closeDb() {
 	db.Close()
 }
 
-func getReportComments(id int64) ([]Comment, error) {
-	stmt, err := db.Prepare("SELECT * FROM comments where active=1 AND report_id=?")
+/*
+getReportComments returns the active comments of a report. Internal staff notes
+are only selected when includeInternal is set.
+*/
+func getReportComments(id int64, includeInternal bool) ([]Comment, error) {
+	stmt, err := db.Prepare("SELECT * FROM comments where active=1 AND report_id=? AND (visibility=? OR ?)")
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := stmt.Query(id)
+	rows, err := stmt.Query(id, CommentPublic, includeInternal)
 	if err != nil {
 		return nil, err
 	}
@@ -241,7 +304,7 @@ func getReportComments(id int64) ([]Comment, error) {
 
 	for rows.Next() {
 		var c Comment
-		if err := rows.Scan(&c.ID, &c.ReportID, &c.AuthorID, &c.Date, &c.Message, &c.Active); err != nil {
+		if err := scanComment(rows, &c); err != nil {
 			return nil, err
 		}
 		comments = append(comments, c)
@@ -250,13 +313,13 @@ func getReportComments(id int64) ([]Comment, error) {
 	return comments, nil
 }
 
-func insertReport(r *Report) (*Report, error) {
-	stmt, err := db.Prepare("INSERT reports SET reporter_id=?,report_date=?,longitude=?,latitude=?,description=?,location_info=?,image_location=?,active=1")
+func insertReport(r *Report, active int) (*Report, error) {
+	stmt, err := db.Prepare("INSERT reports SET reporter_id=?,report_date=?,longitude=?,latitude=?,description=?,location_info=?,image_location=?,active=?,status=?,category=?,accuracy=?,altitude=?")
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := stmt.Exec(r.ReporterID, time.Now().Format(time.RFC1123), r.Long, r.Lat, r.Description, r.LocationInfo, "")
+	res, err := stmt.Exec(r.ReporterID, time.Now().Format(time.RFC1123), r.Long, r.Lat, r.Description, r.LocationInfo, "", active, StatusOpen, r.Category, r.Accuracy, r.Altitude)
 	if err != nil {
 		return nil, err
 	}
@@ -274,13 +337,13 @@ func insertReport(r *Report) (*Report, error) {
 	return report, nil
 }
 
-func insertComment(c *Comment) (*Comment, error) {
-	stmt, err := db.Prepare("INSERT comments SET report_id=?,author_id=?,comment_date=?,message=?,active=1")
+func insertComment(c *Comment, active int) (*Comment, error) {
+	stmt, err := db.Prepare("INSERT comments SET report_id=?,author_id=?,comment_date=?,message=?,active=?,parent_id=?,visibility=?")
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := stmt.Exec(c.ReportID, c.AuthorID, time.Now().Format(time.RFC1123), c.Message)
+	res, err := stmt.Exec(c.ReportID, c.AuthorID, time.Now().Format(time.RFC1123), c.Message, active, c.ParentID, c.Visibility)
 	if err != nil {
 		return nil, err
 	}
@@ -311,7 +374,7 @@ func getReportByID(id int64) (*Report, error) {
 		return nil, err
 	}
 
-	err = row.Scan(&r.ID, &r.ReporterID, &r.Date, &r.Long, &r.Lat, &r.Description, &r.LocationInfo, &r.ImageLocation, &r.Active)
+	err = scanReport(row, &r)
 	if err != nil {
 		return nil, err
 	}
@@ -329,7 +392,7 @@ func getCommentByID(id int64) (*Comment, error) {
 
 	row := stmt.QueryRow(id)
 
-	err = row.Scan(&c.ID, &c.ReportID, &c.AuthorID, &c.Date, &c.Message, &c.Active)
+	err = scanComment(row, &c)
 	if err != nil {
 		return nil, err
 	}
@@ -347,7 +410,7 @@ func deactivateUserByID(id int64) (*User, error) {
 
 	row := stmt.QueryRow(id)
 
-	err = row.Scan(&u.ID, &u.Email, &u.Password, &u.Date, &u.Active)
+	err = row.Scan(&u.ID, &u.Email, &u.Password, &u.Date, &u.Active, &u.Role)
 	if err != nil {
 		return nil, err
 	}
@@ -375,7 +438,7 @@ func deactivateReportByID(id int64) (*Report, error) {
 
 	row := stmt.QueryRow(id)
 
-	err = row.Scan(&r.ID, &r.ReporterID, &r.Date, &r.Long, &r.Lat, &r.Description, &r.LocationInfo, &r.ImageLocation, &r.Active)
+	err = scanReport(row, &r)
 	if err != nil {
 		return nil, err
 	}
@@ -403,12 +466,12 @@ func deactivateCommentByID(reportID, commentID int64) (*Comment, error) {
 
 	row := stmt.QueryRow(commentID, reportID)
 
-	err = row.Scan(&c.ID, &c.ReportID, &c.AuthorID, &c.Date, &c.Message, &c.Active)
+	err = scanComment(row, &c)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = db.Prepare("UPDATE comments set active=-1 where id=? and report_id=?")
+	stmt, err = db.Prepare("UPDATE comments set active=-1 where id=? and report_id=?")
 	if err != nil {
 		return nil, err
 	}
@@ -420,3 +483,2181 @@ func deactivateCommentByID(reportID, commentID int64) (*Comment, error) {
 
 	return &c, nil
 }
+
+func insertAttachment(a *Attachment) (*Attachment, error) {
+	stmt, err := db.Prepare("INSERT attachments SET report_id=?,uploader_id=?,filename=?,visibility=?,created_date=?,active=1")
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := stmt.Exec(a.ReportID, a.UploaderID, a.Filename, a.Visibility, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return getAttachmentByID(id)
+}
+
+func getAttachmentByID(id int64) (*Attachment, error) {
+	var a Attachment
+
+	stmt, err := db.Prepare("SELECT * FROM attachments where active=1 AND id=?")
+	if err != nil {
+		return nil, err
+	}
+
+	row := stmt.QueryRow(id)
+
+	err = row.Scan(&a.ID, &a.ReportID, &a.UploaderID, &a.Filename, &a.Visibility, &a.Date, &a.Active)
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+func getReportAttachments(reportID int64) ([]Attachment, error) {
+	stmt, err := db.Prepare("SELECT * FROM attachments where active=1 AND report_id=?")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(reportID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.ReportID, &a.UploaderID, &a.Filename, &a.Visibility, &a.Date, &a.Active); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+
+	return attachments, nil
+}
+
+func insertUploadSession(s *UploadSession) error {
+	stmt, err := db.Prepare("INSERT upload_sessions SET id=?,report_id=?,uploader_id=?,filename=?,visibility=?,upload_length=?,upload_offset=0,checksum=?,created_date=?,expires_date=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(s.ID, s.ReportID, s.UploaderID, s.Filename, s.Visibility, s.Length, s.Checksum, time.Now(), s.Expires)
+	return err
+}
+
+func getUploadSession(id string) (*UploadSession, error) {
+	var s UploadSession
+
+	stmt, err := db.Prepare("SELECT * FROM upload_sessions where id=?")
+	if err != nil {
+		return nil, err
+	}
+
+	row := stmt.QueryRow(id)
+
+	err = row.Scan(&s.ID, &s.ReportID, &s.UploaderID, &s.Filename, &s.Visibility, &s.Length, &s.Offset, &s.Checksum, &s.Date, &s.Expires)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func updateUploadOffset(id string, offset int64, expires time.Time) error {
+	stmt, err := db.Prepare("UPDATE upload_sessions set upload_offset=?,expires_date=? where id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(offset, expires, id)
+	return err
+}
+
+func deleteUploadSession(id string) error {
+	stmt, err := db.Prepare("DELETE FROM upload_sessions where id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(id)
+	return err
+}
+
+func getExpiredUploadSessions(now time.Time) ([]string, error) {
+	stmt, err := db.Prepare("SELECT id FROM upload_sessions where expires_date<?")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+/*
+getReportCommentThread returns every comment of a report including deactivated
+ones, which are needed to keep the replies to them in place when building threads.
+Internal staff notes are only selected when includeInternal is set.
+*/
+func getReportCommentThread(id int64, includeInternal bool) ([]Comment, error) {
+	stmt, err := db.Prepare("SELECT * FROM comments where report_id=? AND (visibility=? OR ?) ORDER BY comment_date, id")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(id, CommentPublic, includeInternal)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []Comment
+
+	for rows.Next() {
+		var c Comment
+		if err := scanComment(rows, &c); err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+
+	return comments, nil
+}
+
+/*
+updateCommentMessage changes the message of a comment and records the previous
+message in the edit history, both in one transaction.
+*/
+func updateCommentMessage(c *Comment, editorID int, message string, active int) (*Comment, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.Exec("INSERT comment_edits SET comment_id=?,editor_id=?,message=?,edited_date=?", c.ID, editorID, c.Message, now)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE comments set message=?,edited_date=?,active=? where id=?", message, now, active, c.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return getCommentByID(int64(c.ID))
+}
+
+func getCommentEdits(commentID int64) ([]CommentEdit, error) {
+	stmt, err := db.Prepare("SELECT * FROM comment_edits where comment_id=? ORDER BY edited_date, id")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(commentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var edits []CommentEdit
+
+	for rows.Next() {
+		var e CommentEdit
+		if err := rows.Scan(&e.ID, &e.CommentID, &e.EditorID, &e.Message, &e.Date); err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+
+	return edits, nil
+}
+
+/*
+insertFlag records a flag. A user can only flag the same content once, further
+attempts return errAlreadyFlagged.
+*/
+func insertFlag(f *Flag) (*Flag, error) {
+	stmt, err := db.Prepare("INSERT IGNORE flags SET target_type=?,target_id=?,flagger_id=?,reason=?,note=?,created_date=?,status=?")
+	if err != nil {
+		return nil, err
+	}
+
+	f.Date = time.Now()
+	f.Status = FlagOpen
+	res, err := stmt.Exec(f.TargetType, f.TargetID, f.FlaggerID, f.Reason, f.Note, f.Date, f.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errAlreadyFlagged
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	f.ID = int(id)
+
+	return f, nil
+}
+
+func reopenFlag(targetType string, id int64, flaggerID int, note string) error {
+	stmt, err := db.Prepare("UPDATE flags set status=?,note=?,created_date=? where target_type=? AND target_id=? AND flagger_id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(FlagOpen, note, time.Now(), targetType, id, flaggerID)
+	return err
+}
+
+func countOpenFlags(targetType string, id int64) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM flags where target_type=? AND target_id=? AND status=?", targetType, id, FlagOpen).Scan(&n)
+	return n, err
+}
+
+func resolveFlags(targetType string, id int64) error {
+	stmt, err := db.Prepare("UPDATE flags set status=? where target_type=? AND target_id=? AND status=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(FlagResolved, targetType, id, FlagOpen)
+	return err
+}
+
+/*
+getModerationQueue summarizes the open flags per flagged report and comment,
+most flagged first. Only the flag fields of the returned items are filled in.
+*/
+func getModerationQueue() ([]QueueItem, error) {
+	rows, err := db.Query("SELECT target_type, target_id, reason, COUNT(*), MIN(created_date) FROM flags where status=? GROUP BY target_type, target_id, reason", FlagOpen)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []*QueueItem
+	byTarget := map[string]*QueueItem{}
+
+	for rows.Next() {
+		var targetType, reason string
+		var id, n int
+		var first time.Time
+		if err := rows.Scan(&targetType, &id, &reason, &n, &first); err != nil {
+			return nil, err
+		}
+		key := targetType + ":" + strconv.Itoa(id)
+		item, ok := byTarget[key]
+		if !ok {
+			item = &QueueItem{TargetType: targetType, TargetID: id, Reasons: map[string]int{}, FirstFlag: first}
+			byTarget[key] = item
+			items = append(items, item)
+		}
+		item.FlagCount += n
+		item.Reasons[reason] += n
+		if first.Before(item.FirstFlag) {
+			item.FirstFlag = first
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].FlagCount != items[j].FlagCount {
+			return items[i].FlagCount > items[j].FlagCount
+		}
+		return items[i].FirstFlag.Before(items[j].FirstFlag)
+	})
+
+	queue := make([]QueueItem, len(items))
+	for i, item := range items {
+		queue[i] = *item
+	}
+
+	return queue, nil
+}
+
+func insertModerationAction(a *ModerationAction) (*ModerationAction, error) {
+	stmt, err := db.Prepare("INSERT moderation_log SET moderator_id=?,target_type=?,target_id=?,action=?,note=?,created_date=?")
+	if err != nil {
+		return nil, err
+	}
+
+	a.Date = time.Now()
+	res, err := stmt.Exec(a.ModeratorID, a.TargetType, a.TargetID, a.Action, a.Note, a.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	a.ID = int(id)
+
+	return a, nil
+}
+
+func getModerationLog(limit, offset int) ([]ModerationAction, error) {
+	stmt, err := db.Prepare("SELECT * FROM moderation_log ORDER BY created_date DESC, id DESC LIMIT ? OFFSET ?")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []ModerationAction
+
+	for rows.Next() {
+		var a ModerationAction
+		if err := rows.Scan(&a.ID, &a.ModeratorID, &a.TargetType, &a.TargetID, &a.Action, &a.Note, &a.Date); err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+
+	return actions, nil
+}
+
+func setReportActive(id int64, active int) error {
+	stmt, err := db.Prepare("UPDATE reports set active=? where id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(active, id)
+	return err
+}
+
+func setCommentActive(id int64, active int) error {
+	stmt, err := db.Prepare("UPDATE comments set active=? where id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(active, id)
+	return err
+}
+
+func setUserActive(id int64, active int) error {
+	stmt, err := db.Prepare("UPDATE users set active=? where id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(active, id)
+	return err
+}
+
+/*
+getUserByHandle finds the active user whose email address starts with handle
+followed by @. It fails unless exactly one user matches.
+*/
+func getUserByHandle(handle string) (*User, error) {
+	stmt, err := db.Prepare("SELECT * FROM users where active=1 AND username LIKE ? LIMIT 2")
+	if err != nil {
+		return nil, err
+	}
+
+	escaped := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(handle)
+	rows, err := stmt.Query(escaped + "@%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Email, &u.Password, &u.Date, &u.Active, &u.Role); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	if len(users) != 1 {
+		return nil, sql.ErrNoRows
+	}
+
+	return &users[0], nil
+}
+
+/*
+insertMention records a user mentioned in a comment and reports whether the
+mention is new.
+*/
+func insertMention(c *Comment, userID int) (bool, error) {
+	stmt, err := db.Prepare("INSERT IGNORE mentions SET comment_id=?,report_id=?,author_id=?,user_id=?,created_date=?,read_date=NULL")
+	if err != nil {
+		return false, err
+	}
+
+	res, err := stmt.Exec(c.ID, c.ReportID, c.AuthorID, userID, time.Now())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+/*
+getUserMentions returns the mentions of a user together with the comment text.
+Mentions in comments which were since removed, or which the user can no longer
+see, are left out.
+*/
+func getUserMentions(userID int64, includeInternal, unreadOnly bool, limit, offset int) ([]Mention, error) {
+	stmt, err := db.Prepare("SELECT m.id, m.comment_id, m.report_id, m.author_id, m.user_id, c.message, m.created_date, m.read_date IS NOT NULL FROM mentions m JOIN comments c ON c.id=m.comment_id where m.user_id=? AND c.active=1 AND (c.visibility=? OR ?) AND (m.read_date IS NULL OR NOT ?) ORDER BY m.created_date DESC, m.id DESC LIMIT ? OFFSET ?")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(userID, CommentPublic, includeInternal, unreadOnly, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mentions []Mention
+
+	for rows.Next() {
+		var m Mention
+		if err := rows.Scan(&m.ID, &m.CommentID, &m.ReportID, &m.AuthorID, &m.UserID, &m.Message, &m.Date, &m.Read); err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, m)
+	}
+
+	return mentions, nil
+}
+
+func markMentionRead(userID, mentionID int64) (int64, error) {
+	stmt, err := db.Prepare("UPDATE mentions set read_date=? where id=? AND user_id=? AND read_date IS NULL")
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := stmt.Exec(time.Now(), mentionID, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+/*
+updateReportStatus changes the status of a report and appends the change to the
+status history in one transaction.
+*/
+func updateReportStatus(reportID int64, change *StatusChange) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	change.Date = time.Now()
+	res, err := tx.Exec("INSERT status_history SET report_id=?,status=?,changed_by=?,note=?,changed_date=?", reportID, change.Status, change.ChangedBy, change.Note, change.Date)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	change.ID = int(id)
+	change.ReportID = int(reportID)
+
+	_, err = tx.Exec("UPDATE reports set status=? where id=?", change.Status, reportID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func getStatusHistory(reportID int64) ([]StatusChange, error) {
+	stmt, err := db.Prepare("SELECT * FROM status_history where report_id=? ORDER BY changed_date, id")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(reportID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []StatusChange
+
+	for rows.Next() {
+		var c StatusChange
+		if err := rows.Scan(&c.ID, &c.ReportID, &c.Status, &c.ChangedBy, &c.Note, &c.Date); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
+
+func insertFollow(reportID int64, userID int) error {
+	stmt, err := db.Prepare("INSERT IGNORE follows SET report_id=?,user_id=?,created_date=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(reportID, userID, time.Now())
+	return err
+}
+
+func deleteFollow(reportID int64, userID int) error {
+	stmt, err := db.Prepare("DELETE FROM follows where report_id=? AND user_id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(reportID, userID)
+	return err
+}
+
+/*
+getReportFollowers returns the active users following a report.
+*/
+func getReportFollowers(reportID int64) ([]User, error) {
+	stmt, err := db.Prepare("SELECT u.* FROM follows f JOIN users u ON u.id=f.user_id where f.report_id=? AND u.active=1")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(reportID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Email, &u.Password, &u.Date, &u.Active, &u.Role); err != nil {
+			return nil, err
+		}
+		u.Password = ""
+		users = append(users, u)
+	}
+
+	return users, nil
+}
+
+/*
+getNotificationPreferences returns the preferences a user has set. Channels and
+event types without a stored preference are enabled.
+*/
+func getNotificationPreferences(userID int64) ([]NotificationPreference, error) {
+	stmt, err := db.Prepare("SELECT channel, event_type, enabled FROM notification_preferences where user_id=?")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var prefs []NotificationPreference
+
+	for rows.Next() {
+		var p NotificationPreference
+		if err := rows.Scan(&p.Channel, &p.Type, &p.Enabled); err != nil {
+			return nil, err
+		}
+		prefs = append(prefs, p)
+	}
+
+	return prefs, nil
+}
+
+func setNotificationPreference(userID int64, p NotificationPreference) error {
+	stmt, err := db.Prepare("INSERT notification_preferences SET user_id=?,channel=?,event_type=?,enabled=? ON DUPLICATE KEY UPDATE enabled=VALUES(enabled)")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(userID, p.Channel, p.Type, p.Enabled)
+	return err
+}
+
+func getCategories() ([]Category, error) {
+	rows, err := db.Query("SELECT code, name, department, ack_hours, resolve_hours, severity FROM categories ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []Category
+
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.Code, &c.Name, &c.Department, &c.AckHours, &c.ResolveHours, &c.Severity); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+
+	return categories, nil
+}
+
+func getCategory(code string) (*Category, error) {
+	var c Category
+	err := db.QueryRow("SELECT code, name, department, ack_hours, resolve_hours, severity FROM categories where code=?", code).Scan(&c.Code, &c.Name, &c.Department, &c.AckHours, &c.ResolveHours, &c.Severity)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func saveCategory(c *Category) error {
+	stmt, err := db.Prepare("INSERT categories SET code=?,name=?,department=?,ack_hours=?,resolve_hours=?,severity=? ON DUPLICATE KEY UPDATE name=VALUES(name),department=VALUES(department),ack_hours=VALUES(ack_hours),resolve_hours=VALUES(resolve_hours),severity=VALUES(severity)")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(c.Code, c.Name, c.Department, c.AckHours, c.ResolveHours, c.Severity)
+	return err
+}
+
+func scanSubscription(s rowScanner, sub *Subscription) error {
+	var area sql.NullString
+	var categories string
+	err := s.Scan(&sub.ID, &sub.UserID, &sub.Name, &sub.Lat, &sub.Lng, &sub.Radius, &area, &sub.box.MinLat, &sub.box.MinLng, &sub.box.MaxLat, &sub.box.MaxLng, &categories, &sub.Delivery, &sub.Date, &sub.Active)
+	if err != nil {
+		return err
+	}
+	if area.Valid {
+		sub.Area = &Geometry{}
+		if err := json.Unmarshal([]byte(area.String), sub.Area); err != nil {
+			return err
+		}
+	}
+	sub.Categories = []string{}
+	if categories != "" {
+		sub.Categories = strings.Split(categories, ",")
+	}
+	return nil
+}
+
+func insertSubscription(sub *Subscription) (*Subscription, error) {
+	stmt, err := db.Prepare("INSERT subscriptions SET user_id=?,name=?,lat=?,lng=?,radius=?,area=?,min_lat=?,min_lng=?,max_lat=?,max_lng=?,categories=?,delivery=?,created_date=?,active=1")
+	if err != nil {
+		return nil, err
+	}
+
+	var area interface{}
+	if sub.Area != nil {
+		b, err := json.Marshal(sub.Area)
+		if err != nil {
+			return nil, err
+		}
+		area = string(b)
+	}
+	res, err := stmt.Exec(sub.UserID, sub.Name, sub.Lat, sub.Lng, sub.Radius, area, sub.box.MinLat, sub.box.MinLng, sub.box.MaxLat, sub.box.MaxLng, strings.Join(sub.Categories, ","), sub.Delivery, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	var created Subscription
+	if err := scanSubscription(db.QueryRow("SELECT * FROM subscriptions where id=?", id), &created); err != nil {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+func getUserSubscriptions(userID int64) ([]Subscription, error) {
+	stmt, err := db.Prepare("SELECT * FROM subscriptions where active=1 AND user_id=?")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+
+	for rows.Next() {
+		var s Subscription
+		if err := scanSubscription(rows, &s); err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+
+	return subs, nil
+}
+
+/*
+getSubscriptionsAt returns the active subscriptions of active users whose
+bounding box contains the point.
+*/
+func getSubscriptionsAt(lat, lng float64) ([]Subscription, error) {
+	stmt, err := db.Prepare("SELECT s.* FROM subscriptions s JOIN users u ON u.id=s.user_id where s.active=1 AND u.active=1 AND ? BETWEEN s.min_lat AND s.max_lat AND ? BETWEEN s.min_lng AND s.max_lng")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(lat, lng)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+
+	for rows.Next() {
+		var s Subscription
+		if err := scanSubscription(rows, &s); err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+
+	return subs, nil
+}
+
+func deactivateSubscription(userID, id int64) (int64, error) {
+	stmt, err := db.Prepare("UPDATE subscriptions set active=-1 where id=? AND user_id=? AND active=1")
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := stmt.Exec(id, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func insertDigestEntry(s *Subscription, reportID int) error {
+	stmt, err := db.Prepare("INSERT IGNORE subscription_digest SET user_id=?,subscription_id=?,report_id=?,created_date=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(s.UserID, s.ID, reportID, time.Now())
+	return err
+}
+
+/*
+getDigestEntries returns the queued digest entries of all users for reports
+which are still active, ordered by user and then id.
+*/
+func getDigestEntries() ([]digestEntry, error) {
+	rows, err := db.Query("SELECT d.id, d.user_id, s.name, d.report_id, r.description FROM subscription_digest d JOIN subscriptions s ON s.id=d.subscription_id JOIN reports r ON r.id=d.report_id where r.active=1 ORDER BY d.user_id, d.id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []digestEntry
+
+	for rows.Next() {
+		var e digestEntry
+		if err := rows.Scan(&e.ID, &e.UserID, &e.SubscriptionName, &e.ReportID, &e.Description); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+/*
+deleteDigestEntries removes the digest entries of a user up to and including maxID.
+*/
+func deleteDigestEntries(userID, maxID int) error {
+	stmt, err := db.Prepare("DELETE FROM subscription_digest where user_id=? AND id<=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(userID, maxID)
+	return err
+}
+
+func insertNotification(n *Notification) error {
+	stmt, err := db.Prepare("INSERT notifications SET user_id=?,type=?,report_id=?,comment_id=?,title=?,body=?,created_date=?,read_date=NULL")
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.Exec(n.UserID, n.Type, n.ReportID, n.CommentID, n.Title, n.Body, n.Date)
+	if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	n.ID = int(id)
+
+	return nil
+}
+
+func getUserNotifications(userID int, unreadOnly bool, limit, offset int) ([]Notification, error) {
+	stmt, err := db.Prepare("SELECT id, user_id, type, report_id, comment_id, title, body, created_date, read_date IS NOT NULL FROM notifications where user_id=? AND (read_date IS NULL OR NOT ?) ORDER BY created_date DESC, id DESC LIMIT ? OFFSET ?")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(userID, unreadOnly, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Type, &n.ReportID, &n.CommentID, &n.Title, &n.Body, &n.Date, &n.Read); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+
+	return notifications, nil
+}
+
+func countUnreadNotifications(userID int) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM notifications where user_id=? AND read_date IS NULL", userID).Scan(&n)
+	return n, err
+}
+
+/*
+markNotificationsRead marks the notification with the given id as read, or all
+of the user's notifications when id is 0.
+*/
+func markNotificationsRead(userID int, id int64) (int64, error) {
+	stmt, err := db.Prepare("UPDATE notifications set read_date=? where user_id=? AND (id=? OR ?=0) AND read_date IS NULL")
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := stmt.Exec(time.Now(), userID, id, id)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func deleteNotificationsBefore(t time.Time) (int64, error) {
+	stmt, err := db.Prepare("DELETE FROM notifications where created_date<?")
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := stmt.Exec(t)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+/*
+saveDevice registers a device for push notifications. A token registered before,
+possibly by another user on a shared device, is moved to the new user.
+*/
+func saveDevice(d *Device) (*Device, error) {
+	stmt, err := db.Prepare("INSERT devices SET user_id=?,platform=?,token=?,p256dh=?,auth=?,created_date=?,last_used=?,active=1 ON DUPLICATE KEY UPDATE user_id=VALUES(user_id),p256dh=VALUES(p256dh),auth=VALUES(auth),created_date=VALUES(created_date),active=1")
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if _, err := stmt.Exec(d.UserID, d.Platform, d.Token, d.P256dh, d.Auth, now, now); err != nil {
+		return nil, err
+	}
+
+	return getDeviceByToken(d.Platform, d.Token)
+}
+
+func getDeviceByToken(platform, token string) (*Device, error) {
+	var d Device
+	if err := scanDevice(db.QueryRow("SELECT * FROM devices where platform=? AND token=?", platform, token), &d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func scanDevice(row rowScanner, d *Device) error {
+	return row.Scan(&d.ID, &d.UserID, &d.Platform, &d.Token, &d.P256dh, &d.Auth, &d.Date, &d.LastUsed, &d.Active)
+}
+
+func getUserDevices(userID int64) ([]Device, error) {
+	stmt, err := db.Prepare("SELECT * FROM devices where active=1 AND user_id=?")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []Device
+
+	for rows.Next() {
+		var d Device
+		if err := scanDevice(rows, &d); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+
+	return devices, nil
+}
+
+func touchDevice(id int) error {
+	stmt, err := db.Prepare("UPDATE devices set last_used=? where id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(time.Now(), id)
+	return err
+}
+
+func deactivateDevice(id int) error {
+	stmt, err := db.Prepare("UPDATE devices set active=0 where id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(id)
+	return err
+}
+
+func deleteUserDevice(userID, deviceID int64) (int64, error) {
+	stmt, err := db.Prepare("UPDATE devices set active=0 where id=? AND user_id=? AND active=1")
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := stmt.Exec(deviceID, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func scanWebhook(s rowScanner, h *Webhook) error {
+	var events string
+	if err := s.Scan(&h.ID, &h.URL, &h.Secret, &events, &h.Description, &h.CreatedBy, &h.Date, &h.Active, &h.Failures, &h.Disabled); err != nil {
+		return err
+	}
+	h.Events = strings.Split(events, ",")
+	return nil
+}
+
+func insertWebhook(h *Webhook) (*Webhook, error) {
+	stmt, err := db.Prepare("INSERT webhooks SET url=?,secret=?,events=?,description=?,created_by=?,created_date=?,active=1,failures=0,disabled_date=NULL")
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := stmt.Exec(h.URL, h.Secret, strings.Join(h.Events, ","), h.Description, h.CreatedBy, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return getWebhook(id)
+}
+
+/*
+updateWebhook changes the address, events, description and secret of a webhook.
+Enabling a webhook again clears its failures.
+*/
+func updateWebhook(h *Webhook) error {
+	stmt, err := db.Prepare("UPDATE webhooks set url=?,secret=?,events=?,description=?,active=?,failures=IF(?=1,0,failures),disabled_date=IF(?=1,NULL,disabled_date) where id=? AND active>=0")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(h.URL, h.Secret, strings.Join(h.Events, ","), h.Description, h.Active, h.Active, h.Active, h.ID)
+	return err
+}
+
+func getWebhook(id int64) (*Webhook, error) {
+	var h Webhook
+	if err := scanWebhook(db.QueryRow("SELECT * FROM webhooks where id=? AND active>=0", id), &h); err != nil {
+		return nil, err
+	}
+
+	return &h, nil
+}
+
+/*
+getWebhooks returns all webhooks which were not deleted, or only the enabled
+ones if activeOnly is set.
+*/
+func getWebhooks(activeOnly bool) ([]Webhook, error) {
+	stmt, err := db.Prepare("SELECT * FROM webhooks where active>=? ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+
+	min := 0
+	if activeOnly {
+		min = 1
+	}
+	rows, err := stmt.Query(min)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+
+	for rows.Next() {
+		var h Webhook
+		if err := scanWebhook(rows, &h); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+
+	return hooks, nil
+}
+
+func getActiveWebhooks() ([]Webhook, error) {
+	return getWebhooks(true)
+}
+
+func setWebhookFailures(id, failures int) error {
+	stmt, err := db.Prepare("UPDATE webhooks set failures=? where id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(failures, id)
+	return err
+}
+
+func disableWebhook(id, failures int) error {
+	stmt, err := db.Prepare("UPDATE webhooks set active=0,failures=?,disabled_date=? where id=? AND active=1")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(failures, time.Now(), id)
+	return err
+}
+
+func deleteWebhook(id int64) (int64, error) {
+	stmt, err := db.Prepare("UPDATE webhooks set active=-1 where id=? AND active>=0")
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := stmt.Exec(id)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func scanWebhookDelivery(s rowScanner, d *WebhookDelivery) error {
+	return s.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.ResponseCode, &d.Response, &d.NextAttempt, &d.LastAttempt, &d.Date)
+}
+
+func insertWebhookDelivery(webhookID int, event, payload string) (*WebhookDelivery, error) {
+	stmt, err := db.Prepare("INSERT webhook_deliveries SET webhook_id=?,event=?,payload=?,status=?,attempts=0,response_code=0,response='',next_attempt=?,last_attempt=NULL,created_date=?")
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	res, err := stmt.Exec(webhookID, event, payload, DeliveryPending, now, now)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return getWebhookDelivery(int64(webhookID), id)
+}
+
+func getWebhookDelivery(webhookID, id int64) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	if err := scanWebhookDelivery(db.QueryRow("SELECT * FROM webhook_deliveries where id=? AND webhook_id=?", id, webhookID), &d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func updateWebhookDelivery(d *WebhookDelivery) error {
+	stmt, err := db.Prepare("UPDATE webhook_deliveries set status=?,attempts=?,response_code=?,response=?,next_attempt=?,last_attempt=? where id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(d.Status, d.Attempts, d.ResponseCode, d.Response, d.NextAttempt, d.LastAttempt, d.ID)
+	return err
+}
+
+/*
+getDueWebhookDeliveries returns pending deliveries of enabled webhooks whose
+next attempt is due, oldest first.
+*/
+func getDueWebhookDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+	stmt, err := db.Prepare("SELECT d.* FROM webhook_deliveries d JOIN webhooks h ON h.id=d.webhook_id where h.active=1 AND d.status=? AND d.next_attempt<=? ORDER BY d.next_attempt LIMIT ?")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(DeliveryPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := scanWebhookDelivery(rows, &d); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, nil
+}
+
+/*
+getWebhookDeliveries returns the delivery log of a webhook, newest first,
+optionally only deliveries with the given status.
+*/
+func getWebhookDeliveries(webhookID int64, status string, limit, offset int) ([]WebhookDelivery, error) {
+	stmt, err := db.Prepare("SELECT * FROM webhook_deliveries where webhook_id=? AND (status=? OR ?='') ORDER BY id DESC LIMIT ? OFFSET ?")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(webhookID, status, status, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := scanWebhookDelivery(rows, &d); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, nil
+}
+
+/*
+insertEvent stores an event with its data already encoded and sets its ID.
+*/
+func insertEvent(e *Event, payload string) error {
+	stmt, err := db.Prepare("INSERT events SET type=?,report_id=?,payload=?,staff_only=?,located=?,lat=?,lng=?,category=?,department=?,created_date=?")
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.Exec(e.Type, e.ReportID, payload, e.staffOnly, e.located, e.lat, e.lng, e.category, e.department, e.Date)
+	if err != nil {
+		return err
+	}
+
+	e.ID, err = res.LastInsertId()
+	return err
+}
+
+/*
+getEventsAfter returns up to limit events with an ID above id, oldest first.
+Their Data is the stored JSON.
+*/
+func getEventsAfter(id int64, limit int) ([]Event, error) {
+	stmt, err := db.Prepare("SELECT * FROM events where id>? ORDER BY id LIMIT ?")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+
+	for rows.Next() {
+		var e Event
+		var payload string
+		if err := rows.Scan(&e.ID, &e.Type, &e.ReportID, &payload, &e.staffOnly, &e.located, &e.lat, &e.lng, &e.category, &e.department, &e.Date); err != nil {
+			return nil, err
+		}
+		e.Data = json.RawMessage(payload)
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+func deleteEventsBefore(t time.Time) (int64, error) {
+	stmt, err := db.Prepare("DELETE FROM events where created_date<?")
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := stmt.Exec(t)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func setReportImage(id int64, image string) error {
+	stmt, err := db.Prepare("UPDATE reports set image_location=? where id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(image, id)
+	return err
+}
+
+/*
+getOpen311Requests returns the visible reports matching an Open311 query, newest
+first, with their category and latest status change.
+*/
+func getOpen311Requests(q *open311Query, limit int) ([]open311Row, error) {
+	query := "SELECT r.*, c.name, c.department, h.note, h.changed_date FROM reports r LEFT JOIN categories c ON c.code=r.category LEFT JOIN status_history h ON h.id=(SELECT MAX(id) FROM status_history where report_id=r.id) where r.active=1"
+	var args []interface{}
+	if len(q.IDs) > 0 {
+		query += " AND r.id IN (?" + strings.Repeat(",?", len(q.IDs)-1) + ")"
+		for _, id := range q.IDs {
+			args = append(args, id)
+		}
+	} else {
+		if len(q.Codes) > 0 {
+			query += " AND r.category IN (?" + strings.Repeat(",?", len(q.Codes)-1) + ")"
+			for _, c := range q.Codes {
+				args = append(args, c)
+			}
+		}
+		if len(q.Statuses) > 0 {
+			query += " AND r.status IN (?" + strings.Repeat(",?", len(q.Statuses)-1) + ")"
+			for _, s := range q.Statuses {
+				args = append(args, s)
+			}
+		}
+		query += " AND r.report_date>=? AND r.report_date<=?"
+		args = append(args, q.Start, q.End)
+	}
+	query += " ORDER BY r.id DESC LIMIT ?"
+	args = append(args, limit)
+
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []open311Row
+
+	for rows.Next() {
+		var o open311Row
+		r := &o.Report
+		if err := rows.Scan(&r.ID, &r.ReporterID, &r.Date, &r.Long, &r.Lat, &r.Description, &r.LocationInfo, &r.ImageLocation, &r.Active, &r.Status, &r.Category, &r.Accuracy, &r.Altitude, &o.ServiceName, &o.Department, &o.StatusNote, &o.Updated); err != nil {
+			return nil, err
+		}
+		requests = append(requests, o)
+	}
+
+	return requests, nil
+}
+
+func insertOpen311Token(token string, reportID int) error {
+	stmt, err := db.Prepare("INSERT open311_tokens SET token=?,report_id=?,created_date=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(token, reportID, time.Now())
+	return err
+}
+
+func getOpen311Token(token string) (int64, error) {
+	var id int64
+	err := db.QueryRow("SELECT report_id FROM open311_tokens where token=?", token).Scan(&id)
+	return id, err
+}
+
+/*
+insertImportedReports stores imported reports in one transaction, so a batch is
+either stored completely or not at all, and sets their IDs.
+*/
+func insertImportedReports(reports []Report) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT reports SET reporter_id=?,report_date=?,longitude=?,latitude=?,description=?,location_info=?,image_location=?,active=1,status=?,category=?,accuracy=?,altitude=?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for i, r := range reports {
+		res, err := stmt.Exec(r.ReporterID, r.Date, r.Long, r.Lat, r.Description, r.LocationInfo, r.ImageLocation, r.Status, r.Category, r.Accuracy, r.Altitude)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		reports[i].ID = int(id)
+	}
+
+	return tx.Commit()
+}
+
+func insertImport(i *Import) error {
+	stmt, err := db.Prepare("INSERT imports SET user_id=?,format=?,dry_run=?,total=?,imported=?,rejected=?,error_report=?,created_date=?,aborted=?")
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.Exec(i.UserID, i.Format, i.DryRun, i.Total, i.Imported, i.Rejected, i.ErrorReport, i.Date, i.Aborted)
+	if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	i.ID = int(id)
+
+	return nil
+}
+
+func getImport(id int64) (*Import, error) {
+	var i Import
+	err := db.QueryRow("SELECT * FROM imports where id=?", id).Scan(&i.ID, &i.UserID, &i.Format, &i.DryRun, &i.Total, &i.Imported, &i.Rejected, &i.ErrorReport, &i.Date, &i.Aborted)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+/*
+getTileGrid counts the visible reports matching the filter per category in the
+cells of a grid over b with cols columns. The rows are split at the ascending
+latitudes in rowEdges and numbered from the south.
+*/
+func getTileGrid(b bbox, cols int, rowEdges []float64, f *reportFilter) ([]gridCount, error) {
+	row := "0"
+	if len(rowEdges) > 0 {
+		row = "INTERVAL(r.latitude" + strings.Repeat(",?", len(rowEdges)) + ")"
+	}
+	cond, filterArgs := f.where()
+	query := "SELECT LEAST(FLOOR((r.longitude-?)/?),?) AS col, " + row + " AS row_index, r.category, COUNT(*), AVG(r.latitude), AVG(r.longitude), MIN(r.id) FROM reports r where r.active=1 AND r.latitude>=? AND r.latitude<? AND r.longitude>=? AND r.longitude<?" + cond + " GROUP BY col, row_index, r.category"
+
+	args := []interface{}{b.MinLng, (b.MaxLng - b.MinLng) / float64(cols), cols - 1}
+	for _, e := range rowEdges {
+		args = append(args, e)
+	}
+	args = append(args, b.MinLat, b.MaxLat, b.MinLng, b.MaxLng)
+	args = append(args, filterArgs...)
+
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []gridCount
+
+	for rows.Next() {
+		var c gridCount
+		if err := rows.Scan(&c.Col, &c.Row, &c.Category, &c.Count, &c.Lat, &c.Lng, &c.MinID); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+
+	return counts, nil
+}
+
+func insertVote(reportID int64, userID int) error {
+	stmt, err := db.Prepare("INSERT IGNORE votes SET report_id=?,user_id=?,created_date=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(reportID, userID, time.Now())
+	return err
+}
+
+func deleteVote(reportID int64, userID int) error {
+	stmt, err := db.Prepare("DELETE FROM votes where report_id=? AND user_id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(reportID, userID)
+	return err
+}
+
+func countVotes(reportID int64) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM votes where report_id=?", reportID).Scan(&n)
+	return n, err
+}
+
+/*
+getTilePoints returns up to limit of the newest visible reports matching the
+filter within b, with their vote counts.
+*/
+func getTilePoints(b bbox, f *reportFilter, limit int) ([]tilePoint, error) {
+	cond, filterArgs := f.where()
+	stmt, err := db.Prepare("SELECT r.id, r.latitude, r.longitude, r.category, r.status, r.report_date, (SELECT COUNT(*) FROM votes v where v.report_id=r.id) FROM reports r where r.active=1 AND r.latitude>=? AND r.latitude<? AND r.longitude>=? AND r.longitude<?" + cond + " ORDER BY r.id DESC LIMIT ?")
+	if err != nil {
+		return nil, err
+	}
+
+	args := []interface{}{b.MinLat, b.MaxLat, b.MinLng, b.MaxLng}
+	args = append(args, filterArgs...)
+	args = append(args, limit)
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []tilePoint
+
+	for rows.Next() {
+		var p tilePoint
+		if err := rows.Scan(&p.ID, &p.Lat, &p.Lng, &p.Category, &p.Status, &p.Date, &p.Votes); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+
+	return points, rows.Err()
+}
+
+/*
+insertBoundarySet stores a boundary set with its areas in one transaction and
+sets their IDs.
+*/
+func insertBoundarySet(set *BoundarySet, areas []*BoundaryArea) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("INSERT boundary_sets SET name=?,description=?,created_by=?,created_date=?,active=1", set.Name, set.Description, set.CreatedBy, set.Date)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	set.ID = int(id)
+	set.Active = activeVisible
+
+	stmt, err := tx.Prepare("INSERT boundary_areas SET set_id=?,name=?,code=?,geometry=?,min_lat=?,min_lng=?,max_lat=?,max_lng=?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, a := range areas {
+		g, err := json.Marshal(a.Geometry)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		res, err := stmt.Exec(set.ID, a.Name, a.Code, string(g), a.box.MinLat, a.box.MinLng, a.box.MaxLat, a.box.MaxLng)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		a.ID = int(id)
+		a.SetID = set.ID
+	}
+
+	return tx.Commit()
+}
+
+func getBoundarySets() ([]BoundarySet, error) {
+	stmt, err := db.Prepare("SELECT s.*, (SELECT COUNT(*) FROM boundary_areas a where a.set_id=s.id) FROM boundary_sets s where s.active=1 ORDER BY s.name")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sets := []BoundarySet{}
+
+	for rows.Next() {
+		var s BoundarySet
+		if err := rows.Scan(&s.ID, &s.Name, &s.Description, &s.CreatedBy, &s.Date, &s.Active, &s.Areas); err != nil {
+			return nil, err
+		}
+		sets = append(sets, s)
+	}
+
+	return sets, nil
+}
+
+func getBoundarySet(id int64) (*BoundarySet, error) {
+	var s BoundarySet
+	err := db.QueryRow("SELECT s.*, (SELECT COUNT(*) FROM boundary_areas a where a.set_id=s.id) FROM boundary_sets s where s.active=1 AND s.id=?", id).Scan(&s.ID, &s.Name, &s.Description, &s.CreatedBy, &s.Date, &s.Active, &s.Areas)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func scanBoundaryArea(s rowScanner, a *BoundaryArea) error {
+	var g string
+	if err := s.Scan(&a.ID, &a.SetID, &a.Name, &a.Code, &g, &a.box.MinLat, &a.box.MinLng, &a.box.MaxLat, &a.box.MaxLng); err != nil {
+		return err
+	}
+	a.Geometry = &Geometry{}
+	return json.Unmarshal([]byte(g), a.Geometry)
+}
+
+func queryBoundaryAreas(query string, args ...interface{}) ([]BoundaryArea, error) {
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var areas []BoundaryArea
+
+	for rows.Next() {
+		var a BoundaryArea
+		if err := scanBoundaryArea(rows, &a); err != nil {
+			return nil, err
+		}
+		areas = append(areas, a)
+	}
+
+	return areas, nil
+}
+
+func getBoundaryAreas(setID int64) ([]BoundaryArea, error) {
+	return queryBoundaryAreas("SELECT * FROM boundary_areas where set_id=? ORDER BY name", setID)
+}
+
+/*
+getActiveBoundaryAreas returns the areas of all boundary sets which are not
+deleted.
+*/
+func getActiveBoundaryAreas() ([]BoundaryArea, error) {
+	return queryBoundaryAreas("SELECT a.* FROM boundary_areas a JOIN boundary_sets s ON s.id=a.set_id where s.active=1 ORDER BY a.set_id, a.id")
+}
+
+/*
+deleteBoundarySet deactivates a boundary set and forgets which of its areas the
+reports were in.
+*/
+func deleteBoundarySet(id int64) (int64, error) {
+	stmt, err := db.Prepare("UPDATE boundary_sets SET active=-1 where id=? AND active=1")
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := stmt.Exec(id)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return n, err
+	}
+
+	_, err = db.Exec("DELETE FROM report_areas where set_id=?", id)
+	return n, err
+}
+
+func insertReportArea(reportID int64, setID, areaID int) error {
+	stmt, err := db.Prepare("INSERT IGNORE report_areas SET report_id=?,set_id=?,area_id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(reportID, setID, areaID)
+	return err
+}
+
+/*
+insertReportAreas records the areas of a boundary set for many reports, keyed
+by report ID.
+*/
+func insertReportAreas(setID int, areas map[int64]int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT IGNORE report_areas SET report_id=?,set_id=?,area_id=?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for reportID, areaID := range areas {
+		if _, err := stmt.Exec(reportID, setID, areaID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+/*
+getAreaCounts counts the visible reports matching the filter per area of a
+boundary set, status and category. Reports outside every area count for area 0.
+*/
+func getAreaCounts(setID int64, f *reportFilter) ([]areaCount, error) {
+	cond, filterArgs := f.where()
+	stmt, err := db.Prepare("SELECT COALESCE(ra.area_id, 0), r.status, r.category, COUNT(*) FROM reports r LEFT JOIN report_areas ra ON ra.report_id=r.id AND ra.set_id=? where r.active=1" + cond + " GROUP BY 1, r.status, r.category")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(append([]interface{}{setID}, filterArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []areaCount
+
+	for rows.Next() {
+		var c areaCount
+		if err := rows.Scan(&c.AreaID, &c.Status, &c.Category, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+
+	return counts, nil
+}
+
+/*
+getUsersByRole returns the active users holding a role.
+*/
+func getUsersByRole(role string) ([]User, error) {
+	stmt, err := db.Prepare("SELECT * FROM users where active=1 AND role=?")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Email, &u.Password, &u.Date, &u.Active, &u.Role); err != nil {
+			return nil, err
+		}
+		u.Password = ""
+		users = append(users, u)
+	}
+
+	return users, nil
+}
+
+/*
+slaQuery selects visible reports as slaReports. A report is acknowledged by its
+first status change away from open and resolved by its first change to resolved
+or closed.
+*/
+const slaQuery = "SELECT r.id, r.category, COALESCE(c.department, ''), r.report_date, r.status, " +
+	"(SELECT MIN(h.changed_date) FROM status_history h where h.report_id=r.id AND h.status<>'open'), " +
+	"(SELECT MIN(h.changed_date) FROM status_history h where h.report_id=r.id AND h.status IN ('resolved','closed')), " +
+	"COALESCE(c.ack_hours, 0), COALESCE(c.resolve_hours, 0), " +
+	"(SELECT MAX(e.escalated_date) FROM sla_escalations e where e.report_id=r.id) " +
+	"FROM reports r LEFT JOIN categories c ON c.code=r.category where r.active=1"
+
+func scanSLAReport(s rowScanner, r *slaReport) error {
+	var ack, resolved, escalated sql.NullTime
+	if err := s.Scan(&r.ID, &r.Category, &r.Department, &r.Date, &r.Status, &ack, &resolved, &r.AckHours, &r.ResolveHours, &escalated); err != nil {
+		return err
+	}
+	if ack.Valid {
+		r.Acknowledged = &ack.Time
+	}
+	if resolved.Valid {
+		r.Resolved = &resolved.Time
+	}
+	if escalated.Valid {
+		r.Escalated = &escalated.Time
+	}
+	return nil
+}
+
+func querySLAReports(query string, args ...interface{}) ([]slaReport, error) {
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []slaReport
+
+	for rows.Next() {
+		var r slaReport
+		if err := scanSLAReport(rows, &r); err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+
+	return reports, rows.Err()
+}
+
+func getSLAReports(f *reportFilter) ([]slaReport, error) {
+	cond, args := f.where()
+	return querySLAReports(slaQuery+cond, args...)
+}
+
+func getReportSLA(id int64) (*slaReport, error) {
+	var r slaReport
+	if err := scanSLAReport(db.QueryRow(slaQuery+" AND r.id=?", id), &r); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+/*
+getPendingSLAReports returns the reports which are not done yet and whose
+category has an SLA target.
+*/
+func getPendingSLAReports() ([]slaReport, error) {
+	return querySLAReports(slaQuery + " AND r.status NOT IN ('resolved','closed','rejected') AND (c.ack_hours>0 OR c.resolve_hours>0)")
+}
+
+/*
+insertEscalation records that a stage of a report was escalated. It returns
+false if it had been escalated before.
+*/
+func insertEscalation(reportID int64, stage string, date time.Time) (bool, error) {
+	stmt, err := db.Prepare("INSERT IGNORE sla_escalations SET report_id=?,stage=?,escalated_date=?")
+	if err != nil {
+		return false, err
+	}
+
+	res, err := stmt.Exec(reportID, stage, date)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+/*
+insertAddressPoints stores a batch of address points for the local geocoder in
+one transaction.
+*/
+func insertAddressPoints(points []addressPoint) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT address_points SET number=?,street=?,city=?,postcode=?,latitude=?,longitude=?,search=?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for i := range points {
+		p := &points[i]
+		if _, err := stmt.Exec(p.Number, p.Street, p.City, p.Postcode, p.Lat, p.Lng, p.searchText()); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func deleteAddressPoints() error {
+	_, err := db.Exec("DELETE FROM address_points")
+	return err
+}
+
+func queryAddressPoints(query string, args ...interface{}) ([]addressPoint, error) {
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []addressPoint
+
+	for rows.Next() {
+		var p addressPoint
+		if err := rows.Scan(&p.Number, &p.Street, &p.City, &p.Postcode, &p.Lat, &p.Lng); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+
+	return points, rows.Err()
+}
+
+/*
+getAddressPoints returns up to limit address points within b, nearest to the
+location first.
+*/
+func getAddressPoints(b bbox, lat, lng float64, limit int) ([]addressPoint, error) {
+	// Squared distance on a plane, as in searchAddressPoints.
+	scale := math.Cos(lat * math.Pi / 180)
+	return queryAddressPoints("SELECT number, street, city, postcode, latitude, longitude FROM address_points where latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ? ORDER BY POW(latitude-?, 2) + POW((longitude-?)*?, 2) LIMIT ?", b.MinLat, b.MaxLat, b.MinLng, b.MaxLng, lat, lng, scale, limit)
+}
+
+/*
+searchAddressPoints returns the address points whose search text contains all
+terms, nearest first if the query is near a location and otherwise by street
+and house number.
+*/
+func searchAddressPoints(terms []string, q GeocodeQuery) ([]addressPoint, error) {
+	query := "SELECT number, street, city, postcode, latitude, longitude FROM address_points where 1=1"
+	var args []interface{}
+	escape := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+	for _, t := range terms {
+		query += " AND search LIKE ?"
+		args = append(args, "%"+escape.Replace(t)+"%")
+	}
+	if q.Near {
+		// Squared distance on a plane, with longitudes shrunk to the scale of
+		// latitudes at the location.
+		scale := math.Cos(q.Lat * math.Pi / 180)
+		query += " ORDER BY POW(latitude-?, 2) + POW((longitude-?)*?, 2)"
+		args = append(args, q.Lat, q.Lng, scale)
+	} else {
+		query += " ORDER BY street, CAST(number AS UNSIGNED), number"
+	}
+	query += " LIMIT ?"
+	args = append(args, q.Limit)
+
+	return queryAddressPoints(query, args...)
+}
+
+/*
+getTrustCounts counts what the trust score of a user is computed from. A report
+or comment counts as moderated when a moderator or the flag threshold hid it
+and it has not been restored. The email counts as verified only if the address
+verified is still the one of the account.
+*/
+func getTrustCounts(userID int64, email string) (*trustCounts, error) {
+	var c trustCounts
+	err := db.QueryRow("SELECT "+
+		"(SELECT COUNT(*) FROM reports where reporter_id=? AND status IN (?,?)), "+
+		"(SELECT COUNT(*) FROM reports where reporter_id=? AND status=?), "+
+		"(SELECT COUNT(DISTINCT m.target_id) FROM moderation_log m JOIN reports r ON r.id=m.target_id where m.target_type=? AND m.action IN (?,?,?) AND r.reporter_id=? AND r.active<>1) + "+
+		"(SELECT COUNT(DISTINCT m.target_id) FROM moderation_log m JOIN comments c ON c.id=m.target_id where m.target_type=? AND m.action IN (?,?,?) AND c.author_id=? AND c.active<>1), "+
+		"EXISTS(SELECT 1 FROM email_verifications where user_id=? AND email=? AND verified_date IS NOT NULL)",
+		userID, StatusResolved, StatusClosed,
+		userID, StatusRejected,
+		TargetReport, ActionHide, ActionBan, ActionAutoHide, userID,
+		TargetComment, ActionHide, ActionBan, ActionAutoHide, userID,
+		userID, email,
+	).Scan(&c.Resolved, &c.Rejected, &c.Moderated, &c.Verified)
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func saveTrust(t *Trust) error {
+	stmt, err := db.Prepare("INSERT user_trust SET user_id=?,computed=?,updated_date=? ON DUPLICATE KEY UPDATE computed=VALUES(computed),updated_date=VALUES(updated_date)")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(t.UserID, t.Computed, t.Date)
+	return err
+}
+
+/*
+getTrustScore returns the stored trust score of a user, the override if one is
+set, and when it was last computed.
+*/
+func getTrustScore(userID int64) (int, time.Time, error) {
+	var score int
+	var updated time.Time
+	err := db.QueryRow("SELECT COALESCE(o.score, t.computed), t.updated_date FROM user_trust t LEFT JOIN trust_overrides o ON o.user_id=t.user_id where t.user_id=?", userID).Scan(&score, &updated)
+	return score, updated, err
+}
+
+/*
+getTrustOverride returns the override of the trust score of a user, or nil if
+there is none.
+*/
+func getTrustOverride(userID int64) (*TrustOverride, error) {
+	var o TrustOverride
+	err := db.QueryRow("SELECT score, note, set_by, set_date FROM trust_overrides where user_id=?", userID).Scan(&o.Score, &o.Note, &o.By, &o.Date)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+func setTrustOverride(userID int64, o *TrustOverride) error {
+	stmt, err := db.Prepare("INSERT trust_overrides SET user_id=?,score=?,note=?,set_by=?,set_date=? ON DUPLICATE KEY UPDATE score=VALUES(score),note=VALUES(note),set_by=VALUES(set_by),set_date=VALUES(set_date)")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(userID, o.Score, o.Note, o.By, o.Date)
+	return err
+}
+
+func deleteTrustOverride(userID int64) error {
+	stmt, err := db.Prepare("DELETE FROM trust_overrides where user_id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(userID)
+	return err
+}
+
+/*
+insertEmailVerification stores a new verification token for the email address
+of a user, replacing an earlier one.
+*/
+func insertEmailVerification(v *emailVerification) error {
+	stmt, err := db.Prepare("INSERT email_verifications SET user_id=?,email=?,token=?,sent_date=?,verified_date=NULL ON DUPLICATE KEY UPDATE email=VALUES(email),token=VALUES(token),sent_date=VALUES(sent_date),verified_date=NULL")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(v.UserID, v.Email, v.Token, v.Sent)
+	return err
+}
+
+func getEmailVerification(token string) (*emailVerification, error) {
+	var v emailVerification
+	var verified sql.NullTime
+	err := db.QueryRow("SELECT user_id, email, token, sent_date, verified_date FROM email_verifications where token=?", token).Scan(&v.UserID, &v.Email, &v.Token, &v.Sent, &verified)
+	if err != nil {
+		return nil, err
+	}
+	if verified.Valid {
+		v.Verified = &verified.Time
+	}
+
+	return &v, nil
+}
+
+func markEmailVerified(userID int64, date time.Time) error {
+	stmt, err := db.Prepare("UPDATE email_verifications set verified_date=? where user_id=?")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(date, userID)
+	return err
+}
+
+func savePriority(p *ReportPriority, factors string) error {
+	stmt, err := db.Prepare("INSERT report_priority SET report_id=?,score=?,factors=?,updated_date=? ON DUPLICATE KEY UPDATE score=VALUES(score),factors=VALUES(factors),updated_date=VALUES(updated_date)")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(p.ReportID, p.Score, factors, p.Date)
+	return err
+}
+
+/*
+getTriage returns a page of the visible reports matching the filter, highest
+priority first, with their priorities. Priority is nil for reports which were
+not scored yet; they come last.
+*/
+func getTriage(f *reportFilter, limit, offset int) ([]TriageItem, error) {
+	cond, args := f.where()
+	stmt, err := db.Prepare("SELECT r.*, p.score, p.factors, p.updated_date FROM reports r LEFT JOIN report_priority p ON p.report_id=r.id where r.active=1" + cond + " ORDER BY p.score IS NULL, p.score DESC, r.id LIMIT ? OFFSET ?")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []TriageItem
+
+	for rows.Next() {
+		var r Report
+		var score sql.NullFloat64
+		var factors sql.NullString
+		var updated sql.NullTime
+		err := rows.Scan(&r.ID, &r.ReporterID, &r.Date, &r.Long, &r.Lat, &r.Description, &r.LocationInfo, &r.ImageLocation, &r.Active, &r.Status, &r.Category, &r.Accuracy, &r.Altitude, &score, &factors, &updated)
+		if err != nil {
+			return nil, err
+		}
+		item := TriageItem{Report: &r}
+		if score.Valid {
+			item.Priority = &ReportPriority{ReportID: r.ID, Score: score.Float64, Date: updated.Time}
+			if err := json.Unmarshal([]byte(factors.String), &item.Priority.Factors); err != nil {
+				return nil, err
+			}
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+const maxDevicesPerUser = 20
+
+/*
+validate checks that a device can be delivered to on its platform.
+*/
+func (d *Device) validate() error {
+	if _, ok := pushProviders[d.Platform]; !ok {
+		return errors.New("Push notifications are not available for platform " + d.Platform)
+	}
+	if d.Token == "" || len(d.Token) > 1024 {
+		return errors.New("Device token missing or too long")
+	}
+	if d.Platform != PlatformWeb {
+		d.P256dh, d.Auth = "", ""
+		return nil
+	}
+	if _, err := webPushEndpoint(d.Token); err != nil {
+		return err
+	}
+	if key, err := decodeBase64URL(d.P256dh); err != nil || len(key) != 65 {
+		return errors.New("Web push subscriptions need a p256dh key of 65 bytes")
+	}
+	if secret, err := decodeBase64URL(d.Auth); err != nil || len(secret) != 16 {
+		return errors.New("Web push subscriptions need an auth secret of 16 bytes")
+	}
+	return nil
+}
+
+/*
+UserDevices lists the devices a user receives push notifications on.
+*/
+func UserDevices(w http.ResponseWriter, r *http.Request) {
+	id, ok := selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	devices, err := getUserDevices(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if devices == nil {
+		devices = []Device{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(devices); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+DeviceCreate registers a device for push notifications. Web push subscriptions
+are sent as they come from the browser, with the endpoint as token and the keys
+in p256dh and auth. Registering a device again refreshes it. A token still
+active for another user is refused with 409 Conflict.
+*/
+func DeviceCreate(w http.ResponseWriter, r *http.Request) {
+	id, ok := selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	var d Device
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(body, &d); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := d.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	registered, err := getDeviceByToken(d.Platform, d.Token)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	refresh := false
+	if err == nil && registered.Active == 1 {
+		if int64(registered.UserID) != id {
+			http.Error(w, "Device is registered to another user", http.StatusConflict)
+			return
+		}
+		refresh = true
+	}
+	existing, err := getUserDevices(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !refresh && len(existing) >= maxDevicesPerUser {
+		http.Error(w, "Too many devices", http.StatusConflict)
+		return
+	}
+	d.UserID = int(id)
+
+	saved, err := saveDevice(&d)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(saved); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+DeviceDelete stops push notifications to a device, e.g. on logout.
+*/
+func DeviceDelete(w http.ResponseWriter, r *http.Request) {
+	id, ok := selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	deviceID, err := strconv.ParseInt(mux.Vars(r)["deviceId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := deleteUserDevice(id, deviceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+PushPublicKey returns the VAPID public key browsers need as applicationServerKey
+to subscribe to web push.
+*/
+func PushPublicKey(w http.ResponseWriter, r *http.Request) {
+	p, ok := pushProviders[PlatformWeb].(*webPushProvider)
+	if !ok {
+		http.Error(w, "Web push is not configured", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(map[string]string{"publicKey": p.public}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+FakePushDeliveries lists the messages recorded by the fake push provider. With
+clear=true the recorded messages are removed. Only available to admins and only
+when the fake provider is enabled.
+*/
+func FakePushDeliveries(w http.ResponseWriter, r *http.Request) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !u.isAdmin() {
+		http.Error(w, "Only admins can see push deliveries", http.StatusForbidden)
+		return
+	}
+	if _, ok := pushProviders[PlatformFake]; !ok {
+		http.Error(w, "The fake push provider is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(fakePush.recorded(r.URL.Query().Get("clear") == "true")); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	eventHeartbeat    = 25 * time.Second
+	eventBacklogPage  = 500
+	eventWriteTimeout = 10 * time.Second
+	eventRetryMillis  = 5000
+)
+
+var eventUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	// Streams are authorized by token, not by cookie, so other origins such as
+	// the operations dashboard may connect.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+/*
+eventFilter selects the events a stream receives.
+*/
+type eventFilter struct {
+	box         *bbox
+	categories  map[string]bool
+	departments map[string]bool
+	staff       bool
+}
+
+/*
+listParam splits a comma separated query parameter into a set.
+*/
+func listParam(r *http.Request, name string) map[string]bool {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return nil
+	}
+	set := map[string]bool{}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			set[s] = true
+		}
+	}
+	return set
+}
+
+/*
+eventFilterFromRequest reads the bbox, category and department filters of a
+stream. Both lists are comma separated.
+*/
+func eventFilterFromRequest(r *http.Request, u *User) (*eventFilter, error) {
+	f := &eventFilter{
+		categories:  listParam(r, "category"),
+		departments: listParam(r, "department"),
+		staff:       u.isStaff(),
+	}
+	if s := r.URL.Query().Get("bbox"); s != "" {
+		b, err := parseBBox(s)
+		if err != nil {
+			return nil, err
+		}
+		f.box = &b
+	}
+	return f, nil
+}
+
+func (f *eventFilter) matches(e *Event) bool {
+	if e.staffOnly && !f.staff {
+		return false
+	}
+	if f.box != nil && (!e.located || !f.box.contains(e.lat, e.lng)) {
+		return false
+	}
+	if f.categories != nil && !f.categories[e.category] {
+		return false
+	}
+	if f.departments != nil && !f.departments[e.department] {
+		return false
+	}
+	return true
+}
+
+/*
+streamUser returns the user of a stream, or nil for anonymous streams. Browsers
+cannot set headers on EventSource and WebSocket requests, so the token may also
+be passed as access_token.
+*/
+func streamUser(r *http.Request) (*User, error) {
+	if r.Header.Get("Authorization") == "" {
+		t := r.URL.Query().Get("access_token")
+		if t == "" {
+			return nil, nil
+		}
+		r.Header.Set("Authorization", "Bearer "+t)
+	}
+	return requestUser(r)
+}
+
+/*
+lastEventID returns the ID of the last event a client saw, from the
+Last-Event-ID header EventSource sends when reconnecting or the lastEventId
+parameter.
+*/
+func lastEventID(r *http.Request) (int64, error) {
+	s := r.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = r.URL.Query().Get("lastEventId")
+	}
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+/*
+streamEvents sends the stored events after lastID and then live events which
+match the filter until done is closed, sending fails or the stream falls too far
+behind. Stored events about content removed since are sent redacted. ping is called when nothing was sent for a while to keep the connection
+open.
+*/
+func streamEvents(f *eventFilter, lastID int64, done <-chan struct{}, send func(e *Event) error, ping func() error) error {
+	live := events.subscribe()
+	defer events.unsubscribe(live)
+
+	for lastID > 0 {
+		backlog, err := getEventsAfter(lastID, eventBacklogPage)
+		if err != nil {
+			return err
+		}
+		if err := redactRemoved(backlog); err != nil {
+			return err
+		}
+		for i := range backlog {
+			lastID = backlog[i].ID
+			if !f.matches(&backlog[i]) {
+				continue
+			}
+			if err := send(&backlog[i]); err != nil {
+				return err
+			}
+		}
+		if len(backlog) < eventBacklogPage {
+			break
+		}
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-live:
+			if !ok {
+				return nil
+			}
+			if e.ID <= lastID {
+				continue
+			}
+			lastID = e.ID
+			if !f.matches(e) {
+				continue
+			}
+			if err := send(e); err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			if err := ping(); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+/*
+EventStream streams report and comment events as Server-Sent Events. The stream
+can be filtered with bbox, category and department and resumed with
+Last-Event-ID. Internal notes are only sent to staff.
+*/
+func EventStream(w http.ResponseWriter, r *http.Request) {
+	u, err := streamUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	f, err := eventFilterFromRequest(r, u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lastID, err := lastEventID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetryMillis)
+	flusher.Flush()
+
+	send := func(e *Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	ping := func() error {
+		if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	streamEvents(f, lastID, r.Context().Done(), send, ping)
+}
+
+/*
+EventSocket streams the same events as EventStream over a WebSocket, one JSON
+message per event. A stream is resumed with the lastEventId parameter.
+*/
+func EventSocket(w http.ResponseWriter, r *http.Request) {
+	u, err := streamUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	f, err := eventFilterFromRequest(r, u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lastID, err := lastEventID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := eventUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// Clients don't send anything, but reading is needed to notice when the
+	// connection is closed and to handle pongs.
+	done := make(chan struct{})
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(2 * eventHeartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * eventHeartbeat))
+	})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(e *Event) error {
+		conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		return conn.WriteJSON(e)
+	}
+	ping := func() error {
+		conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		return conn.WriteMessage(websocket.PingMessage, nil)
+	}
+	streamEvents(f, lastID, done, send, ping)
+}
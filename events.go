@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+Types of events published when reports and comments change.
+*/
+const (
+	EventReportCreated       = "report.created"
+	EventReportUpdated       = "report.updated"
+	EventReportStatusChanged = "report.status_changed"
+	EventCommentCreated      = "comment.created"
+)
+
+var eventTypes = map[string]bool{
+	EventReportCreated:       true,
+	EventReportUpdated:       true,
+	EventReportStatusChanged: true,
+	EventCommentCreated:      true,
+}
+
+const (
+	eventRetention      = 7 * 24 * time.Hour
+	eventCleanupPeriod  = time.Hour
+	eventSubscriberSize = 256
+)
+
+/*
+Event is something that happened on a report. Data holds the report, status
+change or comment the event is about. Events are numbered in the order they are
+published so clients can resume a stream after the last event they saw.
+
+The unexported fields describe the report for filtering. Events about internal
+notes are staffOnly.
+*/
+type Event struct {
+	ID       int64       `json:"id"`
+	Type     string      `json:"event"`
+	ReportID int         `json:"reportId"`
+	Date     time.Time   `json:"created"`
+	Data     interface{} `json:"data"`
+
+	staffOnly  bool
+	located    bool
+	lat, lng   float64
+	category   string
+	department string
+}
+
+/*
+removedReport is the data of a report.updated event for a report which is no
+longer visible.
+*/
+type removedReport struct {
+	ID      int  `json:"id"`
+	Removed bool `json:"removed"`
+}
+
+/*
+removedComment is the data of a stored comment.created event for a comment
+which is no longer visible.
+*/
+type removedComment struct {
+	ID      int  `json:"Id"`
+	Removed bool `json:"removed"`
+}
+
+/*
+redactRemoved replaces the data of stored events whose report or comment was
+hidden or deleted after the event was published, so clients resuming a stream
+are not sent content moderators took down.
+*/
+func redactRemoved(backlog []Event) error {
+	reports := map[int]bool{}
+	for i := range backlog {
+		e := &backlog[i]
+		visible, ok := reports[e.ReportID]
+		if !ok {
+			r, err := getReportByID(int64(e.ReportID))
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			visible = err == nil && r.Active == activeVisible
+			reports[e.ReportID] = visible
+		}
+		if e.Type != EventCommentCreated {
+			if !visible {
+				e.Data = removedReport{e.ReportID, true}
+			}
+			continue
+		}
+
+		var c struct {
+			ID int `json:"Id"`
+		}
+		raw, _ := e.Data.(json.RawMessage)
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return err
+		}
+		if visible {
+			comment, err := getCommentByID(int64(c.ID))
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			visible = err == nil && comment.Active == activeVisible
+		}
+		if !visible {
+			e.Data = removedComment{c.ID, true}
+		}
+	}
+	return nil
+}
+
+/*
+eventHub passes published events on to the open event streams.
+*/
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan *Event]bool
+}
+
+var events = &eventHub{subs: map[chan *Event]bool{}}
+
+/*
+publishMu keeps storing and broadcasting events in one order, so streams never
+see an event before one with a lower ID.
+*/
+var publishMu sync.Mutex
+
+func (h *eventHub) subscribe() chan *Event {
+	c := make(chan *Event, eventSubscriberSize)
+	h.mu.Lock()
+	h.subs[c] = true
+	h.mu.Unlock()
+	return c
+}
+
+func (h *eventHub) unsubscribe(c chan *Event) {
+	h.mu.Lock()
+	if h.subs[c] {
+		delete(h.subs, c)
+		close(c)
+	}
+	h.mu.Unlock()
+}
+
+/*
+broadcast sends an event to every stream. Streams which fall too far behind are
+closed; their clients reconnect and catch up from the stored events.
+*/
+func (h *eventHub) broadcast(e *Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.subs {
+		select {
+		case c <- e:
+		default:
+			delete(h.subs, c)
+			close(c)
+		}
+	}
+}
+
+/*
+publishEvent stores an event, sends it to the open event streams and hands it to
+the webhooks subscribed to its type. The cached map tiles of the report are
+dropped. Events about comments which are not public only go to staff and never
+to webhooks. Content held for moderation must not be published.
+*/
+func publishEvent(eventType string, reportID int, data interface{}) {
+	e := &Event{Type: eventType, ReportID: reportID, Date: time.Now(), Data: data}
+	if c, ok := data.(*Comment); ok && !c.isPublic() {
+		e.staffOnly = true
+	}
+	go func() {
+		if r, err := getReportByID(int64(reportID)); err == nil {
+			e.category = r.Category
+			if lat, lng, err := r.point(); err == nil {
+				e.located, e.lat, e.lng = true, lat, lng
+				tiles.invalidatePoint(lat, lng)
+			}
+			if c, err := getCategory(r.Category); err == nil {
+				e.department = c.Department
+			}
+		}
+		payload, err := json.Marshal(e.Data)
+		if err != nil {
+			log.Println("encoding event:", err)
+			return
+		}
+
+		publishMu.Lock()
+		err = insertEvent(e, string(payload))
+		if err == nil {
+			events.broadcast(e)
+		}
+		publishMu.Unlock()
+		if err != nil {
+			log.Println("storing event:", err)
+			return
+		}
+
+		if !e.staffOnly {
+			queueWebhookDeliveries(*e)
+		}
+	}()
+}
+
+/*
+publishReportUpdate publishes a report.updated event after a report was hidden,
+restored or deleted. Reports which are not visible anymore are sent as removed
+without their content.
+*/
+func publishReportUpdate(id int64) {
+	r, err := getReportByID(id)
+	if err != nil {
+		log.Println("loading updated report:", err)
+		return
+	}
+	if r.Active == activeVisible {
+		publishEvent(EventReportUpdated, r.ID, r)
+		return
+	}
+	publishEvent(EventReportUpdated, r.ID, removedReport{r.ID, true})
+}
+
+/*
+cleanupEvents deletes stored events once they are too old to resume a stream
+from. It is meant to be run in its own goroutine.
+*/
+func cleanupEvents() {
+	for {
+		if _, err := deleteEventsBefore(time.Now().Add(-eventRetention)); err != nil {
+			log.Println("cleaning up events:", err)
+		}
+		time.Sleep(eventCleanupPeriod)
+	}
+}
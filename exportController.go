@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+exportColumns are the columns of a CSV export, in their default order.
+*/
+var exportColumns = []string{"id", "created", "lat", "long", "description", "locInfo", "status", "category", "image"}
+
+/*
+exportValue returns the value of a CSV column for a report.
+*/
+func exportValue(r *Report, column string) string {
+	switch column {
+	case "id":
+		return strconv.Itoa(r.ID)
+	case "created":
+		return r.Date.Format(time.RFC3339)
+	case "lat":
+		return r.Lat.String()
+	case "long":
+		return r.Long.String()
+	case "description":
+		return r.Description
+	case "locInfo":
+		return r.LocationInfo
+	case "status":
+		return r.Status
+	case "category":
+		return r.Category
+	case "image":
+		return r.ImageLocation
+	}
+	return ""
+}
+
+/*
+exportFormat describes how reports are written in one export format.
+*/
+type exportFormat struct {
+	contentType string
+	extension   string
+	write       func(w io.Writer, r *http.Request, f *reportFilter) error
+}
+
+var exportFormats = map[string]exportFormat{
+	"geojson": {"application/geo+json", "geojson", writeGeoJSON},
+	"csv":     {"text/csv; charset=UTF-8", "csv", writeCSV},
+	"kml":     {"application/vnd.google-earth.kml+xml", "kml", writeKML},
+}
+
+/*
+csvColumns returns the columns asked for with columns, or all columns.
+*/
+func csvColumns(r *http.Request) ([]string, error) {
+	s := r.URL.Query().Get("columns")
+	if s == "" {
+		return exportColumns, nil
+	}
+	var columns []string
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		known := false
+		for _, e := range exportColumns {
+			if c == e {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, errors.New("Unknown column " + c + ", columns are " + strings.Join(exportColumns, ","))
+		}
+		columns = append(columns, c)
+	}
+	return columns, nil
+}
+
+/*
+csvCell keeps spreadsheets from running user text as a formula: a value
+starting with =, +, -, @ or a tab or carriage return is prefixed with a quote,
+unless it is a number such as a negative coordinate.
+*/
+func csvCell(v string) string {
+	if v == "" || !strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return v
+	}
+	if _, err := strconv.ParseFloat(v, 64); err == nil {
+		return v
+	}
+	return "'" + v
+}
+
+func writeCSV(w io.Writer, r *http.Request, f *reportFilter) error {
+	columns, _ := csvColumns(r)
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	record := make([]string, len(columns))
+	err := eachReport(f, func(report *Report) error {
+		for i, c := range columns {
+			record[i] = csvCell(exportValue(report, c))
+		}
+		return cw.Write(record)
+	})
+	cw.Flush()
+	if err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+/*
+geoJSONFeature is a report as a GeoJSON feature. Reports with coordinates which
+don't parse get a null geometry.
+*/
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         int                    `json:"id"`
+	Geometry   map[string]interface{} `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+func reportFeature(r *Report) geoJSONFeature {
+	f := geoJSONFeature{
+		Type: "Feature",
+		ID:   r.ID,
+		Properties: map[string]interface{}{
+			"id":          r.ID,
+			"created":     r.Date.Format(time.RFC3339),
+			"description": r.Description,
+			"locInfo":     r.LocationInfo,
+			"status":      r.Status,
+			"category":    r.Category,
+			"image":       r.ImageLocation,
+		},
+	}
+	if lat, lng, err := r.point(); err == nil {
+		f.Geometry = map[string]interface{}{
+			"type":        "Point",
+			"coordinates": []float64{lng, lat},
+		}
+	}
+	return f
+}
+
+func writeGeoJSON(w io.Writer, r *http.Request, f *reportFilter) error {
+	if _, err := io.WriteString(w, `{"type":"FeatureCollection","features":[`); err != nil {
+		return err
+	}
+	first := true
+	err := eachReport(f, func(report *Report) error {
+		b, err := json.Marshal(reportFeature(report))
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		_, err = w.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
+
+/*
+kmlPlacemark is a report as a KML placemark.
+*/
+type kmlPlacemark struct {
+	XMLName     xml.Name  `xml:"Placemark"`
+	ID          string    `xml:"id,attr"`
+	Name        string    `xml:"name"`
+	Description string    `xml:"description"`
+	Data        []kmlData `xml:"ExtendedData>Data"`
+	Coordinates string    `xml:"Point>coordinates,omitempty"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+func writeKML(w io.Writer, r *http.Request, f *reportFilter) error {
+	_, err := io.WriteString(w, xml.Header+`<kml xmlns="http://www.opengis.net/kml/2.2"><Document><name>CommComm reports</name>`)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	err = eachReport(f, func(report *Report) error {
+		p := kmlPlacemark{
+			ID:          "report-" + strconv.Itoa(report.ID),
+			Name:        "Report " + strconv.Itoa(report.ID),
+			Description: report.Description,
+			Data: []kmlData{
+				{"created", report.Date.Format(time.RFC3339)},
+				{"locInfo", report.LocationInfo},
+				{"status", report.Status},
+				{"category", report.Category},
+			},
+		}
+		if lat, lng, err := report.point(); err == nil {
+			p.Coordinates = strconv.FormatFloat(lng, 'f', -1, 64) + "," + strconv.FormatFloat(lat, 'f', -1, 64)
+		}
+		return enc.Encode(p)
+	})
+	if err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "</Document></kml>\n")
+	return err
+}
+
+/*
+ReportExport downloads the reports matching the filters of the report list as
+GeoJSON, CSV or KML. For CSV, columns selects and orders the columns. Reports
+are written while they are read from the database so exports of any size use
+little memory. Comments, and with them internal notes, are never exported.
+*/
+func ReportExport(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = "geojson"
+	}
+	format, ok := exportFormats[name]
+	if !ok {
+		http.Error(w, "format must be geojson, csv or kml", http.StatusBadRequest)
+		return
+	}
+	f, err := reportFilterFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if name == "csv" {
+		if _, err := csvColumns(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	filename := fmt.Sprintf("reports-%s.%s", time.Now().Format("20060102-150405"), format.extension)
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriterSize(w, 32*1024)
+	if err := format.write(bw, r, f); err != nil {
+		// The status is already sent; cutting the body short is all we can do.
+		log.Println("exporting reports:", err)
+		return
+	}
+	if err := bw.Flush(); err != nil {
+		log.Println("exporting reports:", err)
+	}
+}
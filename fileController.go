@@ -1,49 +1,365 @@
 package main
 
 import (
-	"io"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"net/http"
-	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
+const imageDir = "/home/ec2-user/images/"
+
+/*
+Visibility levels of an attachment. Public attachments can be fetched by anyone,
+reporter attachments only by the reporter of the report and staff, and staff
+attachments only by staff.
+*/
+const (
+	VisibilityPublic   = "public"
+	VisibilityReporter = "reporter"
+	VisibilityStaff    = "staff"
+)
+
+const (
+	defaultSignedURLTTL = 15 * time.Minute
+	maxSignedURLTTL     = 24 * time.Hour
+)
+
+/*
+Attachment contains information about a file uploaded to a report.
+URL is only filled in when the attachment is returned to a client and is signed
+for attachments which are not public.
+*/
+type Attachment struct {
+	ID         int       `json:"id"`
+	ReportID   int       `json:"reportId"`
+	UploaderID int       `json:"uploader"`
+	Filename   string    `json:"-"`
+	Visibility string    `json:"visibility"`
+	Date       time.Time `json:"created"`
+	Active     int       `json:"-"`
+	URL        string    `json:"url,omitempty"`
+}
+
+var errAttachmentNotFound = errors.New("Attachment not found")
+
+func validVisibility(v string) bool {
+	return v == VisibilityPublic || v == VisibilityReporter || v == VisibilityStaff
+}
+
+/*
+canViewAttachment reports whether the user u may fetch attachment a of the report.
+u may be nil for anonymous requests.
+*/
+func canViewAttachment(u *User, report *Report, a *Attachment) bool {
+	switch a.Visibility {
+	case VisibilityPublic:
+		return true
+	case VisibilityReporter:
+		return u.isStaff() || (u != nil && u.ID == report.ReporterID)
+	case VisibilityStaff:
+		return u.isStaff()
+	}
+	return false
+}
+
+func attachmentPath(a *Attachment) string {
+	return "/report/" + strconv.Itoa(a.ReportID) + "/image/" + strconv.Itoa(a.ID)
+}
+
+func urlSignature(path string, expires, userID int64) string {
+	mac := hmac.New(sha256.New, []byte(conf.Secret))
+	mac.Write([]byte(path + "|" + strconv.FormatInt(expires, 10) + "|" + strconv.FormatInt(userID, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/*
+signURL returns path signed with the server secret so that it can be fetched
+without further authorization until expires. If userID is not 0 the URL is
+bound to that user and only works together with their token.
+*/
+func signURL(path string, expires time.Time, userID int64) string {
+	exp := expires.Unix()
+	s := path + "?expires=" + strconv.FormatInt(exp, 10)
+	if userID != 0 {
+		s += "&user=" + strconv.FormatInt(userID, 10)
+	}
+	return s + "&signature=" + urlSignature(path, exp, userID)
+}
+
+/*
+verifySignedURL checks the signature, expiry and user binding of a signed request.
+u is the authenticated user of the request, or nil.
+*/
+func verifySignedURL(r *http.Request, u *User) bool {
+	vals := r.URL.Query()
+	sig := vals.Get("signature")
+	if sig == "" {
+		return false
+	}
+	exp, err := strconv.ParseInt(vals.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	var userID int64
+	if s := vals.Get("user"); s != "" {
+		userID, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return false
+		}
+		if u == nil || int64(u.ID) != userID {
+			return false
+		}
+	}
+
+	return hmac.Equal([]byte(sig), []byte(urlSignature(r.URL.Path, exp, userID)))
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+/*
+blobName returns a unique name to store an uploaded file under, keeping the
+base name the client supplied.
+*/
+func blobName(filename string) (string, error) {
+	prefix, err := randomToken(8)
+	if err != nil {
+		return "", err
+	}
+	return prefix + "-" + filepath.Base(filename), nil
+}
+
+/*
+attachmentFromRequest loads the report and attachment named by the route variables,
+returning an HTTP status code alongside any error.
+*/
+func attachmentFromRequest(r *http.Request) (*Report, *Attachment, int, error) {
+	v := mux.Vars(r)
+	reportID, err := strconv.ParseInt(v["reportId"], 10, 64)
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+	imageID, err := strconv.ParseInt(v["imageId"], 10, 64)
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+	report, err := getReportByID(reportID)
+	if err != nil {
+		return nil, nil, http.StatusNotFound, err
+	}
+	a, err := getAttachmentByID(imageID)
+	if err != nil || int64(a.ReportID) != reportID {
+		return nil, nil, http.StatusNotFound, errAttachmentNotFound
+	}
+	return report, a, http.StatusOK, nil
+}
+
 /*
-GetImage Returns the image corresponding to the
-TODO: possibly susceptible to attack since the passed in string is
-not checked as of yet.
+GetImage returns the file of an attachment. Public attachments are served to anyone,
+others require either a valid signed URL or an authorized user.
 */
 func GetImage(w http.ResponseWriter, r *http.Request) {
+	report, a, status, err := attachmentFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	u, _ := requestUser(r)
+	if !canViewAttachment(u, report, a) && !verifySignedURL(r, u) {
+		http.Error(w, "Not allowed to view attachment", http.StatusForbidden)
+		return
+	}
+	f, modified, err := blobs.Open(a.Filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	if a.Visibility != VisibilityPublic {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	http.ServeContent(w, r, a.Filename, modified, f)
+}
+
+/*
+SignedImageURL issues a signed, expiring URL for an attachment the requesting user
+is allowed to view. The optional ttl query parameter is the lifetime in seconds
+and bind=true ties the URL to the requesting user.
+*/
+func SignedImageURL(w http.ResponseWriter, r *http.Request) {
+	report, a, status, err := attachmentFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !canViewAttachment(u, report, a) {
+		http.Error(w, "Not allowed to view attachment", http.StatusForbidden)
+		return
+	}
+
+	ttl := defaultSignedURLTTL
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		secs, err := strconv.Atoi(s)
+		if err != nil || secs <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(secs) * time.Second
+		if ttl > maxSignedURLTTL {
+			ttl = maxSignedURLTTL
+		}
+	}
+	var userID int64
+	if r.URL.Query().Get("bind") == "true" {
+		userID = int64(u.ID)
+	}
+
+	expires := time.Now().Add(ttl)
+	resp := struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}{signURL(attachmentPath(a), expires, userID), expires}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+ReportAttachments lists the attachments of a report the requesting user may view.
+Attachments which are not public carry a short lived signed URL, which works
+without a token so it can be used in an img tag. As with SignedImageURL,
+bind=true ties the URLs to the requesting user.
+*/
+func ReportAttachments(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
-	s := v["imageId"]
-	http.ServeFile(w, r, "/home/ec2-user/images/"+s)
+	id, err := strconv.ParseInt(v["reportId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := getReportByID(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	attachments, err := getReportAttachments(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	u, _ := requestUser(r)
+	bind := r.URL.Query().Get("bind") == "true"
+	visible := []Attachment{}
+	for _, a := range attachments {
+		if !canViewAttachment(u, report, &a) {
+			continue
+		}
+		if a.Visibility == VisibilityPublic {
+			a.URL = attachmentPath(&a)
+		} else {
+			var userID int64
+			if bind {
+				userID = int64(u.ID)
+			}
+			a.URL = signURL(attachmentPath(&a), time.Now().Add(defaultSignedURLTTL), userID)
+		}
+		visible = append(visible, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(visible); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 }
 
 /*
-UploadFile processes and saves an uploaded image.
+UploadFile processes and saves an uploaded image. The visibility form value sets who
+may see the attachment and defaults to public. Restricted attachments can only be
+uploaded by the reporter or staff.
 */
 func UploadFile(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	reportID, err := strconv.ParseInt(v["reportId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := getSpecificReport(reportID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
 	r.ParseMultipartForm(32 << 20)
+	visibility := r.FormValue("visibility")
+	if visibility == "" {
+		visibility = VisibilityPublic
+	}
+	if !validVisibility(visibility) {
+		http.Error(w, "Invalid visibility", http.StatusBadRequest)
+		return
+	}
+	u, _ := requestUser(r)
+	if visibility != VisibilityPublic && !canViewAttachment(u, report, &Attachment{Visibility: visibility}) {
+		http.Error(w, "Not allowed to upload with this visibility", http.StatusForbidden)
+		return
+	}
+
 	file, handler, err := r.FormFile("uploadfile")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer file.Close()
-	n, err := splitString(handler.Filename, "/")
+
+	name, err := blobName(handler.Filename)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	out, err := os.Create("/home/ec2-user/images/" + n[len(n)-1])
-	if err != nil {
+	if _, err := blobs.Put(name, file); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer out.Close()
-	_, err = io.Copy(out, file)
+
+	a := Attachment{ReportID: report.ID, Filename: name, Visibility: visibility}
+	if u != nil {
+		a.UploaderID = u.ID
+	}
+	created, err := insertAttachment(&a)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 }
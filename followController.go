@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+FollowReport is the handler function for the requesting user following a report
+to be notified about status changes and new public comments.
+*/
+func FollowReport(w http.ResponseWriter, r *http.Request) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["reportId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := getSpecificReport(id); err != nil {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	if err := insertFollow(id, u.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+UnfollowReport is the handler function for the requesting user no longer
+following a report.
+*/
+func UnfollowReport(w http.ResponseWriter, r *http.Request) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["reportId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := deleteFollow(id, u.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+notifyFollowers sends n to every follower of a report except actorID, the user
+who caused the event.
+*/
+func notifyFollowers(reportID int64, actorID int, n Notification) {
+	followers, err := getReportFollowers(reportID)
+	if err != nil {
+		return
+	}
+	for _, f := range followers {
+		if f.ID == actorID {
+			continue
+		}
+		n.UserID = f.ID
+		notify(n)
+	}
+}
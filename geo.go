@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const earthRadius = 6371008.8
+
+var errInvalidGeometry = errors.New("Invalid geometry")
+
+var errInvalidBBox = errors.New("bbox must be minLng,minLat,maxLng,maxLat")
+
+/*
+Geometry is a GeoJSON geometry. Only Polygon and MultiPolygon are used as areas.
+*/
+type Geometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+/*
+polygon is a list of rings, each a list of [longitude, latitude] positions. The
+first ring is the outer boundary and any further rings are holes.
+*/
+type polygon [][][2]float64
+
+/*
+bbox is a bounding box in degrees.
+*/
+type bbox struct {
+	MinLat, MinLng, MaxLat, MaxLng float64
+}
+
+func (b bbox) contains(lat, lng float64) bool {
+	return lat >= b.MinLat && lat <= b.MaxLat && lng >= b.MinLng && lng <= b.MaxLng
+}
+
+/*
+parseBBox parses a bounding box given as "minLng,minLat,maxLng,maxLat", the
+order used by GeoJSON.
+*/
+func parseBBox(s string) (bbox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return bbox{}, errInvalidBBox
+	}
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return bbox{}, errInvalidBBox
+		}
+		v[i] = f
+	}
+	b := bbox{MinLng: v[0], MinLat: v[1], MaxLng: v[2], MaxLat: v[3]}
+	if b.MinLat > b.MaxLat || b.MinLng > b.MaxLng || b.MinLat < -90 || b.MaxLat > 90 || b.MinLng < -180 || b.MaxLng > 180 {
+		return bbox{}, errInvalidBBox
+	}
+	return b, nil
+}
+
+/*
+coordinatePrecision is the number of decimals coordinates are stored with, about
+a tenth of a meter.
+*/
+const coordinatePrecision = 6
+
+var errInvalidCoordinate = errors.New("Coordinates must be numbers")
+
+/*
+Coordinate is a latitude or longitude in degrees. It is written to JSON as a
+number and read from numbers or, as older clients send them, numeric strings.
+Values are rounded to the precision they are stored with.
+*/
+type Coordinate float64
+
+func parseCoordinate(s string) (Coordinate, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, errInvalidCoordinate
+	}
+	scale := math.Pow10(coordinatePrecision)
+	return Coordinate(math.Round(f*scale) / scale), nil
+}
+
+func (c *Coordinate) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		if s == "" {
+			return nil
+		}
+	}
+	v, err := parseCoordinate(s)
+	if err != nil {
+		return err
+	}
+	*c = v
+	return nil
+}
+
+func (c Coordinate) String() string {
+	return strconv.FormatFloat(float64(c), 'f', -1, 64)
+}
+
+func (c Coordinate) MarshalJSON() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+/*
+point returns the coordinates of a report. They must be within range, and 0,0,
+the value of coordinates which were not sent, is refused.
+*/
+func (r *Report) point() (lat, lng float64, err error) {
+	lat, lng = float64(r.Lat), float64(r.Long)
+	switch {
+	case lat == 0 && lng == 0:
+		return 0, 0, errors.New("lat and long are required")
+	case lat < -90 || lat > 90:
+		return 0, 0, errors.New("lat must be between -90 and 90")
+	case lng < -180 || lng > 180:
+		return 0, 0, errors.New("long must be between -180 and 180")
+	}
+	return lat, lng, nil
+}
+
+/*
+Limits of the accuracy radius and altitude devices report, in meters.
+*/
+const (
+	maxAccuracy = 100000
+	minAltitude = -1000
+	maxAltitude = 10000
+)
+
+var errOutsideServiceArea = errors.New("The location is outside the service area")
+
+/*
+serviceArea is where reports are accepted, from the serviceArea of the
+configuration. Without one, reports are accepted anywhere.
+*/
+var serviceArea []polygon
+
+func initServiceArea(g *Geometry) error {
+	serviceArea = nil
+	if g == nil {
+		return nil
+	}
+	ps, err := g.polygons()
+	if err != nil {
+		return errors.New("serviceArea must be a Polygon or MultiPolygon: " + err.Error())
+	}
+	serviceArea = ps
+	return nil
+}
+
+func inServiceArea(lat, lng float64) bool {
+	return serviceArea == nil || polygonsContain(serviceArea, lat, lng)
+}
+
+/*
+validateLocation checks the coordinates, accuracy and altitude of a new report
+and that it lies within the service area, returning errOutsideServiceArea if
+not.
+*/
+func (r *Report) validateLocation() error {
+	lat, lng, err := r.point()
+	if err != nil {
+		return err
+	}
+	if r.Accuracy != nil && (*r.Accuracy < 0 || *r.Accuracy > maxAccuracy || math.IsNaN(*r.Accuracy)) {
+		return errors.New("accuracy must be between 0 and 100000 meters")
+	}
+	if r.Altitude != nil && (*r.Altitude < minAltitude || *r.Altitude > maxAltitude || math.IsNaN(*r.Altitude)) {
+		return errors.New("altitude must be between -1000 and 10000 meters")
+	}
+	if !inServiceArea(lat, lng) {
+		return errOutsideServiceArea
+	}
+	return nil
+}
+
+/*
+distance returns the great circle distance in meters between two points.
+*/
+func distance(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+/*
+radiusBBox returns a box containing the circle of radius meters around a point.
+*/
+func radiusBBox(lat, lng, radius float64) bbox {
+	dLat := radius / earthRadius * 180 / math.Pi
+	dLng := 180.0
+	if c := math.Cos(lat * math.Pi / 180); c > 1e-9 {
+		dLng = math.Min(180, dLat/c)
+	}
+	return bbox{lat - dLat, lng - dLng, lat + dLat, lng + dLng}
+}
+
+/*
+polygons decodes a Polygon or MultiPolygon geometry.
+*/
+func (g *Geometry) polygons() ([]polygon, error) {
+	switch g.Type {
+	case "Polygon":
+		var p polygon
+		if err := json.Unmarshal(g.Coordinates, &p); err != nil {
+			return nil, err
+		}
+		if len(p) == 0 || len(p[0]) < 4 {
+			return nil, errInvalidGeometry
+		}
+		return []polygon{p}, nil
+	case "MultiPolygon":
+		var ps []polygon
+		if err := json.Unmarshal(g.Coordinates, &ps); err != nil {
+			return nil, err
+		}
+		if len(ps) == 0 {
+			return nil, errInvalidGeometry
+		}
+		for _, p := range ps {
+			if len(p) == 0 || len(p[0]) < 4 {
+				return nil, errInvalidGeometry
+			}
+		}
+		return ps, nil
+	}
+	return nil, errInvalidGeometry
+}
+
+func (p polygon) bbox() bbox {
+	b := bbox{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, pos := range p[0] {
+		b.MinLng = math.Min(b.MinLng, pos[0])
+		b.MaxLng = math.Max(b.MaxLng, pos[0])
+		b.MinLat = math.Min(b.MinLat, pos[1])
+		b.MaxLat = math.Max(b.MaxLat, pos[1])
+	}
+	return b
+}
+
+func polygonsBBox(ps []polygon) bbox {
+	b := ps[0].bbox()
+	for _, p := range ps[1:] {
+		pb := p.bbox()
+		b.MinLat = math.Min(b.MinLat, pb.MinLat)
+		b.MinLng = math.Min(b.MinLng, pb.MinLng)
+		b.MaxLat = math.Max(b.MaxLat, pb.MaxLat)
+		b.MaxLng = math.Max(b.MaxLng, pb.MaxLng)
+	}
+	return b
+}
+
+/*
+ringContains tests whether a point lies inside a ring using ray casting.
+*/
+func ringContains(ring [][2]float64, lat, lng float64) bool {
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > lat) != (yj > lat) && lng < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			in = !in
+		}
+	}
+	return in
+}
+
+func (p polygon) contains(lat, lng float64) bool {
+	if !ringContains(p[0], lat, lng) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if ringContains(hole, lat, lng) {
+			return false
+		}
+	}
+	return true
+}
+
+func polygonsContain(ps []polygon, lat, lng float64) bool {
+	for _, p := range ps {
+		if p.contains(lat, lng) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+maxMercatorLat is the latitude where Web Mercator tiles end.
+*/
+const maxMercatorLat = 85.05112878
+
+/*
+mercator returns the position of a point at zoom level z in tiles from the
+north-west corner of the map.
+*/
+func mercator(lat, lng float64, z int) (x, y float64) {
+	n := math.Exp2(float64(z))
+	lat = math.Max(-maxMercatorLat, math.Min(maxMercatorLat, lat))
+	rad := lat * math.Pi / 180
+	return (lng + 180) / 360 * n, (1 - math.Log(math.Tan(rad)+1/math.Cos(rad))/math.Pi) / 2 * n
+}
+
+/*
+tileOf returns the Web Mercator tile containing a point at zoom level z.
+*/
+func tileOf(lat, lng float64, z int) (x, y int) {
+	fx, fy := mercator(lat, lng, z)
+	x, y = int(fx), int(fy)
+	max := 1<<uint(z) - 1
+	if x > max {
+		x = max
+	}
+	if y > max {
+		y = max
+	}
+	if x < 0 {
+		x = 0
+	}
+	if y < 0 {
+		y = 0
+	}
+	return x, y
+}
+
+/*
+tileLat returns the latitude of the northern edge of tile row y, which may be
+fractional, at zoom level z.
+*/
+func tileLat(z int, y float64) float64 {
+	n := math.Pi - 2*math.Pi*y/math.Exp2(float64(z))
+	return 180 / math.Pi * math.Atan(math.Sinh(n))
+}
+
+/*
+tileBBox returns the area covered by a Web Mercator tile.
+*/
+func tileBBox(z, x, y int) bbox {
+	n := math.Exp2(float64(z))
+	return bbox{
+		MinLat: tileLat(z, float64(y+1)),
+		MaxLat: tileLat(z, float64(y)),
+		MinLng: float64(x)/n*360 - 180,
+		MaxLng: float64(x+1)/n*360 - 180,
+	}
+}
+
+/*
+validTile reports whether z, x and y name a tile.
+*/
+func validTile(z, x, y int) bool {
+	if z < 0 || z > maxTileZoom {
+		return false
+	}
+	n := 1 << uint(z)
+	return x >= 0 && x < n && y >= 0 && y < n
+}
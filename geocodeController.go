@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+/*
+geocoderFromRequest returns the geocoder, answering 503 if geocoding is off.
+*/
+func geocoderFromRequest(w http.ResponseWriter) (Geocoder, bool) {
+	if geocoder == nil {
+		http.Error(w, "Geocoding is not available", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return geocoder, true
+}
+
+/*
+GeocodeReverse returns the address of the location given by lat and long.
+*/
+func GeocodeReverse(w http.ResponseWriter, r *http.Request) {
+	g, ok := geocoderFromRequest(w)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	lat, err1 := strconv.ParseFloat(q.Get("lat"), 64)
+	lng, err2 := strconv.ParseFloat(q.Get("long"), 64)
+	if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		http.Error(w, "lat and long must be valid coordinates", http.StatusBadRequest)
+		return
+	}
+	a, err := g.Reverse(lat, lng)
+	if err == errNoAddress {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(a); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+GeocodeSearch finds addresses for the search box by the words in q. With lat and
+long, addresses near that location come first. limit caps the results.
+*/
+func GeocodeSearch(w http.ResponseWriter, r *http.Request) {
+	g, ok := geocoderFromRequest(w)
+	if !ok {
+		return
+	}
+	vals := r.URL.Query()
+	q := GeocodeQuery{Text: vals.Get("q")}
+	if q.Text == "" || len(q.Text) > 255 {
+		http.Error(w, "q must have between 1 and 255 characters", http.StatusBadRequest)
+		return
+	}
+	var err error
+	q.Limit, _, err = pageParams(r, defaultSearchResults, maxSearchResults)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if vals.Get("lat") != "" || vals.Get("long") != "" {
+		var err1, err2 error
+		q.Lat, err1 = strconv.ParseFloat(vals.Get("lat"), 64)
+		q.Lng, err2 = strconv.ParseFloat(vals.Get("long"), 64)
+		if err1 != nil || err2 != nil || q.Lat < -90 || q.Lat > 90 || q.Lng < -180 || q.Lng > 180 {
+			http.Error(w, "lat and long must be valid coordinates", http.StatusBadRequest)
+			return
+		}
+		q.Near = true
+	}
+	addresses, err := g.Search(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(addresses); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
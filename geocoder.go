@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// reverseRadius is how far from a location addresses are looked for.
+	reverseRadius = 200.0
+	// addressDistance is how close an address point has to be for a location
+	// to be described by it rather than as near it or at an intersection.
+	addressDistance = 40.0
+	// intersectionRatio bounds how much further the second street may be than
+	// the nearest for a location to count as their intersection.
+	intersectionRatio = 1.5
+
+	maxReverseCandidates = 500
+	defaultSearchResults = 5
+	maxSearchResults     = 20
+	addressBatch         = 1000
+)
+
+var errNoAddress = errors.New("No address near this location")
+
+/*
+Address is a place found by a geocoder. Label is the human-readable form used
+as the location info of reports. For locations between addresses CrossStreet
+names the second street of an intersection. Distance is how far a reverse
+geocoded location is from the address, in meters.
+*/
+type Address struct {
+	Label       string  `json:"label"`
+	Number      string  `json:"number,omitempty"`
+	Street      string  `json:"street,omitempty"`
+	CrossStreet string  `json:"crossStreet,omitempty"`
+	City        string  `json:"city,omitempty"`
+	Postcode    string  `json:"postcode,omitempty"`
+	Lat         float64 `json:"lat"`
+	Lng         float64 `json:"long"`
+	Distance    float64 `json:"distance,omitempty"`
+}
+
+/*
+GeocodeQuery is a forward geocoding search. With Near set, results close to
+Lat and Lng come first.
+*/
+type GeocodeQuery struct {
+	Text     string
+	Near     bool
+	Lat, Lng float64
+	Limit    int
+}
+
+/*
+Geocoder turns coordinates into addresses and searches addresses by text.
+Reverse returns errNoAddress when nothing is known near a location.
+*/
+type Geocoder interface {
+	Name() string
+	Reverse(lat, lng float64) (*Address, error)
+	Search(q GeocodeQuery) ([]Address, error)
+}
+
+/*
+GeocoderConfig chooses the geocoder: local, the default, uses the address
+points loaded into the database with "commcomm addresses"; none turns
+geocoding off.
+*/
+type GeocoderConfig struct {
+	Provider string `json:"provider"`
+}
+
+/*
+geocoder is the configured geocoder, nil if geocoding is off.
+*/
+var geocoder Geocoder
+
+/*
+geocoderFactories create the geocoders which can be configured, by provider
+name. Geocoders backed by external services are added here.
+*/
+var geocoderFactories = map[string]func(GeocoderConfig) (Geocoder, error){
+	"local": func(GeocoderConfig) (Geocoder, error) { return localGeocoder{}, nil },
+}
+
+func initGeocoder(c GeocoderConfig) error {
+	switch c.Provider {
+	case "none":
+		geocoder = nil
+		return nil
+	case "":
+		c.Provider = "local"
+	}
+	newGeocoder, ok := geocoderFactories[c.Provider]
+	if !ok {
+		return errors.New("Unknown geocoder " + c.Provider)
+	}
+	g, err := newGeocoder(c)
+	if err != nil {
+		return err
+	}
+	geocoder = g
+	return nil
+}
+
+/*
+fillLocationInfo describes the location of a report by its address when the
+reporter left the location info empty. Reports are stored without one when
+geocoding fails.
+*/
+func fillLocationInfo(r *Report) {
+	if geocoder == nil || strings.TrimSpace(r.LocationInfo) != "" {
+		return
+	}
+	lat, lng, err := r.point()
+	if err != nil {
+		return
+	}
+	a, err := geocoder.Reverse(lat, lng)
+	if err != nil {
+		if err != errNoAddress {
+			log.Println("reverse geocoding:", err)
+		}
+		return
+	}
+	r.LocationInfo = a.Label
+	if len(r.LocationInfo) > 255 {
+		// Cut on a rune boundary to keep the text valid UTF-8.
+		n := 255
+		for n > 0 && !utf8.RuneStart(r.LocationInfo[n]) {
+			n--
+		}
+		r.LocationInfo = r.LocationInfo[:n]
+	}
+}
+
+/*
+addressPoint is a known address with its position, as loaded into the
+address_points table.
+*/
+type addressPoint struct {
+	Number, Street, City, Postcode string
+	Lat, Lng                       float64
+}
+
+func (p *addressPoint) address() Address {
+	a := Address{Number: p.Number, Street: p.Street, City: p.City, Postcode: p.Postcode, Lat: p.Lat, Lng: p.Lng}
+	a.Label = strings.TrimSpace(p.Number + " " + p.Street)
+	if p.City != "" {
+		a.Label += ", " + p.City
+	}
+	return a
+}
+
+/*
+searchText is what address searches match against.
+*/
+func (p *addressPoint) searchText() string {
+	return strings.ToLower(strings.Join(strings.Fields(p.Number+" "+p.Street+" "+p.City+" "+p.Postcode), " "))
+}
+
+/*
+localGeocoder looks up addresses in the address_points table.
+*/
+type localGeocoder struct{}
+
+func (localGeocoder) Name() string { return "local" }
+
+/*
+Reverse describes a location by the nearest address point within 40 meters.
+Further from any address, a location about as close to two streets is given
+as their intersection and otherwise as near the nearest address.
+*/
+func (localGeocoder) Reverse(lat, lng float64) (*Address, error) {
+	points, err := getAddressPoints(radiusBBox(lat, lng, reverseRadius), lat, lng, maxReverseCandidates)
+	if err != nil {
+		return nil, err
+	}
+	type candidate struct {
+		p *addressPoint
+		d float64
+	}
+	var near []candidate
+	for i := range points {
+		if d := distance(lat, lng, points[i].Lat, points[i].Lng); d <= reverseRadius {
+			near = append(near, candidate{&points[i], d})
+		}
+	}
+	if len(near) == 0 {
+		return nil, errNoAddress
+	}
+	sort.Slice(near, func(i, j int) bool { return near[i].d < near[j].d })
+
+	nearest := near[0]
+	a := nearest.p.address()
+	a.Distance = nearest.d
+	if nearest.d <= addressDistance {
+		return &a, nil
+	}
+	for _, c := range near[1:] {
+		if c.p.Street == nearest.p.Street || c.p.Street == "" {
+			continue
+		}
+		if c.d <= nearest.d*intersectionRatio {
+			a.Number = ""
+			a.CrossStreet = c.p.Street
+			a.Label = nearest.p.Street + " & " + c.p.Street
+			if a.City != "" {
+				a.Label += ", " + a.City
+			}
+			return &a, nil
+		}
+		break
+	}
+	a.Label = "Near " + a.Label
+	return &a, nil
+}
+
+/*
+Search finds addresses containing every word of the query.
+*/
+func (localGeocoder) Search(q GeocodeQuery) ([]Address, error) {
+	terms := strings.Fields(strings.ToLower(q.Text))
+	if len(terms) == 0 {
+		return []Address{}, nil
+	}
+	points, err := searchAddressPoints(terms, q)
+	if err != nil {
+		return nil, err
+	}
+	addresses := []Address{}
+	for i := range points {
+		a := points[i].address()
+		if q.Near {
+			a.Distance = distance(q.Lat, q.Lng, a.Lat, a.Lng)
+		}
+		addresses = append(addresses, a)
+	}
+	return addresses, nil
+}
+
+/*
+addressColumns are the column or property names of address fields in address
+files, including those of OpenStreetMap and OpenAddresses.
+*/
+var addressColumns = map[string]string{
+	"lat":              "lat",
+	"latitude":         "lat",
+	"y":                "lat",
+	"lon":              "long",
+	"long":             "long",
+	"lng":              "long",
+	"longitude":        "long",
+	"x":                "long",
+	"number":           "number",
+	"housenumber":      "number",
+	"addr:housenumber": "number",
+	"street":           "street",
+	"addr:street":      "street",
+	"city":             "city",
+	"addr:city":        "city",
+	"postcode":         "postcode",
+	"zip":              "postcode",
+	"addr:postcode":    "postcode",
+}
+
+/*
+addressFromValues makes an address point of the values of a row, keyed by
+addressColumns.
+*/
+func addressFromValues(values map[string]string) (*addressPoint, error) {
+	p := &addressPoint{
+		Number:   values["number"],
+		Street:   values["street"],
+		City:     values["city"],
+		Postcode: values["postcode"],
+	}
+	var err1, err2 error
+	p.Lat, err1 = strconv.ParseFloat(values["lat"], 64)
+	p.Lng, err2 = strconv.ParseFloat(values["long"], 64)
+	if err1 != nil || err2 != nil || p.Lat < -90 || p.Lat > 90 || p.Lng < -180 || p.Lng > 180 {
+		return nil, errors.New("invalid coordinates")
+	}
+	if p.Street == "" {
+		return nil, errors.New("no street")
+	}
+	if len(p.Number) > 32 || len(p.Street) > 255 || len(p.City) > 255 || len(p.Postcode) > 32 {
+		return nil, errors.New("field too long")
+	}
+	return p, nil
+}
+
+/*
+readAddresses calls fn for every address of a CSV file with a header line or a
+GeoJSON FeatureCollection of points. Rows which are no valid address are
+counted as skipped.
+*/
+func readAddresses(in io.Reader, format string, fn func(p *addressPoint) error) (skipped int, err error) {
+	if format == "geojson" {
+		dec, err := geoJSONFeatures(in)
+		if err != nil {
+			return 0, err
+		}
+		for dec.More() {
+			var feature struct {
+				Geometry *struct {
+					Type        string    `json:"type"`
+					Coordinates []float64 `json:"coordinates"`
+				} `json:"geometry"`
+				Properties map[string]interface{} `json:"properties"`
+			}
+			if err := dec.Decode(&feature); err != nil {
+				return skipped, err
+			}
+			values := map[string]string{}
+			for name, v := range feature.Properties {
+				if field := addressColumns[strings.ToLower(name)]; field != "" && v != nil {
+					values[field] = propertyString(feature.Properties, name)
+				}
+			}
+			if g := feature.Geometry; g != nil && g.Type == "Point" && len(g.Coordinates) >= 2 {
+				values["long"] = strconv.FormatFloat(g.Coordinates[0], 'f', -1, 64)
+				values["lat"] = strconv.FormatFloat(g.Coordinates[1], 'f', -1, 64)
+			}
+			p, err := addressFromValues(values)
+			if err != nil {
+				skipped++
+				continue
+			}
+			if err := fn(p); err != nil {
+				return skipped, err
+			}
+		}
+		return skipped, nil
+	}
+
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return 0, errors.New("Reading CSV header: " + err.Error())
+	}
+	fields := make([]string, len(header))
+	for i, c := range header {
+		fields[i] = addressColumns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(c, "\ufeff")))]
+	}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return skipped, nil
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				skipped++
+				continue
+			}
+			return skipped, err
+		}
+		values := map[string]string{}
+		for i, v := range record {
+			if i < len(fields) && fields[i] != "" {
+				values[fields[i]] = strings.TrimSpace(v)
+			}
+		}
+		p, err := addressFromValues(values)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if err := fn(p); err != nil {
+			return skipped, err
+		}
+	}
+}
+
+/*
+addressesCommand implements "commcomm addresses", which loads address points
+for the local geocoder from a CSV or GeoJSON file, such as an OpenAddresses or
+OpenStreetMap extract.
+*/
+func addressesCommand(args []string) {
+	fs := flag.NewFlagSet("addresses", flag.ExitOnError)
+	configFile := fs.String("config", "conf.json", "Configuration file.")
+	format := fs.String("format", "", "Format of the file, csv or geojson. Guessed from the file name if empty.")
+	replace := fs.Bool("replace", false, "Delete the loaded addresses first.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: commcomm addresses [flags] file")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	name := fs.Arg(0)
+	if *format == "" {
+		*format = "csv"
+		if strings.HasSuffix(name, ".geojson") || strings.HasSuffix(name, ".json") {
+			*format = "geojson"
+		}
+	}
+	if *format != "csv" && *format != "geojson" {
+		fmt.Fprintln(os.Stderr, "format must be csv or geojson")
+		os.Exit(2)
+	}
+
+	conf = *getConfig(*configFile)
+	if err := InitDb(conf.DB.Username, conf.DB.Userpass, conf.DB.Address, conf.DB.Port); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer closeDb()
+
+	in, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer in.Close()
+
+	if *replace {
+		if err := deleteAddressPoints(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	loaded := 0
+	var batch []addressPoint
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := insertAddressPoints(batch); err != nil {
+			return err
+		}
+		loaded += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	skipped, err := readAddresses(in, *format, func(p *addressPoint) error {
+		batch = append(batch, *p)
+		if len(batch) >= addressBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Loading addresses failed:", err)
+		fmt.Fprintln(os.Stderr, loaded, "addresses were loaded")
+		os.Exit(1)
+	}
+	fmt.Printf("%d addresses loaded, %d rows skipped\n", loaded, skipped)
+}
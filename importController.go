@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const maxImportSize = 100 << 20
+
+/*
+ImportCreate imports reports from the uploaded file in the multipart field
+file. The field options holds ImportOptions as JSON; format defaults to the
+extension of the file and dryRun=true may also be given as a form value. The
+reports are filed as the admin unless options name a reporter. An import which
+fails part way through is still recorded, with the reason it was aborted, and
+answered with 422.
+*/
+func ImportCreate(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "The file to import is missing", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	var o ImportOptions
+	if s := r.FormValue("options"); s != "" {
+		if err := json.Unmarshal([]byte(s), &o); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if o.Format == "" {
+		o.Format = "csv"
+		if strings.HasSuffix(header.Filename, ".geojson") || strings.HasSuffix(header.Filename, ".json") {
+			o.Format = "geojson"
+		}
+	}
+	if r.FormValue("dryRun") == "true" {
+		o.DryRun = true
+	}
+	if o.ReporterID == 0 {
+		o.ReporterID = u.ID
+	}
+
+	var errs bytes.Buffer
+	res, err := runImport(file, &o, &errs)
+	if res == nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	res.UserID = u.ID
+	if !o.DryRun && res.Imported > 0 {
+		tiles.clear()
+	}
+	if res.Rejected > 0 {
+		token, err := randomToken(16)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.ErrorReport = "import-" + token + "-errors.csv"
+		if _, err := blobs.Put(res.ErrorReport, &errs); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := insertImport(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusCreated
+	if res.Aborted != "" {
+		status = http.StatusUnprocessableEntity
+	} else if o.DryRun {
+		status = http.StatusOK
+	}
+	writeImport(w, status, res)
+}
+
+/*
+writeImport answers with an import and, if rows were rejected, where to download
+the error report.
+*/
+func writeImport(w http.ResponseWriter, status int, i *Import) {
+	resp := struct {
+		*Import
+		Errors string `json:"errors,omitempty"`
+	}{Import: i}
+	if i.ErrorReport != "" {
+		resp.Errors = "/import/" + strconv.Itoa(i.ID) + "/errors"
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+importFromRoute loads the import named in the route.
+*/
+func importFromRoute(w http.ResponseWriter, r *http.Request) (*Import, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["importId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	i, err := getImport(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Import not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return i, true
+}
+
+/*
+ImportDetails returns the outcome of an import.
+*/
+func ImportDetails(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	i, ok := importFromRoute(w, r)
+	if !ok {
+		return
+	}
+	writeImport(w, http.StatusOK, i)
+}
+
+/*
+ImportErrors downloads the rows an import rejected as CSV.
+*/
+func ImportErrors(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	i, ok := importFromRoute(w, r)
+	if !ok {
+		return
+	}
+	if i.ErrorReport == "" {
+		http.Error(w, "The import rejected no rows", http.StatusNotFound)
+		return
+	}
+	f, modtime, err := blobs.Open(i.ErrorReport)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="import-`+strconv.Itoa(i.ID)+`-errors.csv"`)
+	http.ServeContent(w, r, "", modtime, f)
+}
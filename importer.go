@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultImportBatch = 500
+	maxImportBatch     = 5000
+)
+
+/*
+Fields of a report an import can fill. Description, lat and long are required.
+*/
+var importFields = []string{"description", "lat", "long", "locInfo", "category", "status", "created", "image"}
+
+/*
+importAliases are column or property names recognized without a mapping, such
+as the names used by Open311.
+*/
+var importAliases = map[string]string{
+	"latitude":           "lat",
+	"longitude":          "long",
+	"lon":                "long",
+	"lng":                "long",
+	"address":            "locInfo",
+	"address_string":     "locInfo",
+	"service_code":       "category",
+	"requested_datetime": "created",
+	"media_url":          "image",
+}
+
+var importDateLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02", "01/02/2006"}
+
+/*
+ImportOptions controls an import. Columns maps report fields to the CSV column
+or GeoJSON property holding them. Categories and Statuses translate the values
+of the source into category codes and statuses. With DryRun everything is
+validated but nothing is stored.
+*/
+type ImportOptions struct {
+	Format     string            `json:"format"`
+	Columns    map[string]string `json:"columns"`
+	Categories map[string]string `json:"categories"`
+	Statuses   map[string]string `json:"statuses"`
+	DryRun     bool              `json:"dryRun"`
+	BatchSize  int               `json:"batchSize"`
+	ReporterID int               `json:"reporter"`
+}
+
+/*
+Import is the outcome of an import. Rows are counted from 1, for CSV without
+the header. When rows were rejected an error report lists them with the reason.
+Aborted is why an import stopped before the end of the file; the batches stored
+until then are kept.
+*/
+type Import struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"user"`
+	Format      string    `json:"format"`
+	DryRun      bool      `json:"dryRun"`
+	Total       int       `json:"total"`
+	Imported    int       `json:"imported"`
+	Rejected    int       `json:"rejected"`
+	ErrorReport string    `json:"-"`
+	Date        time.Time `json:"created"`
+	Aborted     string    `json:"aborted,omitempty"`
+}
+
+/*
+importSource yields the rows of an import one by one as field values, and the
+raw row for the error report. next returns io.EOF after the last row.
+*/
+type importSource interface {
+	header() []string
+	next() (values map[string]string, raw []string, err error)
+}
+
+/*
+importRowError rejects a single row; other errors abort the import.
+*/
+type importRowError struct {
+	msg string
+}
+
+func (e *importRowError) Error() string { return e.msg }
+
+func rowError(format string, a ...interface{}) error {
+	return &importRowError{fmt.Sprintf(format, a...)}
+}
+
+/*
+fieldFor returns the report field a source column maps to.
+*/
+func (o *ImportOptions) fieldFor(column string) string {
+	for field, c := range o.Columns {
+		if c == column {
+			return field
+		}
+	}
+	if len(o.Columns) > 0 {
+		return ""
+	}
+	for _, f := range importFields {
+		if f == column {
+			return f
+		}
+	}
+	return importAliases[strings.ToLower(column)]
+}
+
+func (o *ImportOptions) validate() error {
+	switch o.Format {
+	case "csv", "geojson":
+	default:
+		return errors.New("format must be csv or geojson")
+	}
+	for field := range o.Columns {
+		known := false
+		for _, f := range importFields {
+			known = known || f == field
+		}
+		if !known {
+			return errors.New("Unknown report field " + field + ", fields are " + strings.Join(importFields, ","))
+		}
+	}
+	for _, status := range o.Statuses {
+		if !reportStatuses[status] {
+			return errors.New("Unknown status " + status)
+		}
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaultImportBatch
+	}
+	if o.BatchSize > maxImportBatch {
+		o.BatchSize = maxImportBatch
+	}
+	return nil
+}
+
+/*
+csvSource reads rows of a CSV file with a header line.
+*/
+type csvSource struct {
+	r       *csv.Reader
+	columns []string
+	fields  []string
+}
+
+func newCSVSource(in io.Reader, o *ImportOptions) (*csvSource, error) {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, errors.New("Reading CSV header: " + err.Error())
+	}
+	s := &csvSource{r: r, columns: header, fields: make([]string, len(header))}
+	found := map[string]bool{}
+	for i, c := range header {
+		c = strings.TrimSpace(strings.TrimPrefix(c, "\ufeff"))
+		s.fields[i] = o.fieldFor(c)
+		found[s.fields[i]] = true
+	}
+	for _, required := range []string{"description", "lat", "long"} {
+		if !found[required] {
+			return nil, errors.New("No column for " + required + ", map one in columns")
+		}
+	}
+	return s, nil
+}
+
+func (s *csvSource) header() []string { return s.columns }
+
+func (s *csvSource) next() (map[string]string, []string, error) {
+	record, err := s.r.Read()
+	if err != nil {
+		if _, ok := err.(*csv.ParseError); ok {
+			return nil, record, rowError("%v", err)
+		}
+		return nil, nil, err
+	}
+	values := map[string]string{}
+	for i, v := range record {
+		if i < len(s.fields) && s.fields[i] != "" {
+			values[s.fields[i]] = strings.TrimSpace(v)
+		}
+	}
+	return values, record, nil
+}
+
+/*
+geoJSONSource reads the features of a FeatureCollection one at a time. Point
+geometries give lat and long, properties the other fields.
+*/
+type geoJSONSource struct {
+	dec *json.Decoder
+	o   *ImportOptions
+}
+
+func newGeoJSONSource(in io.Reader, o *ImportOptions) (*geoJSONSource, error) {
+	dec, err := geoJSONFeatures(in)
+	if err != nil {
+		return nil, err
+	}
+	return &geoJSONSource{dec, o}, nil
+}
+
+/*
+geoJSONFeatures returns a decoder positioned within the features array of a
+FeatureCollection, so large files can be read one feature at a time while
+dec.More() is true.
+*/
+func geoJSONFeatures(in io.Reader) (*json.Decoder, error) {
+	dec := json.NewDecoder(in)
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, errors.New("GeoJSON must be a FeatureCollection")
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if t == "features" {
+			if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+				return nil, errors.New("features must be an array")
+			}
+			return dec, nil
+		}
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return nil, errors.New("GeoJSON has no features")
+}
+
+func (s *geoJSONSource) header() []string { return []string{"feature"} }
+
+func (s *geoJSONSource) next() (map[string]string, []string, error) {
+	if !s.dec.More() {
+		return nil, nil, io.EOF
+	}
+	var raw json.RawMessage
+	if err := s.dec.Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+	var feature struct {
+		Geometry *struct {
+			Type        string    `json:"type"`
+			Coordinates []float64 `json:"coordinates"`
+		} `json:"geometry"`
+		Properties map[string]interface{} `json:"properties"`
+	}
+	if err := json.Unmarshal(raw, &feature); err != nil {
+		return nil, []string{string(raw)}, rowError("%v", err)
+	}
+	values := map[string]string{}
+	for name, v := range feature.Properties {
+		field := s.o.fieldFor(name)
+		if field == "" || v == nil {
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			values[field] = strings.TrimSpace(v)
+		case float64:
+			values[field] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			values[field] = fmt.Sprint(v)
+		}
+	}
+	if g := feature.Geometry; g != nil {
+		if g.Type != "Point" || len(g.Coordinates) < 2 {
+			return nil, []string{string(raw)}, rowError("geometry must be a Point")
+		}
+		values["long"] = strconv.FormatFloat(g.Coordinates[0], 'f', -1, 64)
+		values["lat"] = strconv.FormatFloat(g.Coordinates[1], 'f', -1, 64)
+	}
+	return values, []string{string(raw)}, nil
+}
+
+/*
+importReport validates the values of a row and turns them into a report.
+*/
+func importReport(values map[string]string, o *ImportOptions, categories map[string]bool) (*Report, error) {
+	r := &Report{
+		ReporterID:    o.ReporterID,
+		Description:   values["description"],
+		LocationInfo:  values["locInfo"],
+		ImageLocation: values["image"],
+		Status:        StatusOpen,
+		Date:          time.Now(),
+	}
+	if r.Description == "" {
+		return nil, rowError("description is missing")
+	}
+	if len(r.Description) > 255 || len(r.LocationInfo) > 255 || len(r.ImageLocation) > 255 {
+		return nil, rowError("description, locInfo and image may have up to 255 characters")
+	}
+	lat, err1 := parseCoordinate(values["lat"])
+	lng, err2 := parseCoordinate(values["long"])
+	if err1 != nil || err2 != nil {
+		return nil, rowError("invalid coordinates %q, %q", values["lat"], values["long"])
+	}
+	r.Lat, r.Long = lat, lng
+	if err := r.validateLocation(); err != nil {
+		return nil, rowError("%v", err)
+	}
+	if c := values["category"]; c != "" {
+		if mapped, ok := o.Categories[c]; ok {
+			c = mapped
+		}
+		if !categories[c] {
+			return nil, rowError("unknown category %q", c)
+		}
+		r.Category = c
+	}
+	if s := values["status"]; s != "" {
+		if mapped, ok := o.Statuses[s]; ok {
+			s = mapped
+		}
+		s = strings.ToLower(s)
+		if !reportStatuses[s] {
+			return nil, rowError("unknown status %q", s)
+		}
+		r.Status = s
+	}
+	if d := values["created"]; d != "" {
+		parsed := false
+		for _, layout := range importDateLayouts {
+			if t, err := time.Parse(layout, d); err == nil {
+				r.Date, parsed = t, true
+				break
+			}
+		}
+		if !parsed {
+			return nil, rowError("invalid date %q", d)
+		}
+		if r.Date.After(time.Now()) {
+			return nil, rowError("date %q is in the future", d)
+		}
+	}
+	return r, nil
+}
+
+/*
+runImport reads reports from in and stores them in batches, one transaction per
+batch. Rejected rows are written to errs as CSV with the row number, the reason
+and the original row. Imported reports are historical: they don't notify anyone
+and don't show up in event streams. Missing location info is geocoded.
+When the file can't be read to the end, the rows of the unstored batch are
+rejected and the partial import is returned along with the error.
+*/
+func runImport(in io.Reader, o *ImportOptions, errs io.Writer) (*Import, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	var src importSource
+	var err error
+	if o.Format == "csv" {
+		src, err = newCSVSource(in, o)
+	} else {
+		src, err = newGeoJSONSource(in, o)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	known, err := getCategories()
+	if err != nil {
+		return nil, err
+	}
+	categories := map[string]bool{}
+	for _, c := range known {
+		categories[c.Code] = true
+	}
+
+	res := &Import{Format: o.Format, DryRun: o.DryRun, UserID: o.ReporterID, Date: time.Now()}
+	ew := csv.NewWriter(errs)
+	ew.Write(append([]string{"row", "error"}, src.header()...))
+	reject := func(row int, msg string, raw []string) {
+		res.Rejected++
+		ew.Write(append([]string{strconv.Itoa(row), msg}, raw...))
+	}
+
+	var batch []Report
+	var batchRaw [][]string
+	var batchRows []int
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if !o.DryRun {
+			if err := insertImportedReports(batch); err != nil {
+				for i := range batch {
+					reject(batchRows[i], "not stored: "+err.Error(), batchRaw[i])
+				}
+				batch, batchRaw, batchRows = batch[:0], batchRaw[:0], batchRows[:0]
+				return
+			}
+			for i := range batch {
+				assignReportAreas(&batch[i])
+			}
+		}
+		res.Imported += len(batch)
+		batch, batchRaw, batchRows = batch[:0], batchRaw[:0], batchRows[:0]
+	}
+
+	for row := 1; ; row++ {
+		values, raw, err := src.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*importRowError); !ok {
+				err = fmt.Errorf("row %d: %v", row, err)
+				for i := range batch {
+					reject(batchRows[i], "not stored: import aborted", batchRaw[i])
+				}
+				res.Aborted = err.Error()
+				ew.Flush()
+				return res, err
+			}
+			res.Total++
+			reject(row, err.Error(), raw)
+			continue
+		}
+		res.Total++
+		r, err := importReport(values, o, categories)
+		if err != nil {
+			reject(row, err.Error(), raw)
+			continue
+		}
+		fillLocationInfo(r)
+		batch = append(batch, *r)
+		batchRaw = append(batchRaw, raw)
+		batchRows = append(batchRows, row)
+		if len(batch) >= o.BatchSize {
+			flush()
+		}
+	}
+	flush()
+
+	ew.Flush()
+	return res, ew.Error()
+}
+
+/*
+importCommand implements "commcomm import", which imports a file from the
+command line and writes rejected rows to an error report file.
+*/
+func importCommand(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	configFile := fs.String("config", "conf.json", "Configuration file.")
+	format := fs.String("format", "", "Format of the file, csv or geojson. Guessed from the file name if empty.")
+	mapping := fs.String("mapping", "", "JSON file with import options: columns, categories and statuses.")
+	reporter := fs.Int("reporter", 0, "User the reports are filed as.")
+	dryRun := fs.Bool("dry-run", false, "Validate the file without storing anything.")
+	errorFile := fs.String("errors", "import-errors.csv", "Where to write the rejected rows.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: commcomm import [flags] file")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	name := fs.Arg(0)
+
+	var o ImportOptions
+	if *mapping != "" {
+		b, err := ioutil.ReadFile(*mapping)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := json.Unmarshal(b, &o); err != nil {
+			fmt.Fprintln(os.Stderr, "Reading mapping:", err)
+			os.Exit(1)
+		}
+	}
+	o.Format = *format
+	if o.Format == "" {
+		o.Format = "csv"
+		if strings.HasSuffix(name, ".geojson") || strings.HasSuffix(name, ".json") {
+			o.Format = "geojson"
+		}
+	}
+	o.ReporterID = *reporter
+	o.DryRun = *dryRun
+
+	conf = *getConfig(*configFile)
+	if err := InitDb(conf.DB.Username, conf.DB.Userpass, conf.DB.Address, conf.DB.Port); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer closeDb()
+	if err := initGeocoder(conf.Geocoder); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := initServiceArea(conf.ServiceArea); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	in, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer in.Close()
+	out, err := os.Create(*errorFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer out.Close()
+
+	res, err := runImport(in, &o, out)
+	if err != nil && res == nil {
+		fmt.Fprintln(os.Stderr, "Import failed:", err)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Import aborted:", err)
+	}
+	if o.DryRun {
+		fmt.Printf("Dry run: %d rows, %d would be imported, %d rejected\n", res.Total, res.Imported, res.Rejected)
+	} else {
+		fmt.Printf("%d rows, %d imported, %d rejected\n", res.Total, res.Imported, res.Rejected)
+	}
+	if res.Rejected > 0 {
+		fmt.Println("Rejected rows are listed in", *errorFile)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
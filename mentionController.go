@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const maxMentionsPerComment = 10
+
+/*
+mentionPattern matches "@jane" as well as "@jane@example.com". The handle must
+not be preceded by a word character so email addresses in the text are not
+taken for mentions. The content filter leaves the address of such a mention
+alone, see emailRule.
+*/
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([A-Za-z0-9._%+\-]+(?:@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)+)?)`)
+
+/*
+Mention records a user being mentioned in a comment.
+*/
+type Mention struct {
+	ID        int       `json:"id"`
+	CommentID int       `json:"commentId"`
+	ReportID  int       `json:"reportId"`
+	AuthorID  int       `json:"author"`
+	UserID    int       `json:"user"`
+	Message   string    `json:"Message"`
+	Date      time.Time `json:"created"`
+	Read      bool      `json:"read"`
+}
+
+/*
+parseMentions returns the distinct handles mentioned in text, in order of
+appearance. Trailing punctuation is not part of a handle.
+*/
+func parseMentions(text string) []string {
+	seen := map[string]bool{}
+	var handles []string
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		h := strings.ToLower(strings.TrimRight(m[1], ".-"))
+		if h == "" || seen[h] {
+			continue
+		}
+		seen[h] = true
+		handles = append(handles, h)
+		if len(handles) == maxMentionsPerComment {
+			break
+		}
+	}
+	return handles
+}
+
+/*
+resolveMention finds the user a handle refers to. A handle is either a full
+email address or the part before the @ of exactly one user's address.
+*/
+func resolveMention(handle string) (*User, error) {
+	if strings.Contains(handle, "@") {
+		return GetUserByEmail(handle)
+	}
+	return getUserByHandle(handle)
+}
+
+/*
+processMentions stores the mentions in a comment when it is published and
+notifies the mentioned users. Users who could not see the comment, such as
+residents mentioned in an internal note, are skipped, as is the author. Users
+already notified of the comment are not notified again.
+*/
+func processMentions(c *Comment) {
+	for _, handle := range parseMentions(c.Message) {
+		u, err := resolveMention(handle)
+		if err != nil || u.Active != activeVisible || u.ID == c.AuthorID || !canViewComment(u, c) {
+			continue
+		}
+		if added, err := insertMention(c, u.ID); err != nil || !added {
+			continue
+		}
+		notify(Notification{
+			UserID:    u.ID,
+			Type:      NotifyMention,
+			ReportID:  c.ReportID,
+			CommentID: c.ID,
+			Title:     "You were mentioned on report " + strconv.Itoa(c.ReportID),
+			Body:      c.Message,
+		})
+	}
+}
+
+/*
+UserMentions lists the comments a user was mentioned in, newest first. With
+unread=true only mentions not yet marked as read are returned. limit and offset
+page through the list.
+*/
+func UserMentions(w http.ResponseWriter, r *http.Request) {
+	id, ok := selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	limit, offset, err := pageParams(r, 50, 200)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := GetUserByID(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	mentions, err := getUserMentions(id, user.isStaff(), r.URL.Query().Get("unread") == "true", limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if mentions == nil {
+		mentions = []Mention{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(mentions); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+MentionRead marks a mention as read.
+*/
+func MentionRead(w http.ResponseWriter, r *http.Request) {
+	id, ok := selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	mentionID, err := strconv.ParseInt(mux.Vars(r)["mentionId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := markMentionRead(id, mentionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		http.Error(w, fmt.Sprintf("Mention %d not found", mentionID), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+Kinds of content which can be flagged and moderated.
+*/
+const (
+	TargetReport  = "report"
+	TargetComment = "comment"
+)
+
+/*
+Reasons a user can give when flagging content.
+*/
+var flagReasons = map[string]bool{
+	"spam":      true,
+	"abusive":   true,
+	"offensive": true,
+	"personal":  true,
+	"off-topic": true,
+	"other":     true,
+}
+
+/*
+Moderator actions on flagged content. Hide takes content out of public view,
+restore puts it back, dismiss closes the flags leaving the content as it is and
+ban additionally deactivates the account of the author. Unban reactivates the
+author of the content, leaving the content as it is. Staff can't be banned.
+*/
+const (
+	ActionHide     = "hide"
+	ActionRestore  = "restore"
+	ActionDismiss  = "dismiss"
+	ActionBan      = "ban"
+	ActionAutoHide = "auto-hide"
+	ActionUnban    = "unban"
+)
+
+/*
+Status of a flag. Flags stay open until a moderator acts on the flagged content.
+*/
+const (
+	FlagOpen     = "open"
+	FlagResolved = "resolved"
+)
+
+/*
+Values of the active column. Hidden content and banned users can be restored by
+moderators, deactivated ones were removed by their owner.
+*/
+const (
+	activeVisible     = 1
+	activeHidden      = 0
+	activeDeactivated = -1
+)
+
+const defaultFlagThreshold = 3
+
+var errAlreadyFlagged = errors.New("Content already flagged by this user")
+
+/*
+Flag is a complaint by a user about a report or comment.
+*/
+type Flag struct {
+	ID         int       `json:"id"`
+	TargetType string    `json:"type"`
+	TargetID   int       `json:"targetId"`
+	FlaggerID  int       `json:"flagger"`
+	Reason     string    `json:"reason"`
+	Note       string    `json:"note"`
+	Date       time.Time `json:"created"`
+	Status     string    `json:"status"`
+}
+
+/*
+ModerationAction records a decision made on reported content, either by a
+moderator or automatically, in which case ModeratorID is 0.
+*/
+type ModerationAction struct {
+	ID          int       `json:"id"`
+	ModeratorID int       `json:"moderator"`
+	TargetType  string    `json:"type"`
+	TargetID    int       `json:"targetId"`
+	Action      string    `json:"action"`
+	Note        string    `json:"note"`
+	Date        time.Time `json:"created"`
+}
+
+/*
+QueueItem is an entry of the moderation queue, summarizing the open flags on
+one report or comment.
+*/
+type QueueItem struct {
+	TargetType string         `json:"type"`
+	TargetID   int            `json:"targetId"`
+	ReportID   int            `json:"reportId"`
+	AuthorID   int            `json:"author"`
+	Content    string         `json:"content"`
+	Hidden     bool           `json:"hidden"`
+	FlagCount  int            `json:"flagCount"`
+	Reasons    map[string]int `json:"reasons"`
+	FirstFlag  time.Time      `json:"firstFlagged"`
+}
+
+func flagThreshold() int {
+	if conf.FlagThreshold > 0 {
+		return conf.FlagThreshold
+	}
+	return defaultFlagThreshold
+}
+
+/*
+moderationTarget loads the author, report, text and active state of a report or
+comment.
+*/
+func moderationTarget(targetType string, id int64) (item QueueItem, active int, err error) {
+	item.TargetType = targetType
+	item.TargetID = int(id)
+	switch targetType {
+	case TargetReport:
+		r, err := getReportByID(id)
+		if err != nil {
+			return item, 0, err
+		}
+		item.ReportID = r.ID
+		item.AuthorID = r.ReporterID
+		item.Content = r.Description
+		active = r.Active
+	case TargetComment:
+		c, err := getCommentByID(id)
+		if err != nil {
+			return item, 0, err
+		}
+		item.ReportID = c.ReportID
+		item.AuthorID = c.AuthorID
+		item.Content = c.Message
+		active = c.Active
+	default:
+		return item, 0, errors.New("Unknown content type")
+	}
+	item.Hidden = active == activeHidden
+	return item, active, nil
+}
+
+func setTargetActive(targetType string, id int64, active int) error {
+	if targetType == TargetReport {
+		return setReportActive(id, active)
+	}
+	return setCommentActive(id, active)
+}
+
+/*
+flagContent records a flag and hides the content once it has collected enough
+open flags.
+*/
+func flagContent(w http.ResponseWriter, r *http.Request, targetType string, id int64) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var f Flag
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(body, &f); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if !flagReasons[f.Reason] {
+		http.Error(w, "Invalid reason", http.StatusUnprocessableEntity)
+		return
+	}
+	f.TargetType = targetType
+	f.TargetID = int(id)
+	f.FlaggerID = u.ID
+
+	created, err := insertFlag(&f)
+	if err == errAlreadyFlagged {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	n, err := countOpenFlags(targetType, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n >= flagThreshold() {
+		if target, active, err := moderationTarget(targetType, id); err == nil && active == activeVisible {
+			if err := setTargetActive(targetType, id, activeHidden); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			insertModerationAction(&ModerationAction{TargetType: targetType, TargetID: int(id), Action: ActionAutoHide, Note: strconv.Itoa(n) + " flags"})
+			refreshTrustLater(int64(target.AuthorID))
+			if targetType == TargetReport {
+				publishReportUpdate(id)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+FlagReport is the handler function for a user flagging a report.
+*/
+func FlagReport(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	id, err := strconv.ParseInt(v["reportId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := getSpecificReport(id); err != nil {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	flagContent(w, r, TargetReport, id)
+}
+
+/*
+FlagComment is the handler function for a user flagging a comment.
+*/
+func FlagComment(w http.ResponseWriter, r *http.Request) {
+	c, status, err := commentFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if u, _ := requestUser(r); !canViewComment(u, c) {
+		http.Error(w, errCommentNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	flagContent(w, r, TargetComment, int64(c.ID))
+}
+
+/*
+ModerationQueue lists the reports and comments with open flags, most flagged
+first. Moderators only.
+*/
+func ModerationQueue(w http.ResponseWriter, r *http.Request) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !u.isModerator() {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+
+	items, err := getModerationQueue()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	queue := []QueueItem{}
+	for _, item := range items {
+		target, active, err := moderationTarget(item.TargetType, int64(item.TargetID))
+		if err != nil || active == activeDeactivated {
+			continue
+		}
+		target.FlagCount = item.FlagCount
+		target.Reasons = item.Reasons
+		target.FirstFlag = item.FirstFlag
+		queue = append(queue, target)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(queue); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+ModerateContent is the handler function for a moderator acting on a report or
+comment. The body names the action (hide, restore, dismiss, ban or unban) and
+may carry a note, both of which end up in the moderation log. Ban and unban
+need content with an author. Users mentioned in a held comment are notified
+when it is restored.
+*/
+func ModerateContent(w http.ResponseWriter, r *http.Request) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !u.isModerator() {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+
+	v := mux.Vars(r)
+	targetType := v["targetType"]
+	id, err := strconv.ParseInt(v["targetId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	target, active, err := moderationTarget(targetType, id)
+	if err != nil || active == activeDeactivated {
+		http.Error(w, "Content not found", http.StatusNotFound)
+		return
+	}
+
+	var a ModerationAction
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(body, &a); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	var author *User
+	if a.Action == ActionBan || a.Action == ActionUnban {
+		if target.AuthorID != 0 {
+			author, _ = GetUserByID(int64(target.AuthorID))
+		}
+		if author == nil {
+			http.Error(w, "Anonymous content has no author to "+a.Action, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	switch a.Action {
+	case ActionHide:
+		err = setTargetActive(targetType, id, activeHidden)
+	case ActionRestore:
+		err = setTargetActive(targetType, id, activeVisible)
+	case ActionDismiss:
+	case ActionBan:
+		if author.isStaff() {
+			http.Error(w, "Staff can't be banned", http.StatusForbidden)
+			return
+		}
+		if err = setTargetActive(targetType, id, activeHidden); err == nil {
+			err = setUserActive(int64(author.ID), activeHidden)
+		}
+	case ActionUnban:
+		if author.Active != activeHidden {
+			http.Error(w, "Author is not banned", http.StatusConflict)
+			return
+		}
+		err = setUserActive(int64(author.ID), activeVisible)
+	default:
+		http.Error(w, "Invalid action", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if a.Action == ActionRestore && targetType == TargetComment && active == activeHidden {
+		if c, err := getCommentByID(id); err == nil {
+			processMentions(c)
+		}
+	}
+	if a.Action != ActionUnban {
+		if err := resolveFlags(targetType, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if targetType == TargetReport && a.Action != ActionDismiss && a.Action != ActionUnban {
+		publishReportUpdate(id)
+	}
+
+	a.ModeratorID = u.ID
+	a.TargetType = targetType
+	a.TargetID = int(id)
+	created, err := insertModerationAction(&a)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	refreshTrustLater(int64(target.AuthorID))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+ModerationLog lists moderator decisions, newest first. The optional limit and
+offset query parameters page through the log. Moderators only.
+*/
+func ModerationLog(w http.ResponseWriter, r *http.Request) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !u.isModerator() {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+
+	limit, offset, err := pageParams(r, 50, 500)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	actions, err := getModerationLog(limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if actions == nil {
+		actions = []ModerationAction{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(actions); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
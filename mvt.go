@@ -0,0 +1,168 @@
+package main
+
+import "math"
+
+/*
+Constants of the Mapbox Vector Tile encoding, version 2.1. Only point features
+are written, which is all the report layers need.
+*/
+const (
+	mvtExtent = 4096
+
+	mvtWireVarint = 0
+	mvtWireBytes  = 2
+
+	mvtMoveTo = 1
+	mvtPoint  = 1
+)
+
+/*
+mvtFeature is a point of a vector tile layer. X and Y are in tile units from
+the north-west corner. Properties hold strings, integers and floats.
+*/
+type mvtFeature struct {
+	ID         uint64
+	X, Y       int
+	Properties map[string]interface{}
+}
+
+/*
+mvtLayer collects the features of a layer along with the keys and values their
+properties refer to by index.
+*/
+type mvtLayer struct {
+	name     string
+	features []byte
+	keys     []string
+	keyIndex map[string]int
+	values   [][]byte
+	valIndex map[interface{}]int
+}
+
+func newMVTLayer(name string) *mvtLayer {
+	return &mvtLayer{name: name, keyIndex: map[string]int{}, valIndex: map[interface{}]int{}}
+}
+
+func (l *mvtLayer) key(k string) int {
+	i, ok := l.keyIndex[k]
+	if !ok {
+		i = len(l.keys)
+		l.keys = append(l.keys, k)
+		l.keyIndex[k] = i
+	}
+	return i
+}
+
+/*
+value returns the index of a property value, or -1 for values of other types
+than strings, integers and floats.
+*/
+func (l *mvtLayer) value(v interface{}) int {
+	var enc []byte
+	switch t := v.(type) {
+	case string:
+		enc = pbBytes(nil, 1, []byte(t))
+	case int:
+		enc = pbVarint(nil, 6, zigzag(int64(t)))
+	case int64:
+		enc = pbVarint(nil, 6, zigzag(t))
+	case float64:
+		enc = pbFixed64(nil, 3, t)
+	default:
+		return -1
+	}
+	i, ok := l.valIndex[v]
+	if !ok {
+		i = len(l.values)
+		l.values = append(l.values, enc)
+		l.valIndex[v] = i
+	}
+	return i
+}
+
+/*
+add appends a point feature to the layer. Its properties are written in the
+order of names so equal tiles encode to equal bytes.
+*/
+func (l *mvtLayer) add(f mvtFeature, names []string) {
+	var tags []uint64
+	for _, name := range names {
+		v, ok := f.Properties[name]
+		if !ok {
+			continue
+		}
+		if vi := l.value(v); vi >= 0 {
+			tags = append(tags, uint64(l.key(name)), uint64(vi))
+		}
+	}
+	geometry := []uint64{mvtMoveTo&0x7 | 1<<3, zigzag(int64(f.X)), zigzag(int64(f.Y))}
+
+	var b []byte
+	b = pbVarint(b, 1, f.ID)
+	b = pbPacked(b, 2, tags)
+	b = pbVarint(b, 3, mvtPoint)
+	b = pbPacked(b, 4, geometry)
+	l.features = pbBytes(l.features, 2, b)
+}
+
+/*
+encode returns the layer as a Tile message holding just this layer. Tiles with
+several layers are the concatenation of their encoded layers.
+*/
+func (l *mvtLayer) encode() []byte {
+	if len(l.features) == 0 {
+		return nil
+	}
+	var b []byte
+	b = pbVarint(b, 15, 2)
+	b = pbBytes(b, 1, []byte(l.name))
+	b = append(b, l.features...)
+	for _, k := range l.keys {
+		b = pbBytes(b, 3, []byte(k))
+	}
+	for _, v := range l.values {
+		b = pbBytes(b, 4, v)
+	}
+	b = pbVarint(b, 5, mvtExtent)
+	return pbBytes(nil, 3, b)
+}
+
+func zigzag(n int64) uint64 {
+	return uint64(n<<1) ^ uint64(n>>63)
+}
+
+func pbUvarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func pbVarint(b []byte, field int, v uint64) []byte {
+	b = pbUvarint(b, uint64(field)<<3|mvtWireVarint)
+	return pbUvarint(b, v)
+}
+
+func pbBytes(b []byte, field int, v []byte) []byte {
+	b = pbUvarint(b, uint64(field)<<3|mvtWireBytes)
+	b = pbUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func pbPacked(b []byte, field int, vs []uint64) []byte {
+	var p []byte
+	for _, v := range vs {
+		p = pbUvarint(p, v)
+	}
+	return pbBytes(b, field, p)
+}
+
+func pbFixed64(b []byte, field int, v float64) []byte {
+	b = pbUvarint(b, uint64(field)<<3|1)
+	u := math.Float64bits(v)
+	for i := 0; i < 8; i++ {
+		b = append(b, byte(u>>(8*uint(i))))
+	}
+	return b
+}
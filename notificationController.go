@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultNotificationRetentionDays = 90
+	notificationCleanupPeriod        = 24 * time.Hour
+)
+
+var notificationChannels = map[string]bool{
+	ChannelEmail: true,
+	ChannelPush:  true,
+	ChannelInApp: true,
+}
+
+var notificationTypes = map[string]bool{
+	"*":              true,
+	NotifyMention:    true,
+	NotifyStatus:     true,
+	NotifyComment:    true,
+	NotifyArea:       true,
+	NotifyDigest:     true,
+	NotifyEscalation: true,
+}
+
+/*
+GetNotificationPreferences returns the notification preferences a user has set.
+Anything not listed is enabled.
+*/
+func GetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	id, ok := selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	prefs, err := getNotificationPreferences(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if prefs == nil {
+		prefs = []NotificationPreference{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(prefs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+SetNotificationPreferences stores a list of notification preferences for a user,
+replacing earlier preferences for the same channel and type.
+*/
+func SetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	id, ok := selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	var prefs []NotificationPreference
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(body, &prefs); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	for _, p := range prefs {
+		if !notificationChannels[p.Channel] || !notificationTypes[p.Type] {
+			http.Error(w, "Invalid channel or type", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	for _, p := range prefs {
+		if err := setNotificationPreference(id, p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	GetNotificationPreferences(w, r)
+}
+
+/*
+NotificationIndex returns the in-app notifications of the requesting user, newest
+first, together with the number of unread notifications. With unread=true only
+unread notifications are listed and limit and offset page through the list.
+*/
+func NotificationIndex(w http.ResponseWriter, r *http.Request) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	limit, offset, err := pageParams(r, 50, 200)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+
+	notifications, err := getUserNotifications(u.ID, unreadOnly, limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	unread, err := countUnreadNotifications(u.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if notifications == nil {
+		notifications = []Notification{}
+	}
+	resp := struct {
+		Unread        int            `json:"unread"`
+		Limit         int            `json:"limit"`
+		Offset        int            `json:"offset"`
+		Notifications []Notification `json:"notifications"`
+	}{unread, limit, offset, notifications}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+NotificationRead marks one notification of the requesting user as read.
+*/
+func NotificationRead(w http.ResponseWriter, r *http.Request) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["notificationId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := markNotificationsRead(u.ID, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+NotificationReadAll marks all notifications of the requesting user as read.
+*/
+func NotificationReadAll(w http.ResponseWriter, r *http.Request) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if _, err := markNotificationsRead(u.ID, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+cleanupNotifications deletes in-app notifications older than the configured
+retention once a day. It is meant to be run in its own goroutine.
+*/
+func cleanupNotifications() {
+	days := conf.NotificationRetentionDays
+	if days <= 0 {
+		days = defaultNotificationRetentionDays
+	}
+	for {
+		n, err := deleteNotificationsBefore(time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			log.Println("cleaning up notifications:", err)
+		} else if n > 0 {
+			log.Printf("removed %d notifications older than %d days", n, days)
+		}
+		time.Sleep(notificationCleanupPeriod)
+	}
+}
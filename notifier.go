@@ -0,0 +1,204 @@
+package main
+
+import (
+	"log"
+	"mime"
+	"net/smtp"
+	"time"
+)
+
+/*
+Types of notifications sent to users.
+*/
+const (
+	NotifyMention    = "mention"
+	NotifyStatus     = "status"
+	NotifyComment    = "comment"
+	NotifyArea       = "area"
+	NotifyDigest     = "digest"
+	NotifyEscalation = "escalation"
+)
+
+/*
+Channels notifications can be delivered over. Users can turn each channel off
+per notification type.
+*/
+const (
+	ChannelEmail = "email"
+	ChannelPush  = "push"
+	ChannelInApp = "inapp"
+)
+
+/*
+NotificationPreference turns a channel on or off for one notification type, or
+for all types when Type is "*".
+*/
+type NotificationPreference struct {
+	Channel string `json:"channel"`
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+}
+
+/*
+Notification is a message for a single user about something that happened on a
+report. CommentID is 0 for notifications which are not about a comment.
+*/
+type Notification struct {
+	ID        int       `json:"id,omitempty"`
+	UserID    int       `json:"user"`
+	Type      string    `json:"type"`
+	ReportID  int       `json:"reportId"`
+	CommentID int       `json:"commentId,omitempty"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Date      time.Time `json:"created"`
+	Read      bool      `json:"read"`
+}
+
+/*
+Notifier delivers notifications over one channel, such as email or push.
+*/
+type Notifier interface {
+	Name() string
+	Notify(n Notification) error
+}
+
+/*
+logNotifier writes notifications to the server log. It is registered when no
+other channel is configured so notifications are never dropped silently.
+*/
+type logNotifier struct{}
+
+func (logNotifier) Name() string { return "log" }
+
+func (logNotifier) Notify(n Notification) error {
+	log.Printf("notification for user %d: %s: %s", n.UserID, n.Title, n.Body)
+	return nil
+}
+
+var notifiers []Notifier
+
+/*
+registerNotifier adds a delivery channel for notifications.
+*/
+func registerNotifier(n Notifier) {
+	notifiers = append(notifiers, n)
+}
+
+/*
+notificationEnabled reports whether the preferences allow notifications of type
+t over channel. A preference for the type wins over one for all types and
+everything not mentioned is enabled.
+*/
+func notificationEnabled(prefs []NotificationPreference, channel, t string) bool {
+	enabled := true
+	for _, p := range prefs {
+		if p.Channel != channel {
+			continue
+		}
+		if p.Type == t {
+			return p.Enabled
+		}
+		if p.Type == "*" {
+			enabled = p.Enabled
+		}
+	}
+	return enabled
+}
+
+/*
+notify delivers a notification over every registered channel the user has not
+turned off. Delivery happens in the background so requests don't wait on slow
+channels; failures are logged.
+*/
+func notify(n Notification) {
+	if n.Date.IsZero() {
+		n.Date = time.Now()
+	}
+	channels := notifiers
+	if len(channels) == 0 {
+		channels = []Notifier{logNotifier{}}
+	}
+	go func() {
+		prefs, err := getNotificationPreferences(int64(n.UserID))
+		if err != nil {
+			log.Printf("loading notification preferences of user %d: %v", n.UserID, err)
+		}
+		for _, c := range channels {
+			if !notificationEnabled(prefs, c.Name(), n.Type) {
+				continue
+			}
+			if err := c.Notify(n); err != nil {
+				log.Printf("delivering notification over %s: %v", c.Name(), err)
+			}
+		}
+	}()
+}
+
+/*
+inAppNotifier stores notifications in the database for the notification inbox
+of the apps.
+*/
+type inAppNotifier struct{}
+
+func (inAppNotifier) Name() string { return ChannelInApp }
+
+func (inAppNotifier) Notify(n Notification) error {
+	return insertNotification(&n)
+}
+
+/*
+SMTPConfig holds the mail server used to send email notifications.
+*/
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+/*
+emailNotifier sends notifications to the email address of the user.
+*/
+type emailNotifier struct {
+	c SMTPConfig
+}
+
+func (e *emailNotifier) Name() string { return ChannelEmail }
+
+func (e *emailNotifier) Notify(n Notification) error {
+	u, err := GetUserByID(int64(n.UserID))
+	if err != nil {
+		return err
+	}
+	return sendEmail(e.c, u.Email, n.Title, n.Body)
+}
+
+/*
+sendEmail sends a plain text email over the mail server in c.
+*/
+func sendEmail(c SMTPConfig, to, subject, body string) error {
+	var auth smtp.Auth
+	if c.Username != "" {
+		auth = smtp.PlainAuth("", c.Username, c.Password, c.Host)
+	}
+	msg := "From: " + c.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body + "\r\n"
+	return smtp.SendMail(c.Host+":"+c.Port, auth, c.From, []string{to}, []byte(msg))
+}
+
+/*
+initNotifiers registers the notification channels which are configured, including
+the push providers.
+*/
+func initNotifiers(c Config) error {
+	registerNotifier(inAppNotifier{})
+	if c.SMTP.Host != "" {
+		registerNotifier(&emailNotifier{c.SMTP})
+	}
+	return initPush(c.Push)
+}
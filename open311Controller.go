@@ -0,0 +1,524 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+Open311 GeoReport v2 (http://wiki.open311.org/GeoReport_v2) maps services onto
+categories and service requests onto reports. Open311 only knows the statuses
+open and closed.
+*/
+const (
+	open311Open   = "open"
+	open311Closed = "closed"
+
+	open311MaxRequests   = 1000
+	open311DefaultWindow = 90 * 24 * time.Hour
+	open311HeldNotice    = "Your request will be published after review."
+)
+
+/*
+Open311Config configures the Open311 API. Jurisdiction, if set, must match the
+jurisdiction_id clients send. Submissions need one of the APIKeys.
+*/
+type Open311Config struct {
+	Jurisdiction string       `json:"jurisdiction"`
+	APIKeys      []Open311Key `json:"apiKeys"`
+}
+
+/*
+Open311Key is an API key of an Open311 client. Reports submitted with it are
+filed as the user UserID.
+*/
+type Open311Key struct {
+	Key    string `json:"key"`
+	Name   string `json:"name"`
+	UserID int    `json:"userId"`
+}
+
+type open311Service struct {
+	XMLName     xml.Name `json:"-" xml:"service"`
+	ServiceCode string   `json:"service_code" xml:"service_code"`
+	ServiceName string   `json:"service_name" xml:"service_name"`
+	Description string   `json:"description" xml:"description"`
+	Metadata    bool     `json:"metadata" xml:"metadata"`
+	Type        string   `json:"type" xml:"type"`
+	Keywords    string   `json:"keywords" xml:"keywords"`
+	Group       string   `json:"group" xml:"group"`
+}
+
+type open311ServiceDefinition struct {
+	XMLName     xml.Name   `json:"-" xml:"service_definition"`
+	ServiceCode string     `json:"service_code" xml:"service_code"`
+	Attributes  []struct{} `json:"attributes" xml:"attributes"`
+}
+
+type open311Request struct {
+	XMLName           xml.Name `json:"-" xml:"request"`
+	ServiceRequestID  string   `json:"service_request_id" xml:"service_request_id"`
+	Status            string   `json:"status" xml:"status"`
+	StatusNotes       string   `json:"status_notes" xml:"status_notes"`
+	ServiceName       string   `json:"service_name" xml:"service_name"`
+	ServiceCode       string   `json:"service_code" xml:"service_code"`
+	Description       string   `json:"description" xml:"description"`
+	AgencyResponsible string   `json:"agency_responsible" xml:"agency_responsible"`
+	ServiceNotice     string   `json:"service_notice" xml:"service_notice"`
+	RequestedDatetime string   `json:"requested_datetime" xml:"requested_datetime"`
+	UpdatedDatetime   string   `json:"updated_datetime" xml:"updated_datetime"`
+	ExpectedDatetime  string   `json:"expected_datetime" xml:"expected_datetime"`
+	Address           string   `json:"address" xml:"address"`
+	AddressID         string   `json:"address_id" xml:"address_id"`
+	Zipcode           string   `json:"zipcode" xml:"zipcode"`
+	Lat               string   `json:"lat" xml:"lat"`
+	Long              string   `json:"long" xml:"long"`
+	MediaURL          string   `json:"media_url" xml:"media_url"`
+}
+
+type open311Submission struct {
+	XMLName          xml.Name `json:"-" xml:"request"`
+	ServiceRequestID string   `json:"service_request_id,omitempty" xml:"service_request_id,omitempty"`
+	Token            string   `json:"token,omitempty" xml:"token,omitempty"`
+	ServiceNotice    string   `json:"service_notice" xml:"service_notice"`
+	AccountID        string   `json:"account_id" xml:"account_id"`
+}
+
+type open311Token struct {
+	XMLName          xml.Name `json:"-" xml:"request"`
+	ServiceRequestID string   `json:"service_request_id" xml:"service_request_id"`
+	Token            string   `json:"token" xml:"token"`
+}
+
+type open311Error struct {
+	XMLName     xml.Name `json:"-" xml:"error"`
+	Code        int      `json:"code" xml:"code"`
+	Description string   `json:"description" xml:"description"`
+}
+
+/*
+open311Row is a report with what an Open311 request shows besides the report:
+the category name and department and the latest status change.
+*/
+type open311Row struct {
+	Report      Report
+	ServiceName sql.NullString
+	Department  sql.NullString
+	StatusNote  sql.NullString
+	Updated     *time.Time
+}
+
+/*
+open311Query selects the requests listed by GET requests. IDs, if given, take
+precedence over the other fields.
+*/
+type open311Query struct {
+	IDs      []int64
+	Codes    []string
+	Statuses []string
+	Start    time.Time
+	End      time.Time
+}
+
+/*
+open311Status maps a report status onto the Open311 statuses.
+*/
+func open311Status(status string) string {
+	switch status {
+	case StatusResolved, StatusClosed, StatusRejected:
+		return open311Closed
+	}
+	return open311Open
+}
+
+/*
+open311Statuses returns the report statuses counted as the Open311 status s.
+*/
+func open311Statuses(s string) []string {
+	var statuses []string
+	for status := range reportStatuses {
+		if open311Status(status) == s {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+func (row *open311Row) request() open311Request {
+	r := row.Report
+	req := open311Request{
+		ServiceRequestID:  strconv.Itoa(r.ID),
+		Status:            open311Status(r.Status),
+		StatusNotes:       row.StatusNote.String,
+		ServiceName:       row.ServiceName.String,
+		ServiceCode:       r.Category,
+		Description:       r.Description,
+		AgencyResponsible: row.Department.String,
+		RequestedDatetime: r.Date.Format(time.RFC3339),
+		UpdatedDatetime:   r.Date.Format(time.RFC3339),
+		Address:           r.LocationInfo,
+		Lat:               r.Lat.String(),
+		Long:              r.Long.String(),
+		MediaURL:          r.ImageLocation,
+	}
+	if row.Updated != nil {
+		req.UpdatedDatetime = row.Updated.Format(time.RFC3339)
+	}
+	return req
+}
+
+/*
+open311Write answers in the format of the route, JSON or XML. For XML the
+elements of v are wrapped in root, as GeoReport wants.
+*/
+func open311Write(w http.ResponseWriter, r *http.Request, status int, root string, v interface{}) {
+	if mux.Vars(r)["format"] == "xml" {
+		b, err := xml.Marshal(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml; charset=UTF-8")
+		w.WriteHeader(status)
+		w.Write([]byte(xml.Header + "<" + root + ">"))
+		w.Write(b)
+		w.Write([]byte("</" + root + ">"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func open311Fail(w http.ResponseWriter, r *http.Request, status int, description string) {
+	open311Write(w, r, status, "errors", []open311Error{{Code: status, Description: description}})
+}
+
+/*
+open311Jurisdiction checks the jurisdiction_id of a request, which is optional
+for clients.
+*/
+func open311Jurisdiction(w http.ResponseWriter, r *http.Request) bool {
+	j := r.FormValue("jurisdiction_id")
+	if j != "" && conf.Open311.Jurisdiction != "" && j != conf.Open311.Jurisdiction {
+		open311Fail(w, r, http.StatusNotFound, "Unknown jurisdiction_id")
+		return false
+	}
+	return true
+}
+
+/*
+open311Key finds the configured key matching the api_key of a request.
+*/
+func open311Key(r *http.Request) *Open311Key {
+	key := r.FormValue("api_key")
+	if key == "" {
+		return nil
+	}
+	for i, k := range conf.Open311.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+			return &conf.Open311.APIKeys[i]
+		}
+	}
+	return nil
+}
+
+/*
+Open311Services lists the categories as Open311 services, grouped by department.
+*/
+func Open311Services(w http.ResponseWriter, r *http.Request) {
+	if !open311Jurisdiction(w, r) {
+		return
+	}
+	categories, err := getCategories()
+	if err != nil {
+		open311Fail(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	services := []open311Service{}
+	for _, c := range categories {
+		services = append(services, open311Service{
+			ServiceCode: c.Code,
+			ServiceName: c.Name,
+			Description: c.Name,
+			Type:        "realtime",
+			Group:       c.Department,
+		})
+	}
+	open311Write(w, r, http.StatusOK, "services", services)
+}
+
+/*
+Open311ServiceDefinition describes a service. Categories have no extra
+attributes, so the definition only confirms the service exists.
+*/
+func Open311ServiceDefinition(w http.ResponseWriter, r *http.Request) {
+	if !open311Jurisdiction(w, r) {
+		return
+	}
+	c, err := getCategory(mux.Vars(r)["serviceCode"])
+	if err == sql.ErrNoRows {
+		open311Fail(w, r, http.StatusNotFound, "Unknown service_code")
+		return
+	}
+	if err != nil {
+		open311Fail(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	def := open311ServiceDefinition{ServiceCode: c.Code, Attributes: []struct{}{}}
+	if mux.Vars(r)["format"] == "xml" {
+		b, err := xml.Marshal(def)
+		if err != nil {
+			open311Fail(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml; charset=UTF-8")
+		w.Write([]byte(xml.Header))
+		w.Write(b)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(def); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+Open311Requests lists service requests. Without service_request_id the list is
+limited to the start_date and end_date window, by default the last 90 days, and
+to 1000 requests.
+*/
+func Open311Requests(w http.ResponseWriter, r *http.Request) {
+	if !open311Jurisdiction(w, r) {
+		return
+	}
+	var q open311Query
+	if ids := r.FormValue("service_request_id"); ids != "" {
+		for _, s := range strings.Split(ids, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				open311Fail(w, r, http.StatusBadRequest, "Invalid service_request_id")
+				return
+			}
+			q.IDs = append(q.IDs, id)
+		}
+	} else {
+		if codes := r.FormValue("service_code"); codes != "" {
+			q.Codes = strings.Split(codes, ",")
+		}
+		if statuses := r.FormValue("status"); statuses != "" {
+			for _, s := range strings.Split(statuses, ",") {
+				if s != open311Open && s != open311Closed {
+					open311Fail(w, r, http.StatusBadRequest, "status must be open or closed")
+					return
+				}
+				q.Statuses = append(q.Statuses, open311Statuses(s)...)
+			}
+		}
+		q.End = time.Now()
+		if s := r.FormValue("end_date"); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				open311Fail(w, r, http.StatusBadRequest, "end_date must be a W3C datetime")
+				return
+			}
+			q.End = t
+		}
+		q.Start = q.End.Add(-open311DefaultWindow)
+		if s := r.FormValue("start_date"); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				open311Fail(w, r, http.StatusBadRequest, "start_date must be a W3C datetime")
+				return
+			}
+			q.Start = t
+		}
+	}
+
+	rows, err := getOpen311Requests(&q, open311MaxRequests)
+	if err != nil {
+		open311Fail(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	requests := []open311Request{}
+	for i := range rows {
+		requests = append(requests, rows[i].request())
+	}
+	open311Write(w, r, http.StatusOK, "service_requests", requests)
+}
+
+/*
+Open311Request returns a single service request.
+*/
+func Open311Request(w http.ResponseWriter, r *http.Request) {
+	if !open311Jurisdiction(w, r) {
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["requestId"], 10, 64)
+	if err != nil {
+		open311Fail(w, r, http.StatusBadRequest, "Invalid service_request_id")
+		return
+	}
+	rows, err := getOpen311Requests(&open311Query{IDs: []int64{id}}, 1)
+	if err != nil {
+		open311Fail(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(rows) == 0 {
+		open311Fail(w, r, http.StatusNotFound, "Service request not found")
+		return
+	}
+	open311Write(w, r, http.StatusOK, "service_requests", []open311Request{rows[0].request()})
+}
+
+/*
+validMediaURL accepts the absolute http and https URLs a media_url may link to,
+so clients showing the image can't be handed a javascript: or data: URL.
+*/
+func validMediaURL(s string) bool {
+	if len(s) > 255 {
+		return false
+	}
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+/*
+Open311RequestCreate files a service request as a report. It needs an api_key.
+Requests held by the content filter get a token instead of an id, which turns
+into the id once a moderator publishes the report.
+*/
+func Open311RequestCreate(w http.ResponseWriter, r *http.Request) {
+	if !open311Jurisdiction(w, r) {
+		return
+	}
+	key := open311Key(r)
+	if key == nil {
+		open311Fail(w, r, http.StatusForbidden, "A valid api_key is required")
+		return
+	}
+	u, err := GetUserByID(int64(key.UserID))
+	if err != nil || u.Active != activeVisible {
+		open311Fail(w, r, http.StatusForbidden, "The account of this api_key is not active")
+		return
+	}
+
+	report := Report{
+		ReporterID:   u.ID,
+		Category:     r.FormValue("service_code"),
+		Description:  r.FormValue("description"),
+		LocationInfo: r.FormValue("address_string"),
+	}
+	lat, err1 := parseCoordinate(r.FormValue("lat"))
+	lng, err2 := parseCoordinate(r.FormValue("long"))
+	if err1 != nil || err2 != nil {
+		open311Fail(w, r, http.StatusBadRequest, "lat and long are required")
+		return
+	}
+	report.Lat, report.Long = lat, lng
+	if report.Category == "" {
+		open311Fail(w, r, http.StatusBadRequest, "service_code is required")
+		return
+	}
+	if _, err := getCategory(report.Category); err != nil {
+		open311Fail(w, r, http.StatusBadRequest, "Unknown service_code")
+		return
+	}
+	if err := report.validateLocation(); err != nil {
+		status := http.StatusBadRequest
+		if err == errOutsideServiceArea {
+			status = http.StatusUnprocessableEntity
+		}
+		open311Fail(w, r, status, err.Error())
+		return
+	}
+	if report.Description == "" || len(report.Description) > 255 || len(report.LocationInfo) > 255 {
+		open311Fail(w, r, http.StatusBadRequest, "description is required and may have up to 255 characters")
+		return
+	}
+	media := r.FormValue("media_url")
+	if media != "" && !validMediaURL(media) {
+		open311Fail(w, r, http.StatusBadRequest, "media_url must be an absolute http or https URL of up to 255 characters")
+		return
+	}
+
+	filtered := filterContent(report.Description, contentFilterRequest(r, u))
+	if filtered.Rejected {
+		open311Fail(w, r, http.StatusBadRequest, "Content rejected by filter: "+strings.Join(filtered.Rules, ", "))
+		return
+	}
+	report.Description = filtered.Text
+	fillLocationInfo(&report)
+
+	created, err := insertReport(&report, contentActive(filtered))
+	if err != nil {
+		open311Fail(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if media != "" {
+		if err := setReportImage(int64(created.ID), media); err == nil {
+			created.ImageLocation = media
+		}
+	}
+
+	res := open311Submission{}
+	if filtered.Held {
+		if err := holdForModeration(TargetReport, int64(created.ID), filtered); err != nil {
+			open311Fail(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		token, err := randomToken(16)
+		if err == nil {
+			err = insertOpen311Token(token, created.ID)
+		}
+		if err != nil {
+			open311Fail(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		res.Token = token
+		res.ServiceNotice = open311HeldNotice
+	} else {
+		res.ServiceRequestID = strconv.Itoa(created.ID)
+	}
+	reportCreated(created, filtered.Held)
+
+	open311Write(w, r, http.StatusCreated, "service_requests", []open311Submission{res})
+}
+
+/*
+Open311Token returns the id of the request a token was issued for, which stays
+empty while the request awaits review.
+*/
+func Open311Token(w http.ResponseWriter, r *http.Request) {
+	if !open311Jurisdiction(w, r) {
+		return
+	}
+	token := mux.Vars(r)["token"]
+	reportID, err := getOpen311Token(token)
+	if err == sql.ErrNoRows {
+		open311Fail(w, r, http.StatusNotFound, "Token not found")
+		return
+	}
+	if err != nil {
+		open311Fail(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	res := open311Token{Token: token}
+	if report, err := getReportByID(reportID); err == nil && report.Active == activeVisible {
+		res.ServiceRequestID = strconv.Itoa(report.ID)
+	}
+	open311Write(w, r, http.StatusOK, "service_requests", []open311Token{res})
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+maxSeverity is the severity of the most urgent categories.
+*/
+const maxSeverity = 5
+
+/*
+Defaults of the priority configuration, used for settings left at 0.
+*/
+const (
+	defaultPriorityMaxVotes   = 20
+	defaultPriorityMaxAgeDays = 14
+	defaultSensitiveRadius    = 250.0
+	priorityRefreshPeriod     = time.Hour
+)
+
+/*
+defaultPriorityWeights add up to 100, so scores run from 0 to 100 unless the
+weights are configured.
+*/
+var defaultPriorityWeights = PriorityWeights{Severity: 35, Votes: 20, Trust: 15, Age: 15, Proximity: 15}
+
+/*
+PriorityWeights are the most points each factor can add to the priority of a
+report.
+*/
+type PriorityWeights struct {
+	Severity  float64 `json:"severity"`
+	Votes     float64 `json:"votes"`
+	Trust     float64 `json:"trust"`
+	Age       float64 `json:"age"`
+	Proximity float64 `json:"proximity"`
+}
+
+/*
+PriorityConfig configures the priority score of reports. Weights default to
+defaultPriorityWeights when all are 0. Votes count fully at MaxVotes votes and
+age at MaxAgeDays days. SensitiveLocations is a GeoJSON file of points such as
+schools and hospitals, with name and type properties; reports within
+SensitiveRadius meters of one get proximity points, the more the closer they
+are.
+*/
+type PriorityConfig struct {
+	Weights            PriorityWeights `json:"weights"`
+	MaxVotes           int             `json:"maxVotes"`
+	MaxAgeDays         float64         `json:"maxAgeDays"`
+	SensitiveLocations string          `json:"sensitiveLocations"`
+	SensitiveRadius    float64         `json:"sensitiveRadius"`
+}
+
+/*
+sensitiveLocation is a place such as a school or hospital where problems are
+more urgent.
+*/
+type sensitiveLocation struct {
+	Name     string
+	Type     string
+	Lat, Lng float64
+}
+
+/*
+PriorityFactor explains one part of a priority score. Value is what was
+measured: the severity, votes, trust score, age in hours or distance in meters.
+*/
+type PriorityFactor struct {
+	Name   string  `json:"name"`
+	Value  float64 `json:"value"`
+	Points float64 `json:"points"`
+	Max    float64 `json:"max"`
+	Detail string  `json:"detail"`
+}
+
+/*
+ReportPriority is the priority score of a report with the factors it was
+computed from.
+*/
+type ReportPriority struct {
+	ReportID int              `json:"reportId"`
+	Score    float64          `json:"score"`
+	Factors  []PriorityFactor `json:"factors"`
+	Date     time.Time        `json:"updated"`
+}
+
+var (
+	priorityConf       PriorityConfig
+	sensitiveLocations []sensitiveLocation
+)
+
+/*
+initPriority applies the defaults of the priority configuration and loads the
+sensitive locations.
+*/
+func initPriority(c PriorityConfig) error {
+	if c.Weights == (PriorityWeights{}) {
+		c.Weights = defaultPriorityWeights
+	}
+	w := c.Weights
+	if w.Severity < 0 || w.Votes < 0 || w.Trust < 0 || w.Age < 0 || w.Proximity < 0 {
+		return errors.New("priority weights can't be negative")
+	}
+	if c.MaxVotes <= 0 {
+		c.MaxVotes = defaultPriorityMaxVotes
+	}
+	if c.MaxAgeDays <= 0 {
+		c.MaxAgeDays = defaultPriorityMaxAgeDays
+	}
+	if c.SensitiveRadius <= 0 {
+		c.SensitiveRadius = defaultSensitiveRadius
+	}
+	priorityConf = c
+	if c.SensitiveLocations == "" {
+		return nil
+	}
+	locations, err := readSensitiveLocations(c.SensitiveLocations)
+	if err != nil {
+		return errors.New("loading sensitive locations: " + err.Error())
+	}
+	sensitiveLocations = locations
+	return nil
+}
+
+/*
+readSensitiveLocations reads the points of a GeoJSON FeatureCollection. The type
+is taken from the type property or, for OpenStreetMap extracts, amenity.
+*/
+func readSensitiveLocations(name string) ([]sensitiveLocation, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dec, err := geoJSONFeatures(file)
+	if err != nil {
+		return nil, err
+	}
+	var locations []sensitiveLocation
+	for dec.More() {
+		var feature struct {
+			Geometry *struct {
+				Type        string    `json:"type"`
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		}
+		if err := dec.Decode(&feature); err != nil {
+			return nil, err
+		}
+		g := feature.Geometry
+		if g == nil || g.Type != "Point" || len(g.Coordinates) < 2 {
+			continue
+		}
+		l := sensitiveLocation{
+			Name: propertyString(feature.Properties, "name"),
+			Type: propertyString(feature.Properties, "type"),
+			Lat:  g.Coordinates[1],
+			Lng:  g.Coordinates[0],
+		}
+		if l.Type == "" {
+			l.Type = propertyString(feature.Properties, "amenity")
+		}
+		locations = append(locations, l)
+	}
+	return locations, nil
+}
+
+func (l *sensitiveLocation) label() string {
+	switch {
+	case l.Name == "" && l.Type == "":
+		return "a sensitive location"
+	case l.Name == "":
+		return "a " + l.Type
+	case l.Type == "":
+		return l.Name
+	}
+	return l.Name + " (" + l.Type + ")"
+}
+
+/*
+nearestSensitiveLocation returns the closest sensitive location within radius
+meters of a point and its distance, or nil.
+*/
+func nearestSensitiveLocation(lat, lng, radius float64) (*sensitiveLocation, float64) {
+	var nearest *sensitiveLocation
+	best := radius
+	b := radiusBBox(lat, lng, radius)
+	for i := range sensitiveLocations {
+		l := &sensitiveLocations[i]
+		if !b.contains(l.Lat, l.Lng) {
+			continue
+		}
+		if d := distance(lat, lng, l.Lat, l.Lng); d <= best {
+			nearest, best = l, d
+		}
+	}
+	return nearest, best
+}
+
+/*
+priorityInput is what the priority of a report is computed from.
+*/
+type priorityInput struct {
+	Report   *Report
+	Severity int
+	Votes    int
+	Trust    int
+}
+
+/*
+computePriority scores a report. Each factor is scaled to between 0 and 1 and
+multiplied by its weight: votes on a logarithmic scale so the first few count
+most, age linearly and proximity falling off linearly to 0 at the radius.
+*/
+func computePriority(in priorityInput, now time.Time) *ReportPriority {
+	c := priorityConf
+	r := in.Report
+	p := &ReportPriority{ReportID: r.ID, Date: now}
+	add := func(name string, value, scale, max float64, detail string) {
+		points := math.Round(math.Max(0, math.Min(1, scale))*max*100) / 100
+		p.Factors = append(p.Factors, PriorityFactor{name, value, points, max, detail})
+		p.Score += points
+	}
+
+	add("severity", float64(in.Severity), float64(in.Severity)/maxSeverity, c.Weights.Severity,
+		"Category "+r.Category+" has severity "+strconv.Itoa(in.Severity)+" of "+strconv.Itoa(maxSeverity))
+	add("votes", float64(in.Votes), math.Log1p(float64(in.Votes))/math.Log1p(float64(c.MaxVotes)), c.Weights.Votes,
+		strconv.Itoa(in.Votes)+" votes")
+	add("trust", float64(in.Trust), float64(in.Trust)/trustMax, c.Weights.Trust,
+		"The reporter has a trust score of "+strconv.Itoa(in.Trust))
+	hours := math.Max(0, now.Sub(r.Date).Hours())
+	add("age", math.Round(hours*10)/10, hours/(c.MaxAgeDays*24), c.Weights.Age,
+		"Filed "+strconv.Itoa(int(hours/24))+" days ago")
+
+	detail := "Not near a sensitive location"
+	scale, meters := 0.0, 0.0
+	if lat, lng, err := r.point(); err == nil {
+		if l, d := nearestSensitiveLocation(lat, lng, c.SensitiveRadius); l != nil {
+			scale, meters = 1-d/c.SensitiveRadius, math.Round(d)
+			detail = strconv.Itoa(int(meters)) + " m from " + l.label()
+		}
+	}
+	add("proximity", meters, scale, c.Weights.Proximity, detail)
+
+	p.Score = math.Round(p.Score*100) / 100
+	return p
+}
+
+/*
+triageStatuses are the statuses of reports which still need work.
+*/
+func triageStatuses() map[string]bool {
+	return map[string]bool{StatusOpen: true, StatusAcknowledged: true, StatusInProgress: true}
+}
+
+/*
+refreshPriority recomputes and stores the priority of a report. categories
+caches the severities of categories, loaded on demand.
+*/
+func refreshPriority(r *Report, categories map[string]int, now time.Time) (*ReportPriority, error) {
+	severity, ok := categories[r.Category]
+	if !ok {
+		if c, err := getCategory(r.Category); err == nil {
+			severity = c.Severity
+		}
+		categories[r.Category] = severity
+	}
+	votes, err := countVotes(int64(r.ID))
+	if err != nil {
+		return nil, err
+	}
+	p := computePriority(priorityInput{r, severity, votes, trustScore(int64(r.ReporterID))}, now)
+	factors, err := json.Marshal(p.Factors)
+	if err != nil {
+		return nil, err
+	}
+	if err := savePriority(p, string(factors)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+/*
+refreshPriorityLater recomputes the priority of a report in the background
+after it changed.
+*/
+func refreshPriorityLater(id int64) {
+	go func() {
+		r, err := getReportByID(id)
+		if err != nil {
+			log.Println("loading report for priority:", err)
+			return
+		}
+		if _, err := refreshPriority(r, map[string]int{}, time.Now()); err != nil {
+			log.Println("computing priority:", err)
+		}
+	}()
+}
+
+var priorityMu sync.Mutex
+
+/*
+refreshPriorities recomputes the priority of every report in the triage queue
+matching the filter. Runs don't overlap.
+*/
+func refreshPriorities(f *reportFilter) {
+	priorityMu.Lock()
+	defer priorityMu.Unlock()
+
+	if f.Statuses == nil {
+		f.Statuses = triageStatuses()
+	}
+	reports, err := getReports(f)
+	if err != nil {
+		log.Println("loading reports for priority:", err)
+		return
+	}
+	now := time.Now()
+	categories := map[string]int{}
+	for i := range reports {
+		if _, err := refreshPriority(&reports[i], categories, now); err != nil {
+			log.Println("computing priority:", err)
+		}
+	}
+}
+
+/*
+runPriorityRefresh recomputes all priorities at start and then every hour, as
+reports age and reporters' trust changes. It is meant to be run in its own
+goroutine.
+*/
+func runPriorityRefresh() {
+	for {
+		refreshPriorities(&reportFilter{})
+		time.Sleep(priorityRefreshPeriod)
+	}
+}
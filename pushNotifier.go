@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+/*
+Platforms devices can register for push notifications on.
+*/
+const (
+	PlatformWeb     = "web"
+	PlatformAndroid = "android"
+	PlatformIOS     = "ios"
+	PlatformFake    = "fake"
+)
+
+const (
+	pushTTL           = 24 * time.Hour
+	pushTimeout       = 10 * time.Second
+	webPushRecordSize = 4096
+)
+
+/*
+errDeadToken is returned by push providers when the device token is no longer
+valid, for example because the app was uninstalled. The device is removed.
+*/
+var errDeadToken = errors.New("Device token is no longer valid")
+
+/*
+Device is a browser or app install which receives push notifications. For web
+push Token is the endpoint of the push subscription and P256dh and Auth are its
+keys.
+*/
+type Device struct {
+	ID       int       `json:"id"`
+	UserID   int       `json:"user"`
+	Platform string    `json:"platform"`
+	Token    string    `json:"token"`
+	P256dh   string    `json:"p256dh,omitempty"`
+	Auth     string    `json:"auth,omitempty"`
+	Date     time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+	Active   int       `json:"-"`
+}
+
+/*
+PushMessage is the content of a push notification.
+*/
+type PushMessage struct {
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	Type      string `json:"type"`
+	ReportID  int    `json:"reportId"`
+	CommentID int    `json:"commentId,omitempty"`
+}
+
+/*
+PushProvider delivers push messages to the devices of one platform.
+*/
+type PushProvider interface {
+	Platform() string
+	Send(d *Device, m PushMessage) error
+}
+
+/*
+PushConfig configures push delivery. VAPID holds the key pair web push messages
+are signed with, Providers the HTTP push services for the apps. With Fake set,
+messages to devices on the "fake" platform are recorded in memory instead of
+being sent, which allows testing push without network access.
+*/
+type PushConfig struct {
+	VAPID     VAPIDConfig          `json:"vapid"`
+	Providers []PushProviderConfig `json:"providers"`
+	Fake      bool                 `json:"fake"`
+}
+
+/*
+VAPIDConfig holds the P-256 key pair of the server for web push as unpadded
+base64url, and the contact sent to push services as subject.
+*/
+type VAPIDConfig struct {
+	PublicKey  string `json:"publicKey"`
+	PrivateKey string `json:"privateKey"`
+	Subject    string `json:"subject"`
+}
+
+/*
+PushProviderConfig describes an HTTP push service such as FCM or APNs. Format is
+"fcm" or "apns" and decides how messages are encoded. For APNs the device token
+is appended to URL and Topic is the bundle id of the app. Authorization is sent
+as is in the Authorization header.
+*/
+type PushProviderConfig struct {
+	Platform      string `json:"platform"`
+	Format        string `json:"format"`
+	URL           string `json:"url"`
+	Authorization string `json:"authorization"`
+	Topic         string `json:"topic"`
+}
+
+var pushProviders = map[string]PushProvider{}
+
+var pushClient = &http.Client{Timeout: pushTimeout}
+
+/*
+registerPushProvider adds a provider, replacing any earlier one for the same
+platform.
+*/
+func registerPushProvider(p PushProvider) {
+	pushProviders[p.Platform()] = p
+}
+
+/*
+pushNotifier sends notifications to all devices of the user.
+*/
+type pushNotifier struct{}
+
+func (pushNotifier) Name() string { return ChannelPush }
+
+func (pushNotifier) Notify(n Notification) error {
+	devices, err := getUserDevices(int64(n.UserID))
+	if err != nil {
+		return err
+	}
+	m := PushMessage{n.Title, n.Body, n.Type, n.ReportID, n.CommentID}
+	var failed error
+	for i := range devices {
+		d := &devices[i]
+		p, ok := pushProviders[d.Platform]
+		if !ok {
+			continue
+		}
+		err := p.Send(d, m)
+		switch {
+		case err == errDeadToken:
+			if err := deactivateDevice(d.ID); err != nil {
+				log.Println("removing dead device:", err)
+			}
+		case err != nil:
+			failed = fmt.Errorf("device %d: %v", d.ID, err)
+		default:
+			if err := touchDevice(d.ID); err != nil {
+				log.Println("updating device:", err)
+			}
+		}
+	}
+	return failed
+}
+
+/*
+webPushProvider sends web push messages (RFC 8030) encrypted with aes128gcm
+(RFC 8291) and authenticated with VAPID (RFC 8292).
+*/
+type webPushProvider struct {
+	key     *ecdsa.PrivateKey
+	public  string
+	subject string
+}
+
+/*
+newWebPushProvider parses the VAPID key pair. The private key is the raw 32 byte
+scalar and the public key the uncompressed point, both base64url encoded.
+*/
+func newWebPushProvider(c VAPIDConfig) (*webPushProvider, error) {
+	d, err := base64.RawURLEncoding.DecodeString(c.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, err
+	}
+	pub := priv.PublicKey().Bytes()
+	if c.PublicKey != "" && c.PublicKey != base64.RawURLEncoding.EncodeToString(pub) {
+		return nil, errors.New("VAPID public key does not match the private key")
+	}
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(pub[1:33]),
+			Y:     new(big.Int).SetBytes(pub[33:65]),
+		},
+		D: new(big.Int).SetBytes(d),
+	}
+	return &webPushProvider{key, base64.RawURLEncoding.EncodeToString(pub), c.Subject}, nil
+}
+
+/*
+webPushHosts are the push services of the browsers. Endpoints elsewhere are
+refused so subscriptions can't make the server post to arbitrary hosts.
+*/
+var webPushHosts = []string{
+	"fcm.googleapis.com",
+	"updates.push.services.mozilla.com",
+	"web.push.apple.com",
+	"*.notify.windows.com",
+}
+
+var errPushEndpoint = errors.New("Web push endpoint is not a known push service")
+
+/*
+webPushEndpoint parses the endpoint of a web push subscription, which must be an
+https URL on one of webPushHosts.
+*/
+func webPushEndpoint(endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.User != nil || u.Port() != "" {
+		return nil, errPushEndpoint
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range webPushHosts {
+		if host == h || strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			return u, nil
+		}
+	}
+	return nil, errPushEndpoint
+}
+
+func (p *webPushProvider) Platform() string { return PlatformWeb }
+
+func (p *webPushProvider) Send(d *Device, m PushMessage) error {
+	if _, err := webPushEndpoint(d.Token); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	body, err := encryptWebPush(payload, d.P256dh, d.Auth)
+	if err != nil {
+		return err
+	}
+	auth, err := p.vapidAuthorization(d.Token)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", d.Token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(int(pushTTL.Seconds())))
+	return sendPush(req, nil)
+}
+
+/*
+vapidAuthorization returns the Authorization header for a push service: an ES256
+JWT for the origin of the endpoint together with the public key of the server.
+*/
+func (p *webPushProvider) vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": p.subject,
+	})
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		return "", err
+	}
+	return "vapid t=" + signed + ", k=" + p.public, nil
+}
+
+/*
+encryptWebPush encrypts a payload for the subscription keys of a browser as a
+single aes128gcm record.
+*/
+func encryptWebPush(payload []byte, p256dh, authSecret string) ([]byte, error) {
+	uaPublic, err := decodeBase64URL(p256dh)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := decodeBase64URL(authSecret)
+	if err != nil {
+		return nil, err
+	}
+	uaKey, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+	shared, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdf(secret, shared, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload)+1+gcm.Overhead() > webPushRecordSize {
+		return nil, errors.New("Push message too large")
+	}
+	// The delimiter 2 marks the last and only record.
+	plain := append(append([]byte{}, payload...), 2)
+
+	header := make([]byte, 16+4+1, 16+4+1+len(asPublic))
+	copy(header, salt)
+	binary.BigEndian.PutUint32(header[16:], webPushRecordSize)
+	header[20] = byte(len(asPublic))
+	header = append(header, asPublic...)
+	return gcm.Seal(header, nonce, plain, nil), nil
+}
+
+/*
+hkdf derives length bytes from the input key material with HMAC-SHA256 (RFC
+5869). length is never more than one block here.
+*/
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
+
+/*
+decodeBase64URL accepts base64url with or without padding, as browsers differ.
+*/
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+/*
+httpPushProvider sends messages to an FCM or APNs style HTTP push service.
+*/
+type httpPushProvider struct {
+	c PushProviderConfig
+}
+
+func (p *httpPushProvider) Platform() string { return p.c.Platform }
+
+func (p *httpPushProvider) Send(d *Device, m PushMessage) error {
+	var body interface{}
+	endpoint := p.c.URL
+	data := map[string]string{
+		"type":     m.Type,
+		"reportId": fmt.Sprint(m.ReportID),
+	}
+	if m.CommentID != 0 {
+		data["commentId"] = fmt.Sprint(m.CommentID)
+	}
+	switch p.c.Format {
+	case "apns":
+		endpoint = strings.TrimRight(endpoint, "/") + "/" + url.PathEscape(d.Token)
+		payload := map[string]interface{}{
+			"aps": map[string]interface{}{
+				"alert": map[string]string{"title": m.Title, "body": m.Body},
+			},
+		}
+		for k, v := range data {
+			payload[k] = v
+		}
+		body = payload
+	default:
+		body = map[string]interface{}{
+			"message": map[string]interface{}{
+				"token":        d.Token,
+				"notification": map[string]string{"title": m.Title, "body": m.Body},
+				"data":         data,
+			},
+		}
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.c.Authorization != "" {
+		req.Header.Set("Authorization", p.c.Authorization)
+	}
+	if p.c.Format == "apns" {
+		req.Header.Set("apns-topic", p.c.Topic)
+		req.Header.Set("apns-push-type", "alert")
+		req.Header.Set("apns-expiration", fmt.Sprint(time.Now().Add(pushTTL).Unix()))
+	}
+	return sendPush(req, deadTokenReason)
+}
+
+/*
+deadTokenReason recognizes the error bodies FCM and APNs send for tokens which
+are not registered anymore.
+*/
+func deadTokenReason(status int, body []byte) bool {
+	if status != http.StatusBadRequest && status != http.StatusNotFound && status != http.StatusGone {
+		return false
+	}
+	for _, reason := range []string{"UNREGISTERED", "Unregistered", "BadDeviceToken", "NOT_FOUND"} {
+		if bytes.Contains(body, []byte(reason)) {
+			return true
+		}
+	}
+	return status == http.StatusGone
+}
+
+/*
+sendPush performs a push request. 404 and 410 mean the subscription is gone;
+dead, if not nil, recognizes other responses for dead tokens.
+*/
+func sendPush(req *http.Request, dead func(status int, body []byte) bool) error {
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 65536))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if dead != nil {
+		if dead(resp.StatusCode, body) {
+			return errDeadToken
+		}
+	} else if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return errDeadToken
+	}
+	return fmt.Errorf("push service returned %s: %s", resp.Status, bytes.TrimSpace(body))
+}
+
+/*
+PushDelivery is a message recorded by the fake push provider.
+*/
+type PushDelivery struct {
+	DeviceID int         `json:"device"`
+	UserID   int         `json:"user"`
+	Token    string      `json:"token"`
+	Message  PushMessage `json:"message"`
+	Date     time.Time   `json:"date"`
+}
+
+const maxFakeDeliveries = 1000
+
+/*
+fakePushProvider records messages instead of sending them. Tokens starting with
+"dead" are treated as unregistered so removal of dead devices can be tried out.
+*/
+type fakePushProvider struct {
+	mu         sync.Mutex
+	deliveries []PushDelivery
+}
+
+var fakePush = &fakePushProvider{}
+
+func (p *fakePushProvider) Platform() string { return PlatformFake }
+
+func (p *fakePushProvider) Send(d *Device, m PushMessage) error {
+	if strings.HasPrefix(d.Token, "dead") {
+		return errDeadToken
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deliveries = append(p.deliveries, PushDelivery{d.ID, d.UserID, d.Token, m, time.Now()})
+	if len(p.deliveries) > maxFakeDeliveries {
+		p.deliveries = p.deliveries[len(p.deliveries)-maxFakeDeliveries:]
+	}
+	return nil
+}
+
+/*
+recorded returns the recorded deliveries, oldest first, and clears them if
+clear is set.
+*/
+func (p *fakePushProvider) recorded(clear bool) []PushDelivery {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	deliveries := append([]PushDelivery{}, p.deliveries...)
+	if clear {
+		p.deliveries = nil
+	}
+	return deliveries
+}
+
+/*
+initPush registers the configured push providers, and the push channel when
+there are any.
+*/
+func initPush(c PushConfig) error {
+	if c.VAPID.PrivateKey != "" {
+		p, err := newWebPushProvider(c.VAPID)
+		if err != nil {
+			return err
+		}
+		registerPushProvider(p)
+	}
+	for _, pc := range c.Providers {
+		if pc.Platform == "" || pc.URL == "" {
+			return errors.New("Push providers need a platform and a URL")
+		}
+		registerPushProvider(&httpPushProvider{pc})
+	}
+	if c.Fake {
+		registerPushProvider(fakePush)
+	}
+	if len(pushProviders) > 0 {
+		registerNotifier(pushNotifier{})
+	}
+	return nil
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -13,47 +16,212 @@ import (
 
 /*
 Report contains information about a given report.
-The reporter must
+The reporter is taken from the bearer token of the request and is 0 for
+anonymous reports.
+Accuracy is the radius in meters the device located the report within and
+Altitude its height in meters; both are optional.
 */
 type Report struct {
-	ID            int       `json:"-"`
-	ReporterID    int       `json:"reporter"`
-	Date          time.Time `json:"created"`
-	Long          string    `json:"long"`
-	Lat           string    `json:"lat"`
-	Description   string    `json:"description"`
-	LocationInfo  string    `json:"locInfo"`
-	ImageLocation string    `json:"image"`
-	Active        int       `json:"-"`
+	ID            int        `json:"id"`
+	ReporterID    int        `json:"reporter"`
+	Date          time.Time  `json:"created"`
+	Long          Coordinate `json:"long"`
+	Lat           Coordinate `json:"lat"`
+	Description   string     `json:"description"`
+	LocationInfo  string     `json:"locInfo"`
+	ImageLocation string     `json:"image"`
+	Active        int        `json:"-"`
+	Status        string     `json:"status"`
+	Category      string     `json:"category"`
+	Accuracy      *float64   `json:"accuracy,omitempty"`
+	Altitude      *float64   `json:"altitude,omitempty"`
+}
+
+/*
+Statuses a report moves through. New reports are open, staff acknowledge them,
+work on them and finally resolve, close or reject them as invalid.
+*/
+const (
+	StatusOpen         = "open"
+	StatusAcknowledged = "acknowledged"
+	StatusInProgress   = "in_progress"
+	StatusResolved     = "resolved"
+	StatusClosed       = "closed"
+	StatusRejected     = "rejected"
+)
+
+var reportStatuses = map[string]bool{
+	StatusOpen:         true,
+	StatusAcknowledged: true,
+	StatusInProgress:   true,
+	StatusResolved:     true,
+	StatusClosed:       true,
+	StatusRejected:     true,
+}
+
+/*
+StatusChange is an entry in the status history of a report.
+*/
+type StatusChange struct {
+	ID        int       `json:"id"`
+	ReportID  int       `json:"reportId"`
+	Status    string    `json:"status"`
+	ChangedBy int       `json:"changedBy"`
+	Note      string    `json:"note"`
+	Date      time.Time `json:"changed"`
 }
 
 /*
 Comment contains information of a comment made on a report.
 */
 type Comment struct {
-	ID       int       `json:"-"`
-	ReportID int       `json:"ReportId"`
-	AuthorID int       `json:"AuthorId"`
-	Date     time.Time `json:"created"`
-	Message  string    `json:"Message"`
-	Active   int       `json:"-"`
+	ID         int        `json:"Id"`
+	ReportID   int        `json:"ReportId"`
+	AuthorID   int        `json:"AuthorId"`
+	Date       time.Time  `json:"created"`
+	Message    string     `json:"Message"`
+	Active     int        `json:"-"`
+	ParentID   int        `json:"ParentId,omitempty"`
+	Edited     bool       `json:"edited"`
+	EditedDate *time.Time `json:"editedAt,omitempty"`
+	Visibility string     `json:"visibility"`
+}
+
+/*
+Visibility of a comment. Internal comments are notes between staff and must only
+ever be shown to staff. Anything that sends comments to citizens, whether a
+listing, an export, a search or a notification, has to check isPublic.
+*/
+const (
+	CommentPublic   = "public"
+	CommentInternal = "internal"
+)
+
+func (c *Comment) isPublic() bool {
+	return c.Visibility == CommentPublic
+}
+
+/*
+canViewComment reports whether the user u, which may be nil, can see comment c.
+*/
+func canViewComment(u *User, c *Comment) bool {
+	return c.isPublic() || u.isStaff()
+}
+
+/*
+CommentEdit is a previous version of a comment, kept whenever a comment is edited.
+*/
+type CommentEdit struct {
+	ID        int       `json:"id"`
+	CommentID int       `json:"commentId"`
+	EditorID  int       `json:"editor"`
+	Message   string    `json:"Message"`
+	Date      time.Time `json:"edited"`
+}
+
+var errCommentNotFound = errors.New("Comment not found")
+
+const (
+	defaultCommentDepth = 5
+	maxCommentDepth     = 20
+)
+
+/*
+CommentNode is a comment in a threaded view of a report's comments.
+ReplyCount is the number of direct replies, which is also set when the replies
+themselves are cut off by the depth limit. A deactivated comment which still has
+replies is kept as a tombstone with its author and message removed.
+*/
+type CommentNode struct {
+	Comment
+	Deleted    bool           `json:"deleted,omitempty"`
+	ReplyCount int            `json:"replyCount"`
+	Replies    []*CommentNode `json:"replies,omitempty"`
+}
+
+/*
+buildCommentTree arranges comments into threads below root, which is 0 for the
+whole report. Replies nested deeper than depth are counted but left out.
+*/
+func buildCommentTree(comments []Comment, root, depth int) []*CommentNode {
+	ids := map[int]bool{}
+	for _, c := range comments {
+		ids[c.ID] = true
+	}
+	children := map[int][]Comment{}
+	for _, c := range comments {
+		parent := c.ParentID
+		if parent != 0 && !ids[parent] {
+			parent = 0
+		}
+		children[parent] = append(children[parent], c)
+	}
+
+	var build func(parent, level int) []*CommentNode
+	build = func(parent, level int) []*CommentNode {
+		nodes := []*CommentNode{}
+		for _, c := range children[parent] {
+			n := &CommentNode{Comment: c}
+			replies := build(c.ID, level+1)
+			if c.Active != 1 {
+				if len(replies) == 0 {
+					continue
+				}
+				n.Deleted = true
+				n.AuthorID = 0
+				n.Message = ""
+			}
+			n.ReplyCount = len(replies)
+			if level < depth {
+				n.Replies = replies
+			}
+			nodes = append(nodes, n)
+		}
+		return nodes
+	}
+
+	return build(root, 1)
 }
 
 /*
 ReportIndex retireves all of the reports for a given system.
+They can be filtered by status, category, department, bbox and creation date,
+see reportFilterFromRequest. Staff can pass sort=trust to see the reports of the
+most trusted reporters first.
 */
 func ReportIndex(w http.ResponseWriter, r *http.Request) {
-	reports, err := getAllReports()
+	f, err := reportFilterFromRequest(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if err = json.NewEncoder(w).Encode(reports); err != nil {
+	byTrust := false
+	switch r.URL.Query().Get("sort") {
+	case "":
+	case "trust":
+		if u, err := requestUser(r); err != nil || !u.isStaff() {
+			http.Error(w, "Sorting by trust is for staff only", http.StatusForbidden)
+			return
+		}
+		byTrust = true
+	default:
+		http.Error(w, "Invalid sort", http.StatusBadRequest)
+		return
+	}
+	reports, err := getReports(f)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if byTrust {
+		sortByTrust(reports)
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(reports); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 }
 
 /*
@@ -84,6 +252,9 @@ func UserReports(w http.ResponseWriter, r *http.Request) {
 
 /*
 ReportDetails Handler function to get the details for a specific report
+The sla field tells how the report stands against the SLA targets of its
+category and whether it is overdue. Staff also see the trust score of the
+reporter.
 */
 func ReportDetails(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -100,16 +271,37 @@ func ReportDetails(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if err = json.NewEncoder(w).Encode(report); err != nil {
+	s, err := getReportSLA(id)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	resp := struct {
+		*Report
+		SLA           *ReportSLA `json:"sla"`
+		ReporterTrust *int       `json:"reporterTrust,omitempty"`
+	}{Report: report, SLA: s.sla(time.Now())}
+	if u, err := requestUser(r); err == nil && u.isStaff() {
+		score := trustScore(int64(report.ReporterID))
+		resp.ReporterTrust = &score
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 }
 
 /*
 ReportCreate handler function for the creation of a report.
+The description is run through the content filter. Reports held by the filter,
+including anonymous ones unless they are allowed, are stored hidden and answered
+with 202 Accepted instead of 201 Created.
+The reporter automatically follows the new report and users subscribed to the
+area are notified. Without location info the address is filled in by the
+geocoder. Reports with invalid coordinates or outside the service area are
+refused with 422 Unprocessable Entity.
 */
 func ReportCreate(w http.ResponseWriter, r *http.Request) {
 	var report Report
@@ -122,23 +314,80 @@ func ReportCreate(w http.ResponseWriter, r *http.Request) {
 	}
 	if err := json.Unmarshal(body, &report); err != nil {
 		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	u, ok := requestAuthor(w, r)
+	if !ok {
+		return
 	}
+	report.ReporterID = 0
+	if u != nil {
+		report.ReporterID = u.ID
+	}
+	if err := report.validateLocation(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if report.Category != "" {
+		if _, err := getCategory(report.Category); err != nil {
+			http.Error(w, "Unknown category", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	filtered := filterContent(report.Description, contentFilterRequest(r, u))
+	if filtered.Rejected {
+		writeRejected(w, filtered)
+		return
+	}
+	report.Description = filtered.Text
+	fillLocationInfo(&report)
 
-	created, err := insertReport(&report)
+	created, err := insertReport(&report, contentActive(filtered))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	status := http.StatusCreated
+	if filtered.Held {
+		if err := holdForModeration(TargetReport, int64(created.ID), filtered); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status = http.StatusAccepted
+	}
+	reportCreated(created, filtered.Held)
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(created); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
 }
 
 /*
-ReportComments handler function to get the comments for a given report
+reportCreated runs what follows the creation of a report: the reporter follows
+it, it is assigned to the areas of the boundary sets and, unless it is held for
+moderation, area subscribers and event listeners are told about it.
+*/
+func reportCreated(created *Report, held bool) {
+	if created.ReporterID != 0 {
+		insertFollow(int64(created.ID), created.ReporterID)
+	}
+	assignReportAreas(created)
+	refreshPriorityLater(int64(created.ID))
+	if !held {
+		go matchSubscriptions(created)
+		publishEvent(EventReportCreated, created.ID, created)
+	}
+}
+
+/*
+ReportComments handler function to get the comments for a given report.
+Internal staff notes are only included for staff.
+With tree=true the comments are returned as nested threads. depth limits how
+deep the threads are expanded and parent returns only the replies below a
+given comment, which clients use to load threads cut off by the depth limit.
 */
 func ReportComments(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -150,7 +399,42 @@ func ReportComments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	report, err := getReportComments(id)
+	u, _ := requestUser(r)
+	vals := r.URL.Query()
+	if vals.Get("tree") == "true" {
+		depth := defaultCommentDepth
+		if s := vals.Get("depth"); s != "" {
+			depth, err = strconv.Atoi(s)
+			if err != nil || depth < 1 {
+				http.Error(w, "Invalid depth", http.StatusBadRequest)
+				return
+			}
+			if depth > maxCommentDepth {
+				depth = maxCommentDepth
+			}
+		}
+		var parent int
+		if s := vals.Get("parent"); s != "" {
+			parent, err = strconv.Atoi(s)
+			if err != nil {
+				http.Error(w, "Invalid parent", http.StatusBadRequest)
+				return
+			}
+		}
+
+		comments, err := getReportCommentThread(id, u.isStaff())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		if err = json.NewEncoder(w).Encode(buildCommentTree(comments, parent, depth)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	report, err := getReportComments(id, u.isStaff())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -164,7 +448,11 @@ func ReportComments(w http.ResponseWriter, r *http.Request) {
 }
 
 /*
-CommentCreate creates a comment for a specified report
+CommentCreate creates a comment for a specified report.
+The message is run through the content filter. Comments held by the filter are
+stored hidden and answered with 202 Accepted instead of 201 Created. Users
+@mentioned in a published comment are notified, as are the followers of the
+report for public comments. The author starts following the report.
 */
 func CommentCreate(w http.ResponseWriter, r *http.Request) {
 	var comment Comment
@@ -177,49 +465,115 @@ func CommentCreate(w http.ResponseWriter, r *http.Request) {
 	}
 	if err := json.Unmarshal(body, &comment); err != nil {
 		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
 	}
 
-	created, err := insertComment(&comment)
+	reportID, err := strconv.ParseInt(mux.Vars(r)["reportId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	comment.ReportID = int(reportID)
+	u, ok := requestAuthor(w, r)
+	if !ok {
+		return
+	}
+	comment.AuthorID = 0
+	if u != nil {
+		comment.AuthorID = u.ID
+	}
+	if comment.Visibility == "" {
+		comment.Visibility = CommentPublic
+	}
+	if comment.Visibility != CommentPublic && comment.Visibility != CommentInternal {
+		http.Error(w, "Invalid visibility", http.StatusUnprocessableEntity)
+		return
+	}
+	if comment.Visibility == CommentInternal && !u.isStaff() {
+		http.Error(w, "Only staff can write internal notes", http.StatusForbidden)
+		return
+	}
+	if comment.ParentID != 0 {
+		parent, err := getCommentByID(int64(comment.ParentID))
+		if err != nil || parent.ReportID != comment.ReportID || parent.Active != 1 || !canViewComment(u, parent) {
+			http.Error(w, "Parent comment not found", http.StatusUnprocessableEntity)
+			return
+		}
+		// Replies to internal notes stay internal so threads never leak them.
+		if !parent.isPublic() {
+			comment.Visibility = CommentInternal
+		}
+	}
+
+	filtered := filterContent(comment.Message, contentFilterRequest(r, u))
+	if filtered.Rejected {
+		writeRejected(w, filtered)
+		return
+	}
+	comment.Message = filtered.Text
+
+	created, err := insertComment(&comment, contentActive(filtered))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	status := http.StatusCreated
+	if filtered.Held {
+		if err := holdForModeration(TargetComment, int64(created.ID), filtered); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status = http.StatusAccepted
+	} else {
+		processMentions(created)
+		if created.isPublic() {
+			notifyFollowers(int64(created.ReportID), created.AuthorID, Notification{
+				Type:      NotifyComment,
+				ReportID:  created.ReportID,
+				CommentID: created.ID,
+				Title:     "New comment on report " + strconv.Itoa(created.ReportID),
+				Body:      created.Message,
+			})
+		}
+		publishEvent(EventCommentCreated, created.ReportID, created)
+	}
+	if created.AuthorID != 0 {
+		insertFollow(int64(created.ReportID), created.AuthorID)
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(created); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
 }
 
 /*
-GetSpecificReportComment is the handler function for getting a comment off of a report
+GetSpecificReportComment is the handler function for getting a comment off of a report.
+Internal staff notes are reported as not found to anyone but staff and hidden
+comments to anyone but moderators. Deleted comments are never returned.
 */
 func GetSpecificReportComment(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	reportID := vars["commentId"]
-
-	id, err := strconv.ParseInt(reportID, 10, 64)
+	comment, status, err := commentFromRequest(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), status)
 		return
 	}
-
-	comment, err := getCommentByID(id)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	u, _ := requestUser(r)
+	if !canViewComment(u, comment) || comment.Active != activeVisible && !u.isModerator() {
+		http.Error(w, errCommentNotFound.Error(), http.StatusNotFound)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	if err = json.NewEncoder(w).Encode(comment); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
 }
 
 /*
 DeactivateReport is the handler function for deactivating a report.
+Only the reporter and moderators may deactivate a report.
 */
 func DeactivateReport(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
@@ -229,60 +583,282 @@ func DeactivateReport(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	u, err := getReportByID(id)
+	user, err := requestUser(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
-	} else if &u == nil || u.Active == -1 {
+	}
+	u, err := getReportByID(id)
+	if err != nil || u.Active == -1 {
 		http.Error(w, "Report not found", http.StatusNotFound)
 		return
 	}
+	if u.ReporterID != user.ID && !user.isModerator() {
+		http.Error(w, "Not allowed to delete report", http.StatusForbidden)
+		return
+	}
+	wasVisible := u.Active == activeVisible
 	u, err = deactivateReportByID(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wasVisible {
+		publishReportUpdate(id)
 	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	if err := json.NewEncoder(w).Encode(u); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
 }
 
 /*
-DeactivateComment is the handler function for deactivating a report.
+commentFromRequest loads the comment named by the route variables and checks
+it belongs to the report in the route, returning an HTTP status code alongside
+any error.
 */
-func DeactivateComment(w http.ResponseWriter, r *http.Request) {
+func commentFromRequest(r *http.Request) (*Comment, int, error) {
 	v := mux.Vars(r)
-	s := v["reportId"]
-	c := v["commentId"]
-	reportID, err := strconv.ParseInt(s, 10, 64)
+	reportID, err := strconv.ParseInt(v["reportId"], 10, 64)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, http.StatusBadRequest, err
+	}
+	commentID, err := strconv.ParseInt(v["commentId"], 10, 64)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	c, err := getCommentByID(commentID)
+	if err == sql.ErrNoRows || err == nil && (int64(c.ReportID) != reportID || c.Active == -1) {
+		return nil, http.StatusNotFound, errCommentNotFound
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return c, http.StatusOK, nil
+}
+
+/*
+DeactivateComment is the handler function for deactivating a comment.
+Only the author and moderators may deactivate a comment.
+*/
+func DeactivateComment(w http.ResponseWriter, r *http.Request) {
+	user, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	c, status, err := commentFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if c.AuthorID != user.ID && !user.isModerator() {
+		http.Error(w, "Not allowed to delete comment", http.StatusForbidden)
+		return
+	}
+	c, err = deactivateCommentByID(int64(c.ReportID), int64(c.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+CommentUpdate is the handler function for changing the message of a comment.
+Only the author and moderators may edit a comment. The previous message is
+kept in the edit history and the new one goes through the content filter.
+*/
+func CommentUpdate(w http.ResponseWriter, r *http.Request) {
+	user, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	c, status, err := commentFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if c.AuthorID != user.ID && !user.isModerator() {
+		http.Error(w, "Not allowed to edit comment", http.StatusForbidden)
+		return
+	}
+
+	var edit Comment
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(body, &edit); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if edit.Message == "" {
+		http.Error(w, "Message must not be empty", http.StatusUnprocessableEntity)
+		return
+	}
+
+	filtered := filterContent(edit.Message, contentFilterRequest(r, user))
+	if filtered.Rejected {
+		writeRejected(w, filtered)
+		return
+	}
+
+	active := c.Active
+	if filtered.Held {
+		active = activeHidden
+	}
+	updated, err := updateCommentMessage(c, user.ID, filtered.Text, active)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if filtered.Held {
+		if err := holdForModeration(TargetComment, int64(c.ID), filtered); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+	if err := json.NewEncoder(w).Encode(updated); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+CommentHistory returns the previous versions of a comment. Moderators only.
+*/
+func CommentHistory(w http.ResponseWriter, r *http.Request) {
+	user, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !user.isModerator() {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+	c, status, err := commentFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
 		return
 	}
-	commentID, err := strconv.ParseInt(c, 10, 64)
+	edits, err := getCommentEdits(int64(c.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if edits == nil {
+		edits = []CommentEdit{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(edits); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+ReportStatusUpdate is the handler function for staff changing the status of a
+report. The change is recorded in the status history and followers of the
+report are notified.
+*/
+func ReportStatusUpdate(w http.ResponseWriter, r *http.Request) {
+	user, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !user.isStaff() {
+		http.Error(w, "Staff only", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["reportId"], 10, 64)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	u, err := getCommentByID(reportID)
+	report, err := getSpecificReport(id)
+	if err != nil {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+
+	var change StatusChange
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
-	} else if &u == nil || u.Active == -1 {
-		http.Error(w, "Comment
-		 not found", http.StatusNotFound)
+	}
+	if err := json.Unmarshal(body, &change); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if !reportStatuses[change.Status] {
+		http.Error(w, "Invalid status", http.StatusUnprocessableEntity)
+		return
+	}
+	if change.Status == report.Status {
+		http.Error(w, "Report already has status "+change.Status, http.StatusConflict)
+		return
+	}
+	change.ChangedBy = user.ID
+	if err := updateReportStatus(id, &change); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	notifyFollowers(id, user.ID, Notification{
+		Type:     NotifyStatus,
+		ReportID: int(id),
+		Title:    "Report " + strconv.FormatInt(id, 10) + " is now " + strings.Replace(change.Status, "_", " ", -1),
+		Body:     change.Note,
+	})
+	if report.Active == activeVisible {
+		publishEvent(EventReportStatusChanged, int(id), change)
+	}
+	refreshTrustLater(int64(report.ReporterID))
+	refreshPriorityLater(id)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(change); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	u, err = deactivateCommentByID(reportID, commentID)
+}
+
+/*
+ReportStatusHistory returns the status changes of a report, oldest first.
+*/
+func ReportStatusHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["reportId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := getSpecificReport(id); err != nil {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	changes, err := getStatusHistory(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if changes == nil {
+		changes = []StatusChange{}
 	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	if err := json.NewEncoder(w).Encode(u); err != nil {
+	if err := json.NewEncoder(w).Encode(changes); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
 }
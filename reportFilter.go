@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+reportFilter selects reports for the report list and its exports. Empty fields
+don't filter. Statuses, categories and departments are sets. Reporter is only
+set internally, never from a request.
+*/
+type reportFilter struct {
+	Statuses    map[string]bool
+	Categories  map[string]bool
+	Departments map[string]bool
+	Box         *bbox
+	Since       time.Time
+	Until       time.Time
+	Reporter    int64
+}
+
+/*
+reportFilterFromRequest reads the status, category and department lists, the
+bbox and the since and until dates of the report list.
+*/
+func reportFilterFromRequest(r *http.Request) (*reportFilter, error) {
+	f := &reportFilter{
+		Statuses:    listParam(r, "status"),
+		Categories:  listParam(r, "category"),
+		Departments: listParam(r, "department"),
+	}
+	for s := range f.Statuses {
+		if !reportStatuses[s] {
+			return nil, errors.New("Unknown status " + s)
+		}
+	}
+	q := r.URL.Query()
+	if s := q.Get("bbox"); s != "" {
+		b, err := parseBBox(s)
+		if err != nil {
+			return nil, err
+		}
+		f.Box = &b
+	}
+	for name, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if s := q.Get(name); s != "" {
+			parsed, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, errors.New(name + " must be an RFC 3339 date")
+			}
+			*t = parsed
+		}
+	}
+	return f, nil
+}
+
+/*
+inClause returns "column IN (?,...)" for a set and appends its members to args.
+*/
+func inClause(column string, set map[string]bool, args []interface{}) (string, []interface{}) {
+	placeholders := make([]string, 0, len(set))
+	for v := range set {
+		placeholders = append(placeholders, "?")
+		args = append(args, v)
+	}
+	return column + " IN (" + strings.Join(placeholders, ",") + ")", args
+}
+
+/*
+where returns the SQL conditions of the filter, each starting with AND, for a
+query on reports aliased as r, and their arguments.
+*/
+func (f *reportFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	var c string
+	if len(f.Statuses) > 0 {
+		c, args = inClause("r.status", f.Statuses, args)
+		conds = append(conds, c)
+	}
+	if len(f.Categories) > 0 {
+		c, args = inClause("r.category", f.Categories, args)
+		conds = append(conds, c)
+	}
+	if len(f.Departments) > 0 {
+		c, args = inClause("department", f.Departments, args)
+		conds = append(conds, "r.category IN (SELECT code FROM categories where "+c+")")
+	}
+	if f.Box != nil {
+		conds = append(conds, "r.latitude BETWEEN ? AND ? AND r.longitude BETWEEN ? AND ?")
+		args = append(args, f.Box.MinLat, f.Box.MaxLat, f.Box.MinLng, f.Box.MaxLng)
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "r.report_date>=?")
+		args = append(args, f.Since)
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "r.report_date<=?")
+		args = append(args, f.Until)
+	}
+	if f.Reporter != 0 {
+		conds = append(conds, "r.reporter_id=?")
+		args = append(args, f.Reporter)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(conds, " AND "), args
+}
@@ -41,9 +41,105 @@ var userRoutes = []Route{
 		"/user/{userId}",
 		DeactivateUser,
 	},
+	Route{
+		"Get user mentions",
+		"GET",
+		"/user/{userId}/mentions",
+		UserMentions,
+	},
+	Route{
+		"Mark mention read",
+		"POST",
+		"/user/{userId}/mentions/{mentionId}/read",
+		MentionRead,
+	},
+	Route{
+		"Get notification preferences",
+		"GET",
+		"/user/{userId}/notifications/preferences",
+		GetNotificationPreferences,
+	},
+	Route{
+		"Set notification preferences",
+		"PUT",
+		"/user/{userId}/notifications/preferences",
+		SetNotificationPreferences,
+	},
+	Route{
+		"Get area subscriptions",
+		"GET",
+		"/user/{userId}/subscriptions",
+		UserSubscriptions,
+	},
+	Route{
+		"Create area subscription",
+		"POST",
+		"/user/{userId}/subscriptions",
+		SubscriptionCreate,
+	},
+	Route{
+		"Delete area subscription",
+		"DELETE",
+		"/user/{userId}/subscriptions/{subscriptionId}",
+		SubscriptionDelete,
+	},
+	Route{
+		"Get push devices",
+		"GET",
+		"/user/{userId}/device",
+		UserDevices,
+	},
+	Route{
+		"Register push device",
+		"POST",
+		"/user/{userId}/device",
+		DeviceCreate,
+	},
+	Route{
+		"Delete push device",
+		"DELETE",
+		"/user/{userId}/device/{deviceId}",
+		DeviceDelete,
+	},
+	Route{
+		"Send email verification",
+		"POST",
+		"/user/{userId}/verification",
+		SendVerification,
+	},
+	Route{
+		"Get user trust",
+		"GET",
+		"/user/{userId}/trust",
+		UserTrust,
+	},
+	Route{
+		"Override user trust",
+		"PUT",
+		"/user/{userId}/trust",
+		SetUserTrust,
+	},
 }
 
 var reportRoutes = []Route{
+	Route{
+		"Export reports",
+		"GET",
+		"/report/export",
+		ReportExport,
+	},
+	Route{
+		"Report clusters",
+		"GET",
+		"/report/clusters",
+		ReportClusters,
+	},
+	Route{
+		"Report heatmap",
+		"GET",
+		"/report/heatmap/{z}/{x}/{y}",
+		ReportHeatmap,
+	},
 	Route{
 		"Get User Reports",
 		"GET",
@@ -56,6 +152,12 @@ var reportRoutes = []Route{
 		"/report/{reportId}",
 		ReportDetails,
 	},
+	Route{
+		"Deactivate report",
+		"DELETE",
+		"/report/{reportId}",
+		DeactivateReport,
+	},
 	Route{
 		"ReportCreate",
 		"POST",
@@ -68,6 +170,48 @@ var reportRoutes = []Route{
 		"/report",
 		ReportIndex,
 	},
+	Route{
+		"Update report status",
+		"PATCH",
+		"/report/{reportId}/status",
+		ReportStatusUpdate,
+	},
+	Route{
+		"Get report status history",
+		"GET",
+		"/report/{reportId}/status",
+		ReportStatusHistory,
+	},
+	Route{
+		"Follow report",
+		"POST",
+		"/report/{reportId}/follow",
+		FollowReport,
+	},
+	Route{
+		"Unfollow report",
+		"DELETE",
+		"/report/{reportId}/follow",
+		UnfollowReport,
+	},
+	Route{
+		"Vote for report",
+		"POST",
+		"/report/{reportId}/vote",
+		VoteReport,
+	},
+	Route{
+		"Take back vote",
+		"DELETE",
+		"/report/{reportId}/vote",
+		UnvoteReport,
+	},
+	Route{
+		"Report vector tile",
+		"GET",
+		"/tiles/reports/{z}/{x}/{y}.pbf",
+		ReportTile,
+	},
 }
 
 var commentRoutes = []Route{
@@ -89,6 +233,255 @@ var commentRoutes = []Route{
 		"/report/{reportId}/comment/{commentId}",
 		GetSpecificReportComment,
 	},
+	Route{
+		"Edit comment",
+		"PATCH",
+		"/report/{reportId}/comment/{commentId}",
+		CommentUpdate,
+	},
+	Route{
+		"Deactivate comment",
+		"DELETE",
+		"/report/{reportId}/comment/{commentId}",
+		DeactivateComment,
+	},
+	Route{
+		"Get comment edit history",
+		"GET",
+		"/report/{reportId}/comment/{commentId}/history",
+		CommentHistory,
+	},
+}
+
+var categoryRoutes = []Route{
+	Route{
+		"Get categories",
+		"GET",
+		"/category",
+		CategoryIndex,
+	},
+	Route{
+		"Save category",
+		"POST",
+		"/category",
+		CategorySave,
+	},
+}
+
+var notificationRoutes = []Route{
+	Route{
+		"Get notifications",
+		"GET",
+		"/notification",
+		NotificationIndex,
+	},
+	Route{
+		"Mark all notifications read",
+		"POST",
+		"/notification/read",
+		NotificationReadAll,
+	},
+	Route{
+		"Mark notification read",
+		"POST",
+		"/notification/{notificationId}/read",
+		NotificationRead,
+	},
+}
+
+var pushRoutes = []Route{
+	Route{
+		"Get web push public key",
+		"GET",
+		"/push/key",
+		PushPublicKey,
+	},
+	Route{
+		"Get fake push deliveries",
+		"GET",
+		"/push/fake",
+		FakePushDeliveries,
+	},
+}
+
+var webhookRoutes = []Route{
+	Route{
+		"Get webhooks",
+		"GET",
+		"/webhook",
+		WebhookIndex,
+	},
+	Route{
+		"Create webhook",
+		"POST",
+		"/webhook",
+		WebhookCreate,
+	},
+	Route{
+		"Update webhook",
+		"PUT",
+		"/webhook/{webhookId}",
+		WebhookUpdate,
+	},
+	Route{
+		"Delete webhook",
+		"DELETE",
+		"/webhook/{webhookId}",
+		WebhookDelete,
+	},
+	Route{
+		"Get webhook deliveries",
+		"GET",
+		"/webhook/{webhookId}/deliveries",
+		WebhookDeliveries,
+	},
+	Route{
+		"Redeliver webhook delivery",
+		"POST",
+		"/webhook/{webhookId}/deliveries/{deliveryId}/redeliver",
+		WebhookRedeliver,
+	},
+}
+
+var eventRoutes = []Route{
+	Route{
+		"Event stream",
+		"GET",
+		"/events",
+		EventStream,
+	},
+	Route{
+		"Event WebSocket",
+		"GET",
+		"/events/ws",
+		EventSocket,
+	},
+}
+
+var open311Routes = []Route{
+	Route{
+		"Open311 services",
+		"GET",
+		"/open311/v2/services.{format:json|xml}",
+		Open311Services,
+	},
+	Route{
+		"Open311 service definition",
+		"GET",
+		"/open311/v2/services/{serviceCode}.{format:json|xml}",
+		Open311ServiceDefinition,
+	},
+	Route{
+		"Open311 service requests",
+		"GET",
+		"/open311/v2/requests.{format:json|xml}",
+		Open311Requests,
+	},
+	Route{
+		"Open311 create service request",
+		"POST",
+		"/open311/v2/requests.{format:json|xml}",
+		Open311RequestCreate,
+	},
+	Route{
+		"Open311 service request",
+		"GET",
+		"/open311/v2/requests/{requestId:[0-9]+}.{format:json|xml}",
+		Open311Request,
+	},
+	Route{
+		"Open311 token",
+		"GET",
+		"/open311/v2/tokens/{token}.{format:json|xml}",
+		Open311Token,
+	},
+}
+
+var importRoutes = []Route{
+	Route{
+		"Import reports",
+		"POST",
+		"/import",
+		ImportCreate,
+	},
+	Route{
+		"Get import",
+		"GET",
+		"/import/{importId}",
+		ImportDetails,
+	},
+	Route{
+		"Get import errors",
+		"GET",
+		"/import/{importId}/errors",
+		ImportErrors,
+	},
+}
+
+var boundaryRoutes = []Route{
+	Route{
+		"Get boundary sets",
+		"GET",
+		"/boundary",
+		BoundaryIndex,
+	},
+	Route{
+		"Create boundary set",
+		"POST",
+		"/boundary",
+		BoundaryCreate,
+	},
+	Route{
+		"Get boundary set",
+		"GET",
+		"/boundary/{setId}",
+		BoundaryDetails,
+	},
+	Route{
+		"Delete boundary set",
+		"DELETE",
+		"/boundary/{setId}",
+		BoundaryDelete,
+	},
+}
+
+var geocodeRoutes = []Route{
+	Route{
+		"Reverse geocode",
+		"GET",
+		"/geocode/reverse",
+		GeocodeReverse,
+	},
+	Route{
+		"Search addresses",
+		"GET",
+		"/geocode/search",
+		GeocodeSearch,
+	},
+}
+
+var statsRoutes = []Route{
+	Route{
+		"Report counts per area",
+		"GET",
+		"/stats/areas/{setId}",
+		AreaStats,
+	},
+	Route{
+		"SLA statistics",
+		"GET",
+		"/stats/sla",
+		SLAStats,
+	},
+}
+
+var triageRoutes = []Route{
+	Route{
+		"Triage queue",
+		"GET",
+		"/triage",
+		Triage,
+	},
 }
 
 var otherRoutes = []Route{
@@ -98,18 +491,102 @@ var otherRoutes = []Route{
 		"/login",
 		Login,
 	},
+	Route{
+		"Verify email",
+		"POST",
+		"/verify/{token}",
+		VerifyEmail,
+	},
 	Route{
 		"Store image",
 		"POST",
 		"/report/{reportId}/image",
 		UploadFile,
 	},
+	Route{
+		"Get report attachments",
+		"GET",
+		"/report/{reportId}/image",
+		ReportAttachments,
+	},
 	Route{
 		"Get image from report",
 		"GET",
-		"report/{reportId}/image",
+		"/report/{reportId}/image/{imageId}",
 		GetImage,
 	},
+	Route{
+		"Get signed image URL",
+		"GET",
+		"/report/{reportId}/image/{imageId}/url",
+		SignedImageURL,
+	},
+}
+
+var uploadRoutes = []Route{
+	Route{
+		"Resumable upload options",
+		"OPTIONS",
+		"/upload",
+		UploadOptions,
+	},
+	Route{
+		"Create resumable upload",
+		"POST",
+		"/upload",
+		UploadCreate,
+	},
+	Route{
+		"Resumable upload status",
+		"HEAD",
+		"/upload/{uploadId}",
+		UploadStatus,
+	},
+	Route{
+		"Upload chunk",
+		"PATCH",
+		"/upload/{uploadId}",
+		UploadChunk,
+	},
+	Route{
+		"Terminate resumable upload",
+		"DELETE",
+		"/upload/{uploadId}",
+		UploadTerminate,
+	},
+}
+
+var moderationRoutes = []Route{
+	Route{
+		"Flag report",
+		"POST",
+		"/report/{reportId}/flag",
+		FlagReport,
+	},
+	Route{
+		"Flag comment",
+		"POST",
+		"/report/{reportId}/comment/{commentId}/flag",
+		FlagComment,
+	},
+	Route{
+		"Moderation queue",
+		"GET",
+		"/moderation/queue",
+		ModerationQueue,
+	},
+	Route{
+		"Moderation log",
+		"GET",
+		"/moderation/log",
+		ModerationLog,
+	},
+	Route{
+		"Moderate content",
+		"POST",
+		"/moderation/{targetType}/{targetId}",
+		ModerateContent,
+	},
 }
 
 /*
@@ -120,7 +597,20 @@ func InitRouter() (r *mux.Router) {
 	routes = append(routes, userRoutes...)
 	routes = append(routes, reportRoutes...)
 	routes = append(routes, commentRoutes...)
+	routes = append(routes, categoryRoutes...)
+	routes = append(routes, notificationRoutes...)
+	routes = append(routes, pushRoutes...)
+	routes = append(routes, webhookRoutes...)
+	routes = append(routes, eventRoutes...)
+	routes = append(routes, open311Routes...)
+	routes = append(routes, importRoutes...)
+	routes = append(routes, boundaryRoutes...)
+	routes = append(routes, statsRoutes...)
+	routes = append(routes, triageRoutes...)
+	routes = append(routes, geocodeRoutes...)
 	routes = append(routes, otherRoutes...)
+	routes = append(routes, uploadRoutes...)
+	routes = append(routes, moderationRoutes...)
 
 	r = mux.NewRouter().StrictSlash(true)
 	for _, route := range routes {
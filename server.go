@@ -12,13 +12,35 @@ import (
 Config stores the basic configuration information for a CommComm server.
 Port corresponds to the port the application will be running on. while DBInfo
 defines all of the information needed to connect to the database used for storage of users and reports.
+FlagThreshold is the number of open flags after which a report or comment is hidden until a moderator looks at it.
+ContentFilter configures the rules run on the text of reports and comments.
+SMTP is the mail server for email notifications, which are off without a host.
+DigestHour is the local hour at which daily digests of area subscriptions are sent.
+EscalationHour is the local hour at which overdue reports are escalated to the admins.
+NotificationRetentionDays is how long in-app notifications are kept.
+Push configures web push and the push services of the apps.
+Open311 configures the Open311 GeoReport API and the keys of its clients.
+Geocoder selects the geocoder used to fill in and look up report addresses.
+ServiceArea is a Polygon or MultiPolygon reports must lie in; without it reports are accepted anywhere.
+Priority configures how reports are ranked in the triage queue.
 */
 type Config struct {
-	Port   string `json:"port"`
-	DB     DBInfo `json:"db"`
-	Key    string `json:"key"`
-	Cert   string `json:"cert"`
-	Secret string `json:"secret"`
+	Port                      string         `json:"port"`
+	DB                        DBInfo         `json:"db"`
+	Key                       string         `json:"key"`
+	Cert                      string         `json:"cert"`
+	Secret                    string         `json:"secret"`
+	FlagThreshold             int            `json:"flagThreshold"`
+	ContentFilter             FilterConfig   `json:"contentFilter"`
+	SMTP                      SMTPConfig     `json:"smtp"`
+	DigestHour                *int           `json:"digestHour"`
+	EscalationHour            *int           `json:"escalationHour"`
+	NotificationRetentionDays int            `json:"notificationRetentionDays"`
+	Push                      PushConfig     `json:"push"`
+	Open311                   Open311Config  `json:"open311"`
+	Geocoder                  GeocoderConfig `json:"geocoder"`
+	ServiceArea               *Geometry      `json:"serviceArea"`
+	Priority                  PriorityConfig `json:"priority"`
 }
 
 var conf Config
@@ -34,14 +56,54 @@ type DBInfo struct {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			importCommand(os.Args[2:])
+			return
+		case "addresses":
+			addressesCommand(os.Args[2:])
+			return
+		}
+	}
+
 	n := flag.String("config", "conf.json", "Configuration file. Must be JSON. Default is conf.json in the same working directory as the binary.")
+	flag.Parse()
 
-	conf := getConfig(*n)
+	conf = *getConfig(*n)
 	err := InitDb(conf.DB.Username, conf.DB.Userpass, conf.DB.Address, conf.DB.Port)
 	if err != nil {
 		panic(err)
 	}
 
+	if err := initContentFilter(conf.ContentFilter); err != nil {
+		panic(err)
+	}
+
+	if err := initNotifiers(conf); err != nil {
+		panic(err)
+	}
+
+	if err := initGeocoder(conf.Geocoder); err != nil {
+		panic(err)
+	}
+
+	if err := initServiceArea(conf.ServiceArea); err != nil {
+		panic(err)
+	}
+
+	if err := initPriority(conf.Priority); err != nil {
+		panic(err)
+	}
+
+	go expireUploads()
+	go runDailyDigest()
+	go cleanupNotifications()
+	go runWebhookDeliveries()
+	go cleanupEvents()
+	go runEscalations()
+	go runPriorityRefresh()
+
 	r := InitRouter()
 	log.Fatal(http.ListenAndServe(":"+conf.Port, r))
 }
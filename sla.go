@@ -0,0 +1,273 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+Stages of a report with an SLA target: acknowledging it, which is the first
+status change away from open, and resolving it, which is the first change to
+resolved or closed.
+*/
+const (
+	SLAAcknowledge = "acknowledge"
+	SLAResolve     = "resolve"
+)
+
+const defaultEscalationHour = 6
+
+var slaPercentiles = []int{50, 90, 95}
+
+/*
+slaReport is a report with the times of its SLA stages and the targets of its
+category in hours, 0 meaning no target. Escalated is the last time the report
+was escalated for breaching a target.
+*/
+type slaReport struct {
+	ID           int
+	Category     string
+	Department   string
+	Date         time.Time
+	Status       string
+	Acknowledged *time.Time
+	Resolved     *time.Time
+	AckHours     int
+	ResolveHours int
+	Escalated    *time.Time
+}
+
+/*
+ReportSLA is how a report stands against the SLA targets of its category. Due
+dates are only set for stages with a target. The Met flags are set once a stage
+is done or overdue; Overdue tells whether a stage is waiting past its due date.
+Hours are the time a stage took.
+*/
+type ReportSLA struct {
+	AckTargetHours     int        `json:"ackTargetHours,omitempty"`
+	AckDue             *time.Time `json:"ackDue,omitempty"`
+	Acknowledged       *time.Time `json:"acknowledged,omitempty"`
+	AckHours           *float64   `json:"ackHours,omitempty"`
+	AckMet             *bool      `json:"ackMet,omitempty"`
+	ResolveTargetHours int        `json:"resolveTargetHours,omitempty"`
+	ResolveDue         *time.Time `json:"resolveDue,omitempty"`
+	Resolved           *time.Time `json:"resolved,omitempty"`
+	ResolveHours       *float64   `json:"resolveHours,omitempty"`
+	ResolveMet         *bool      `json:"resolveMet,omitempty"`
+	Overdue            bool       `json:"overdue"`
+	Escalated          *time.Time `json:"escalated,omitempty"`
+}
+
+/*
+slaStopped tells whether the SLA clock of a report in status has stopped.
+Rejected reports are never resolved but don't breach their target either.
+*/
+func slaStopped(status string) bool {
+	return status == StatusResolved || status == StatusClosed || status == StatusRejected
+}
+
+/*
+stage works out one SLA stage of a report: when it is due, how long it took and
+whether the target was met or, while pending, whether it is overdue.
+*/
+func (s *slaReport) stage(target int, done *time.Time, now time.Time) (due *time.Time, took *float64, met *bool, overdue bool) {
+	if done != nil {
+		h := done.Sub(s.Date).Hours()
+		took = &h
+	}
+	if target <= 0 {
+		return nil, took, nil, false
+	}
+	d := s.Date.Add(time.Duration(target) * time.Hour)
+	due = &d
+	switch {
+	case done != nil:
+		ok := !done.After(d)
+		met = &ok
+	case slaStopped(s.Status):
+	case now.After(d):
+		ok := false
+		met = &ok
+		overdue = true
+	}
+	return due, took, met, overdue
+}
+
+func (s *slaReport) sla(now time.Time) *ReportSLA {
+	r := &ReportSLA{
+		AckTargetHours:     s.AckHours,
+		Acknowledged:       s.Acknowledged,
+		ResolveTargetHours: s.ResolveHours,
+		Resolved:           s.Resolved,
+		Escalated:          s.Escalated,
+	}
+	var ackOverdue, resolveOverdue bool
+	r.AckDue, r.AckHours, r.AckMet, ackOverdue = s.stage(s.AckHours, s.Acknowledged, now)
+	r.ResolveDue, r.ResolveHours, r.ResolveMet, resolveOverdue = s.stage(s.ResolveHours, s.Resolved, now)
+	r.Overdue = ackOverdue || resolveOverdue
+	return r
+}
+
+/*
+slaGroup sums up the SLA figures of the reports of a category, department or
+month. The percentiles are in hours, keyed like "p90". Targeted counts the
+reports whose category has a target for the stage and Met those which met it,
+leaving out reports still within their target.
+*/
+type slaGroup struct {
+	Key             string             `json:"key"`
+	Reports         int                `json:"reports"`
+	Acknowledged    int                `json:"acknowledged"`
+	AckHours        map[string]float64 `json:"ackHours"`
+	AckTargeted     int                `json:"ackTargeted"`
+	AckMet          int                `json:"ackMet"`
+	Resolved        int                `json:"resolved"`
+	ResolveHours    map[string]float64 `json:"resolveHours"`
+	ResolveTargeted int                `json:"resolveTargeted"`
+	ResolveMet      int                `json:"resolveMet"`
+	Overdue         int                `json:"overdue"`
+
+	ackTimes, resolveTimes []float64
+}
+
+func (g *slaGroup) add(sla *ReportSLA) {
+	g.Reports++
+	if sla.AckHours != nil {
+		g.Acknowledged++
+		g.ackTimes = append(g.ackTimes, *sla.AckHours)
+	}
+	if sla.AckMet != nil {
+		g.AckTargeted++
+		if *sla.AckMet {
+			g.AckMet++
+		}
+	}
+	if sla.ResolveHours != nil {
+		g.Resolved++
+		g.resolveTimes = append(g.resolveTimes, *sla.ResolveHours)
+	}
+	if sla.ResolveMet != nil {
+		g.ResolveTargeted++
+		if *sla.ResolveMet {
+			g.ResolveMet++
+		}
+	}
+	if sla.Overdue {
+		g.Overdue++
+	}
+}
+
+func (g *slaGroup) finish() {
+	g.AckHours = percentiles(g.ackTimes)
+	g.ResolveHours = percentiles(g.resolveTimes)
+}
+
+/*
+percentiles returns the slaPercentiles of values by the nearest rank method,
+rounded to a tenth of an hour.
+*/
+func percentiles(values []float64) map[string]float64 {
+	p := map[string]float64{}
+	if len(values) == 0 {
+		return p
+	}
+	sort.Float64s(values)
+	for _, pct := range slaPercentiles {
+		rank := (pct*len(values) + 99) / 100
+		if rank < 1 {
+			rank = 1
+		}
+		v := values[rank-1]
+		p["p"+strconv.Itoa(pct)] = float64(int64(v*10+0.5)) / 10
+	}
+	return p
+}
+
+/*
+slaGroups groups reports by a key and returns the groups sorted by key.
+*/
+type slaGroups map[string]*slaGroup
+
+func (gs slaGroups) add(key string, sla *ReportSLA) {
+	g, ok := gs[key]
+	if !ok {
+		g = &slaGroup{Key: key}
+		gs[key] = g
+	}
+	g.add(sla)
+}
+
+func (gs slaGroups) sorted() []*slaGroup {
+	list := []*slaGroup{}
+	for _, g := range gs {
+		g.finish()
+		list = append(list, g)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+/*
+escalateReports notifies the admins about every SLA stage of a report which is
+overdue. Each stage of a report is escalated once.
+*/
+func escalateReports() {
+	admins, err := getUsersByRole(RoleAdmin)
+	if err != nil {
+		log.Println("loading admins for escalation:", err)
+		return
+	}
+	now := time.Now()
+	pending, err := getPendingSLAReports()
+	if err != nil {
+		log.Println("loading reports for escalation:", err)
+		return
+	}
+	for i := range pending {
+		s := &pending[i]
+		for _, stage := range []struct {
+			name   string
+			target int
+			done   *time.Time
+		}{{SLAAcknowledge, s.AckHours, s.Acknowledged}, {SLAResolve, s.ResolveHours, s.Resolved}} {
+			if _, _, _, overdue := s.stage(stage.target, stage.done, now); !overdue {
+				continue
+			}
+			fresh, err := insertEscalation(int64(s.ID), stage.name, now)
+			if err != nil {
+				log.Println("recording escalation:", err)
+				continue
+			}
+			if !fresh {
+				continue
+			}
+			for _, a := range admins {
+				notify(Notification{
+					UserID:   a.ID,
+					Type:     NotifyEscalation,
+					ReportID: s.ID,
+					Title:    "Report #" + strconv.Itoa(s.ID) + " is overdue",
+					Body:     "The " + s.Category + " report was not " + stage.name + "d within " + strconv.Itoa(stage.target) + " hours.",
+					Date:     now,
+				})
+			}
+		}
+	}
+}
+
+/*
+runEscalations escalates overdue reports once a day at the configured hour. It
+is meant to be run in its own goroutine.
+*/
+func runEscalations() {
+	hour := defaultEscalationHour
+	if conf.EscalationHour != nil {
+		hour = *conf.EscalationHour
+	}
+	for {
+		time.Sleep(time.Until(nextAt(hour)))
+		escalateReports()
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+/*
+areaCount is a row of getAreaCounts.
+*/
+type areaCount struct {
+	AreaID   int
+	Status   string
+	Category string
+	Count    int
+}
+
+/*
+areaStats are the report counts of one area. Counts holds the counts by
+category and status, answering questions such as how many potholes are open.
+*/
+type areaStats struct {
+	ID         int                       `json:"id,omitempty"`
+	Name       string                    `json:"name,omitempty"`
+	Code       string                    `json:"code,omitempty"`
+	Total      int                       `json:"total"`
+	Statuses   map[string]int            `json:"statuses"`
+	Categories map[string]int            `json:"categories"`
+	Counts     map[string]map[string]int `json:"counts"`
+}
+
+func newAreaStats() *areaStats {
+	return &areaStats{
+		Statuses:   map[string]int{},
+		Categories: map[string]int{},
+		Counts:     map[string]map[string]int{},
+	}
+}
+
+func (s *areaStats) add(c areaCount) {
+	s.Total += c.Count
+	s.Statuses[c.Status] += c.Count
+	s.Categories[c.Category] += c.Count
+	if s.Counts[c.Category] == nil {
+		s.Counts[c.Category] = map[string]int{}
+	}
+	s.Counts[c.Category][c.Status] += c.Count
+}
+
+/*
+AreaStats counts the reports in each area of a boundary set by status and
+category. since and until limit the date range and the other filters of the
+report list apply too. Reports outside every area are counted as unassigned.
+*/
+func AreaStats(w http.ResponseWriter, r *http.Request) {
+	set, ok := boundarySetFromRoute(w, r)
+	if !ok {
+		return
+	}
+	f, err := reportFilterFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	areas, err := getBoundaryAreas(int64(set.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	counts, err := getAreaCounts(int64(set.ID), f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	byArea := map[int]*areaStats{0: newAreaStats()}
+	stats := []*areaStats{}
+	for _, a := range areas {
+		s := newAreaStats()
+		s.ID, s.Name, s.Code = a.ID, a.Name, a.Code
+		byArea[a.ID] = s
+		stats = append(stats, s)
+	}
+	for _, c := range counts {
+		if s, ok := byArea[c.AreaID]; ok {
+			s.add(c)
+		}
+	}
+
+	resp := struct {
+		Set        *BoundarySet `json:"set"`
+		Since      *time.Time   `json:"since,omitempty"`
+		Until      *time.Time   `json:"until,omitempty"`
+		Areas      []*areaStats `json:"areas"`
+		Unassigned *areaStats   `json:"unassigned"`
+	}{Set: set, Areas: stats, Unassigned: byArea[0]}
+	if !f.Since.IsZero() {
+		resp.Since = &f.Since
+	}
+	if !f.Until.IsZero() {
+		resp.Until = &f.Until
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+SLAStats reports how long it takes to acknowledge and resolve reports, with
+percentiles in hours and how often the SLA targets were met, overall and by
+category, department and month the reports were filed in. The filters of the
+report list apply; without since, the last 365 days are covered.
+*/
+func SLAStats(w http.ResponseWriter, r *http.Request) {
+	f, err := reportFilterFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	if f.Since.IsZero() {
+		f.Since = now.AddDate(-1, 0, 0)
+	}
+	reports, err := getSLAReports(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	overall := &slaGroup{Key: "all"}
+	categories, departments, months := slaGroups{}, slaGroups{}, slaGroups{}
+	for i := range reports {
+		s := &reports[i]
+		sla := s.sla(now)
+		overall.add(sla)
+		categories.add(s.Category, sla)
+		departments.add(s.Department, sla)
+		months.add(s.Date.Format("2006-01"), sla)
+	}
+	overall.finish()
+
+	resp := struct {
+		Since       time.Time   `json:"since"`
+		Until       *time.Time  `json:"until,omitempty"`
+		Percentiles []int       `json:"percentiles"`
+		Overall     *slaGroup   `json:"overall"`
+		Categories  []*slaGroup `json:"categories"`
+		Departments []*slaGroup `json:"departments"`
+		Months      []*slaGroup `json:"months"`
+	}{
+		Since:       f.Since,
+		Percentiles: slaPercentiles,
+		Overall:     overall,
+		Categories:  categories.sorted(),
+		Departments: departments.sorted(),
+		Months:      months.sorted(),
+	}
+	if !f.Until.IsZero() {
+		resp.Until = &f.Until
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
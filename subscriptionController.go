@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+How notifications for an area subscription are delivered. Immediate sends one
+notification per new report, digest collects them into a daily summary.
+*/
+const (
+	DeliveryImmediate = "immediate"
+	DeliveryDigest    = "digest"
+)
+
+const (
+	maxSubscriptionsPerUser = 20
+	maxSubscriptionRadius   = 50000
+	defaultDigestHour       = 7
+)
+
+var errInvalidSubscription = errors.New("Subscription needs a delivery of immediate or digest and either an area or a point with a radius of up to 50km")
+
+/*
+Subscription asks for notifications about new reports in an area. The area is
+either the circle of Radius meters around Lat and Lng, or the GeoJSON Polygon or
+MultiPolygon in Area. Categories optionally restricts the reports to some
+categories.
+*/
+type Subscription struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user"`
+	Name       string    `json:"name"`
+	Lat        float64   `json:"lat,omitempty"`
+	Lng        float64   `json:"long,omitempty"`
+	Radius     float64   `json:"radius,omitempty"`
+	Area       *Geometry `json:"area,omitempty"`
+	Categories []string  `json:"categories"`
+	Delivery   string    `json:"delivery"`
+	Date       time.Time `json:"created"`
+	Active     int       `json:"-"`
+
+	box   bbox
+	areas []polygon
+}
+
+/*
+digestEntry is a report waiting to be sent in a user's daily digest.
+*/
+type digestEntry struct {
+	ID               int
+	UserID           int
+	SubscriptionName string
+	ReportID         int
+	Description      string
+}
+
+/*
+prepare validates a subscription and computes its bounding box.
+*/
+func (s *Subscription) prepare() error {
+	if s.Delivery == "" {
+		s.Delivery = DeliveryImmediate
+	}
+	if s.Delivery != DeliveryImmediate && s.Delivery != DeliveryDigest {
+		return errInvalidSubscription
+	}
+	if s.Area != nil {
+		areas, err := s.Area.polygons()
+		if err != nil {
+			return err
+		}
+		s.areas = areas
+		s.box = polygonsBBox(areas)
+		s.Lat, s.Lng, s.Radius = 0, 0, 0
+		return nil
+	}
+	if s.Radius <= 0 || s.Radius > maxSubscriptionRadius || s.Lat < -90 || s.Lat > 90 || s.Lng < -180 || s.Lng > 180 {
+		return errInvalidSubscription
+	}
+	s.box = radiusBBox(s.Lat, s.Lng, s.Radius)
+	return nil
+}
+
+/*
+matches reports whether a report at lat, lng falls under the subscription.
+*/
+func (s *Subscription) matches(r *Report, lat, lng float64) bool {
+	if len(s.Categories) > 0 {
+		found := false
+		for _, c := range s.Categories {
+			if c == r.Category {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if s.Area != nil {
+		if s.areas == nil {
+			areas, err := s.Area.polygons()
+			if err != nil {
+				return false
+			}
+			s.areas = areas
+		}
+		return polygonsContain(s.areas, lat, lng)
+	}
+	return distance(s.Lat, s.Lng, lat, lng) <= s.Radius
+}
+
+/*
+matchSubscriptions notifies the subscribers whose area contains a new report, or
+queues the report for their digest. The reporter is not notified about their own
+report.
+*/
+func matchSubscriptions(r *Report) {
+	lat, lng, err := r.point()
+	if err != nil {
+		return
+	}
+	subs, err := getSubscriptionsAt(lat, lng)
+	if err != nil {
+		log.Println("matching subscriptions:", err)
+		return
+	}
+	notified := map[int]bool{}
+	for _, s := range subs {
+		if s.UserID == r.ReporterID || notified[s.UserID] || !s.matches(r, lat, lng) {
+			continue
+		}
+		notified[s.UserID] = true
+		if s.Delivery == DeliveryDigest {
+			if err := insertDigestEntry(&s, r.ID); err != nil {
+				log.Println("queueing digest entry:", err)
+			}
+			continue
+		}
+		notify(Notification{
+			UserID:   s.UserID,
+			Type:     NotifyArea,
+			ReportID: r.ID,
+			Title:    "New report in " + s.Name,
+			Body:     r.Description,
+		})
+	}
+}
+
+/*
+sendDigests sends every user with queued reports one notification listing them.
+*/
+func sendDigests() {
+	entries, err := getDigestEntries()
+	if err != nil {
+		log.Println("loading digests:", err)
+		return
+	}
+	byUser := map[int][]digestEntry{}
+	var users []int
+	for _, e := range entries {
+		if _, ok := byUser[e.UserID]; !ok {
+			users = append(users, e.UserID)
+		}
+		byUser[e.UserID] = append(byUser[e.UserID], e)
+	}
+	for _, id := range users {
+		var lines []string
+		for _, e := range byUser[id] {
+			lines = append(lines, e.SubscriptionName+": report "+strconv.Itoa(e.ReportID)+" - "+e.Description)
+		}
+		notify(Notification{
+			UserID: id,
+			Type:   NotifyDigest,
+			Title:  strconv.Itoa(len(lines)) + " new reports in your areas",
+			Body:   strings.Join(lines, "\n"),
+		})
+		if err := deleteDigestEntries(id, byUser[id][len(byUser[id])-1].ID); err != nil {
+			log.Println("clearing digest:", err)
+		}
+	}
+}
+
+/*
+runDailyDigest sends the digests once a day at the configured hour. It is meant
+to be run in its own goroutine.
+*/
+func runDailyDigest() {
+	hour := defaultDigestHour
+	if conf.DigestHour != nil {
+		hour = *conf.DigestHour
+	}
+	for {
+		time.Sleep(time.Until(nextAt(hour)))
+		sendDigests()
+	}
+}
+
+/*
+UserSubscriptions lists the area subscriptions of a user.
+*/
+func UserSubscriptions(w http.ResponseWriter, r *http.Request) {
+	id, ok := selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	subs, err := getUserSubscriptions(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if subs == nil {
+		subs = []Subscription{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(subs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+SubscriptionCreate adds an area subscription for a user.
+*/
+func SubscriptionCreate(w http.ResponseWriter, r *http.Request) {
+	id, ok := selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	var s Subscription
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(body, &s); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := s.prepare(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	existing, err := getUserSubscriptions(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(existing) >= maxSubscriptionsPerUser {
+		http.Error(w, "Too many subscriptions", http.StatusConflict)
+		return
+	}
+	s.UserID = int(id)
+
+	created, err := insertSubscription(&s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+SubscriptionDelete removes an area subscription of a user.
+*/
+func SubscriptionDelete(w http.ResponseWriter, r *http.Request) {
+	id, ok := selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	subID, err := strconv.ParseInt(mux.Vars(r)["subscriptionId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := deactivateSubscription(id, subID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
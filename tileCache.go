@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	maxTileZoom         = 22
+	tileCacheTTL        = 5 * time.Minute
+	maxTileCacheEntries = 20000
+)
+
+/*
+tileKey names a Web Mercator tile.
+*/
+type tileKey struct {
+	z, x, y int
+}
+
+type tileEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+/*
+tileCache keeps what was computed for map tiles, such as clusters, per tile and
+variant, where the variant stands for the kind of data and the filters used.
+Tiles are dropped when a report within them changes.
+*/
+type tileCache struct {
+	mu      sync.Mutex
+	tiles   map[tileKey]map[string]tileEntry
+	entries int
+}
+
+var tiles = &tileCache{tiles: map[tileKey]map[string]tileEntry{}}
+
+func (c *tileCache) get(k tileKey, variant string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.tiles[k][variant]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *tileCache) put(k tileKey, variant string, v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries >= maxTileCacheEntries {
+		// Starting over is cheaper than tracking the least recently used tile.
+		c.tiles = map[tileKey]map[string]tileEntry{}
+		c.entries = 0
+	}
+	variants, ok := c.tiles[k]
+	if !ok {
+		variants = map[string]tileEntry{}
+		c.tiles[k] = variants
+	}
+	if _, ok := variants[variant]; !ok {
+		c.entries++
+	}
+	variants[variant] = tileEntry{v, time.Now().Add(tileCacheTTL)}
+}
+
+/*
+invalidatePoint drops the tiles containing a point at every zoom level.
+*/
+func (c *tileCache) invalidatePoint(lat, lng float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for z := 0; z <= maxTileZoom; z++ {
+		x, y := tileOf(lat, lng, z)
+		k := tileKey{z, x, y}
+		c.entries -= len(c.tiles[k])
+		delete(c.tiles, k)
+	}
+}
+
+/*
+clear drops all tiles, for changes to many reports at once such as imports.
+*/
+func (c *tileCache) clear() {
+	c.mu.Lock()
+	c.tiles = map[tileKey]map[string]tileEntry{}
+	c.entries = 0
+	c.mu.Unlock()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	reportTileLayer = "reports"
+	maxTileFeatures = 10000
+)
+
+/*
+tilePoint is a report as drawn on vector tiles.
+*/
+type tilePoint struct {
+	ID       int
+	Lat, Lng float64
+	Category string
+	Status   string
+	Date     time.Time
+	Votes    int
+}
+
+var tilePointProperties = []string{"id", "category", "status", "votes", "created"}
+
+/*
+reportTile encodes the reports matching the filter within a tile as a vector
+tile with a single layer of points. Tiles are cached per filter.
+*/
+func reportTile(k tileKey, f *reportFilter, variant string) ([]byte, error) {
+	cacheVariant := "mvt?" + variant
+	if v, ok := tiles.get(k, cacheVariant); ok {
+		return v.([]byte), nil
+	}
+
+	points, err := getTilePoints(tileBBox(k.z, k.x, k.y), f, maxTileFeatures)
+	if err != nil {
+		return nil, err
+	}
+	l := newMVTLayer(reportTileLayer)
+	for _, p := range points {
+		fx, fy := mercator(p.Lat, p.Lng, k.z)
+		l.add(mvtFeature{
+			ID: uint64(p.ID),
+			X:  tileCoord(fx - float64(k.x)),
+			Y:  tileCoord(fy - float64(k.y)),
+			Properties: map[string]interface{}{
+				"id":       p.ID,
+				"category": p.Category,
+				"status":   p.Status,
+				"votes":    p.Votes,
+				"created":  p.Date.UTC().Format(time.RFC3339),
+			},
+		}, tilePointProperties)
+	}
+	tile := l.encode()
+
+	tiles.put(k, cacheVariant, tile)
+	return tile, nil
+}
+
+/*
+tileCoord converts a position within a tile, from 0 to 1, to tile units.
+*/
+func tileCoord(v float64) int {
+	c := int(math.Floor(v * mvtExtent))
+	if c < 0 {
+		return 0
+	}
+	if c >= mvtExtent {
+		return mvtExtent - 1
+	}
+	return c
+}
+
+/*
+ReportTile serves the reports within a map tile as a Mapbox Vector Tile with a
+layer named reports. Each point has the report's id, category, status, vote
+count and creation date. The filters of the report list apply, except bbox.
+At most the 10000 newest reports of a tile are included; maps should show
+clusters at low zoom levels.
+*/
+func ReportTile(w http.ResponseWriter, r *http.Request) {
+	k, err := tileParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, err := reportFilterFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Box = nil
+
+	tile, err := reportTile(k, f, filterVariant(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Write(tile)
+}
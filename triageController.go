@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+/*
+TriageItem is a report in the triage queue with its priority and the factors
+explaining it.
+*/
+type TriageItem struct {
+	Report   *Report         `json:"report"`
+	Priority *ReportPriority `json:"priority"`
+}
+
+/*
+Triage returns the work list of staff: the reports which still need work,
+highest priority first, each with the factors making up its score. The filters
+of the report list apply; without a status, open, acknowledged and in progress
+reports are listed. limit and offset page through the queue. Reports not scored
+yet are scored on the way. Staff only.
+*/
+func Triage(w http.ResponseWriter, r *http.Request) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !u.isStaff() {
+		http.Error(w, "Staff only", http.StatusForbidden)
+		return
+	}
+	f, err := reportFilterFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(f.Statuses) == 0 {
+		f.Statuses = triageStatuses()
+	}
+	limit, offset, err := pageParams(r, 50, 500)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items, err := getTriage(f, limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	categories := map[string]int{}
+	for i := range items {
+		if items[i].Priority != nil {
+			continue
+		}
+		if items[i].Priority, err = refreshPriority(items[i].Report, categories, now); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if items == nil {
+		items = []TriageItem{}
+	}
+
+	resp := struct {
+		Weights PriorityWeights `json:"weights"`
+		Items   []TriageItem    `json:"items"`
+	}{priorityConf.Weights, items}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
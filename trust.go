@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+/*
+Points making up the trust score of a user, from 0 to 100. Everyone starts at
+trustBase; resolved reports and a long-standing account with a verified email
+add to it, reports rejected as invalid and content taken down by moderators
+subtract from it. Each factor is capped.
+*/
+const (
+	trustBase = 50
+	trustMin  = 0
+	trustMax  = 100
+
+	trustPerResolved    = 3
+	maxTrustResolved    = 25
+	trustPerRejected    = -8
+	maxTrustRejected    = -40
+	trustPerModerated   = -10
+	maxTrustModerated   = -40
+	trustPerMonth       = 1
+	maxTrustAge         = 10
+	trustVerifiedEmail  = 10
+	trustRefreshPeriod  = time.Hour
+	defaultTrustForNone = trustBase
+)
+
+/*
+TrustFactor is one part of a trust score: what was counted and the points it
+gave.
+*/
+type TrustFactor struct {
+	Name   string `json:"name"`
+	Count  int    `json:"count"`
+	Points int    `json:"points"`
+}
+
+/*
+TrustOverride is a trust score set by an admin, which replaces the computed one
+until it is cleared.
+*/
+type TrustOverride struct {
+	Score int       `json:"score"`
+	Note  string    `json:"note"`
+	By    int       `json:"by"`
+	Date  time.Time `json:"created"`
+}
+
+/*
+Trust is how far the reports and comments of a user can be trusted. Score is
+the override if one is set and Computed otherwise.
+*/
+type Trust struct {
+	UserID   int            `json:"user"`
+	Score    int            `json:"score"`
+	Computed int            `json:"computed"`
+	Override *TrustOverride `json:"override,omitempty"`
+	Factors  []TrustFactor  `json:"factors"`
+	Date     time.Time      `json:"updated"`
+}
+
+/*
+trustCounts are the figures of a user's history trust is computed from.
+*/
+type trustCounts struct {
+	Resolved, Rejected, Moderated int
+	Verified                      bool
+}
+
+func capPoints(points, limit int) int {
+	if limit < 0 && points < limit || limit > 0 && points > limit {
+		return limit
+	}
+	return points
+}
+
+/*
+computeTrust scores a user from their history.
+*/
+func computeTrust(u *User, c trustCounts, now time.Time) *Trust {
+	months := int(now.Sub(u.Date).Hours() / 24 / 30)
+	verified := 0
+	if c.Verified {
+		verified = 1
+	}
+	t := &Trust{
+		UserID: u.ID,
+		Date:   now,
+		Factors: []TrustFactor{
+			{"resolvedReports", c.Resolved, capPoints(c.Resolved*trustPerResolved, maxTrustResolved)},
+			{"rejectedReports", c.Rejected, capPoints(c.Rejected*trustPerRejected, maxTrustRejected)},
+			{"moderatedContent", c.Moderated, capPoints(c.Moderated*trustPerModerated, maxTrustModerated)},
+			{"accountMonths", months, capPoints(months*trustPerMonth, maxTrustAge)},
+			{"verifiedEmail", verified, verified * trustVerifiedEmail},
+		},
+	}
+	t.Computed = trustBase
+	for _, f := range t.Factors {
+		t.Computed += f.Points
+	}
+	if t.Computed < trustMin {
+		t.Computed = trustMin
+	}
+	if t.Computed > trustMax {
+		t.Computed = trustMax
+	}
+	t.Score = t.Computed
+	return t
+}
+
+/*
+refreshTrust recomputes and stores the trust of a user, keeping an override.
+*/
+func refreshTrust(userID int64) (*Trust, error) {
+	u, err := GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	c, err := getTrustCounts(userID, u.Email)
+	if err != nil {
+		return nil, err
+	}
+	t := computeTrust(u, *c, time.Now())
+	if err := saveTrust(t); err != nil {
+		return nil, err
+	}
+	if t.Override, err = getTrustOverride(userID); err != nil {
+		return nil, err
+	}
+	if t.Override != nil {
+		t.Score = t.Override.Score
+	}
+	return t, nil
+}
+
+/*
+refreshTrustLater recomputes the trust of a user in the background after their
+history changed, and then the priorities of their reports.
+*/
+func refreshTrustLater(userID int64) {
+	if userID == 0 {
+		return
+	}
+	go func() {
+		if _, err := refreshTrust(userID); err != nil {
+			log.Println("refreshing trust:", err)
+			return
+		}
+		refreshPriorities(&reportFilter{Reporter: userID})
+	}()
+}
+
+/*
+trustScore returns the trust score of a user, computing it if it is missing or
+older than an hour. Anonymous content gets the base score.
+*/
+func trustScore(userID int64) int {
+	if userID == 0 {
+		return defaultTrustForNone
+	}
+	score, updated, err := getTrustScore(userID)
+	if err == nil && time.Since(updated) < trustRefreshPeriod {
+		return score
+	}
+	t, err := refreshTrust(userID)
+	if err != nil {
+		log.Println("computing trust:", err)
+		return defaultTrustForNone
+	}
+	return t.Score
+}
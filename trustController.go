@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+userFromRoute loads the user in the route, writing the error response if the
+id is invalid or the user does not exist.
+*/
+func userFromRoute(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["userId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	u, err := GetUserByID(id)
+	if err != nil || u.Active == activeDeactivated {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, false
+	}
+	return u, true
+}
+
+func writeTrust(w http.ResponseWriter, userID int64) {
+	t, err := refreshTrust(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+UserTrust returns the trust score of a user with the factors it was computed
+from and the admin override, if any. Staff only.
+*/
+func UserTrust(w http.ResponseWriter, r *http.Request) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !u.isStaff() {
+		http.Error(w, "Staff only", http.StatusForbidden)
+		return
+	}
+	target, ok := userFromRoute(w, r)
+	if !ok {
+		return
+	}
+	writeTrust(w, int64(target.ID))
+}
+
+/*
+SetUserTrust overrides the computed trust score of a user with a score from 0 to
+100 and a note why. A null score clears the override. The priorities of the
+user's reports are rescored in the background. Admins only.
+*/
+func SetUserTrust(w http.ResponseWriter, r *http.Request) {
+	admin, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	target, ok := userFromRoute(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Score *int   `json:"score"`
+		Note  string `json:"note"`
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	id := int64(target.ID)
+	if req.Score == nil {
+		err = deleteTrustOverride(id)
+	} else if *req.Score < trustMin || *req.Score > trustMax {
+		http.Error(w, "Score must be between 0 and 100", http.StatusUnprocessableEntity)
+		return
+	} else {
+		err = setTrustOverride(id, &TrustOverride{Score: *req.Score, Note: req.Note, By: admin.ID, Date: time.Now()})
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTrust(w, id)
+	go refreshPriorities(&reportFilter{Reporter: id})
+}
+
+/*
+sortByTrust orders reports by the trust score of their reporters, most trusted
+first and newest first among equals.
+*/
+func sortByTrust(reports []Report) {
+	scores := map[int]int{}
+	for _, r := range reports {
+		if _, ok := scores[r.ReporterID]; !ok {
+			scores[r.ReporterID] = trustScore(int64(r.ReporterID))
+		}
+	}
+	sort.SliceStable(reports, func(i, j int) bool {
+		a, b := scores[reports[i].ReporterID], scores[reports[j].ReporterID]
+		if a != b {
+			return a > b
+		}
+		return reports[i].ID > reports[j].ID
+	})
+}
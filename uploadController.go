@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+The resumable upload endpoints implement the core of the tus 1.0.0 protocol
+(https://tus.io/protocols/resumable-upload.html) together with the creation,
+checksum, expiration and termination extensions. A client creates an upload
+session with POST /upload, sends the file in any number of PATCH requests and
+can ask for the current offset with HEAD after a dropped connection. Once the
+last byte has arrived the file is moved into the blob store and attached to
+the report.
+*/
+const (
+	tusVersion        = "1.0.0"
+	tusExtensions     = "creation,checksum,expiration,termination"
+	tusChecksums      = "sha1,sha256,md5"
+	uploadDir         = "/home/ec2-user/uploads/"
+	maxUploadSize     = 512 << 20
+	uploadExpiry      = 24 * time.Hour
+	uploadSweepPeriod = 10 * time.Minute
+
+	// StatusChecksumMismatch is the tus status code for a chunk failing verification.
+	StatusChecksumMismatch = 460
+)
+
+/*
+UploadSession tracks a resumable upload which has not been completed yet.
+Checksum optionally holds the "algorithm base64digest" of the whole file as
+supplied by the client in the upload metadata.
+*/
+type UploadSession struct {
+	ID         string
+	ReportID   int
+	UploaderID int
+	Filename   string
+	Visibility string
+	Length     int64
+	Offset     int64
+	Checksum   string
+	Date       time.Time
+	Expires    time.Time
+}
+
+var errChecksumMismatch = errors.New("Checksum mismatch")
+
+type uploadLock struct {
+	sync.Mutex
+	refs int
+}
+
+var uploadLocks = struct {
+	sync.Mutex
+	m map[string]*uploadLock
+}{m: map[string]*uploadLock{}}
+
+/*
+lockUpload serializes requests modifying the same upload session. The returned
+function releases the lock.
+*/
+func lockUpload(id string) func() {
+	uploadLocks.Lock()
+	l, ok := uploadLocks.m[id]
+	if !ok {
+		l = &uploadLock{}
+		uploadLocks.m[id] = l
+	}
+	l.refs++
+	uploadLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		uploadLocks.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(uploadLocks.m, id)
+		}
+		uploadLocks.Unlock()
+	}
+}
+
+func partialPath(id string) string {
+	return filepath.Join(uploadDir, filepath.Base(id))
+}
+
+/*
+parseUploadMetadata decodes the Upload-Metadata header, a comma separated list
+of keys each followed by a space and its base64 encoded value.
+*/
+func parseUploadMetadata(h string) (map[string]string, error) {
+	meta := map[string]string{}
+	if strings.TrimSpace(h) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(h, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if len(kv) == 1 {
+			meta[kv[0]] = ""
+			continue
+		}
+		v, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		meta[kv[0]] = string(v)
+	}
+	return meta, nil
+}
+
+/*
+parseChecksum splits a tus checksum value of the form "algorithm base64digest".
+*/
+func parseChecksum(s string) (hash.Hash, []byte, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), " ", 2)
+	if len(parts) != 2 {
+		return nil, nil, errors.New("Invalid checksum")
+	}
+	var h hash.Hash
+	switch parts[0] {
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	case "md5":
+		h = md5.New()
+	default:
+		return nil, nil, errors.New("Unsupported checksum algorithm")
+	}
+	sum, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, sum, nil
+}
+
+func writeTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func uploadFromRequest(r *http.Request) (*UploadSession, error) {
+	v := mux.Vars(r)
+	return getUploadSession(v["uploadId"])
+}
+
+/*
+UploadOptions advertises the supported tus version, extensions and limits.
+*/
+func UploadOptions(w http.ResponseWriter, r *http.Request) {
+	writeTusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Checksum-Algorithm", tusChecksums)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+UploadCreate starts a resumable upload. The Upload-Length header gives the size
+of the file and Upload-Metadata must contain the reportId and filename, and may
+contain visibility and a checksum of the whole file.
+*/
+func UploadCreate(w http.ResponseWriter, r *http.Request) {
+	writeTusHeaders(w)
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > maxUploadSize {
+		http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+
+	reportID, err := strconv.ParseInt(meta["reportId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Metadata must contain reportId", http.StatusBadRequest)
+		return
+	}
+	report, err := getSpecificReport(reportID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	visibility := meta["visibility"]
+	if visibility == "" {
+		visibility = VisibilityPublic
+	}
+	if !validVisibility(visibility) {
+		http.Error(w, "Invalid visibility", http.StatusBadRequest)
+		return
+	}
+	u, _ := requestUser(r)
+	if visibility != VisibilityPublic && !canViewAttachment(u, report, &Attachment{Visibility: visibility}) {
+		http.Error(w, "Not allowed to upload with this visibility", http.StatusForbidden)
+		return
+	}
+	if meta["filename"] == "" {
+		http.Error(w, "Upload-Metadata must contain filename", http.StatusBadRequest)
+		return
+	}
+	if c := meta["checksum"]; c != "" {
+		if _, _, err := parseChecksum(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	id, err := randomToken(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Create(partialPath(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	s := UploadSession{
+		ID:         id,
+		ReportID:   report.ID,
+		Filename:   filepath.Base(meta["filename"]),
+		Visibility: visibility,
+		Length:     length,
+		Checksum:   meta["checksum"],
+		Expires:    time.Now().Add(uploadExpiry),
+	}
+	if u != nil {
+		s.UploaderID = u.ID
+	}
+	if err := insertUploadSession(&s); err != nil {
+		os.Remove(partialPath(id))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/upload/"+id)
+	w.Header().Set("Upload-Expires", s.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+/*
+UploadStatus reports how many bytes of an upload the server has received.
+*/
+func UploadStatus(w http.ResponseWriter, r *http.Request) {
+	writeTusHeaders(w)
+	s, err := uploadFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(s.Length, 10))
+	w.Header().Set("Upload-Expires", s.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+UploadChunk appends the request body to an upload at the offset given in the
+Upload-Offset header. If an Upload-Checksum header is sent the chunk is verified
+and discarded on mismatch. The request completing the upload creates the
+attachment, whose location is returned in the X-Attachment-Location header.
+*/
+func UploadChunk(w http.ResponseWriter, r *http.Request) {
+	writeTusHeaders(w)
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	v := mux.Vars(r)
+	unlock := lockUpload(v["uploadId"])
+	defer unlock()
+
+	s, err := uploadFromRequest(r)
+	if err != nil || time.Now().After(s.Expires) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if offset != s.Offset {
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	var h hash.Hash
+	var want []byte
+	if c := r.Header.Get("Upload-Checksum"); c != "" {
+		h, want, err = parseChecksum(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	f, err := os.OpenFile(partialPath(s.ID), os.O_WRONLY, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(s.Offset, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var dst io.Writer = f
+	if h != nil {
+		dst = io.MultiWriter(f, h)
+	}
+	n, err := io.Copy(dst, io.LimitReader(r.Body, s.Length-s.Offset))
+	if h != nil && err == nil && !bytes.Equal(h.Sum(nil), want) {
+		err = errChecksumMismatch
+	}
+	if err != nil {
+		if h != nil {
+			// The chunk can't be verified, so throw it away and let the client
+			// resend it from the old offset.
+			f.Truncate(s.Offset)
+			if err == errChecksumMismatch {
+				http.Error(w, err.Error(), StatusChecksumMismatch)
+				return
+			}
+		} else if n > 0 {
+			// Without a checksum a dropped connection keeps the bytes received
+			// and the client resumes after them.
+			updateUploadOffset(s.ID, s.Offset+n, time.Now().Add(uploadExpiry))
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.Offset += n
+	s.Expires = time.Now().Add(uploadExpiry)
+	if err := updateUploadOffset(s.ID, s.Offset, s.Expires); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if s.Offset == s.Length {
+		f.Close()
+		a, err := finishUpload(s)
+		if err == errChecksumMismatch {
+			http.Error(w, err.Error(), StatusChecksumMismatch)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Attachment-Location", attachmentPath(a))
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	w.Header().Set("Upload-Expires", s.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+UploadTerminate cancels an upload and throws away the bytes received so far.
+*/
+func UploadTerminate(w http.ResponseWriter, r *http.Request) {
+	writeTusHeaders(w)
+	v := mux.Vars(r)
+	unlock := lockUpload(v["uploadId"])
+	defer unlock()
+
+	s, err := uploadFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := removeUpload(s.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+finishUpload verifies the checksum of a completed upload, moves it into the blob
+store and creates the attachment. On a checksum mismatch the upload is discarded.
+*/
+func finishUpload(s *UploadSession) (*Attachment, error) {
+	f, err := os.Open(partialPath(s.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if s.Checksum != "" {
+		h, want, err := parseChecksum(s.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(h, f); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(h.Sum(nil), want) {
+			removeUpload(s.ID)
+			return nil, errChecksumMismatch
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	name, err := blobName(s.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := blobs.Put(name, f); err != nil {
+		return nil, err
+	}
+	a, err := insertAttachment(&Attachment{ReportID: s.ReportID, UploaderID: s.UploaderID, Filename: name, Visibility: s.Visibility})
+	if err != nil {
+		blobs.Delete(name)
+		return nil, err
+	}
+	removeUpload(s.ID)
+	return a, nil
+}
+
+func removeUpload(id string) error {
+	if err := os.Remove(partialPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return deleteUploadSession(id)
+}
+
+/*
+expireUploads periodically removes upload sessions which have not received any
+data within uploadExpiry. It is meant to be run in its own goroutine.
+*/
+func expireUploads() {
+	for range time.Tick(uploadSweepPeriod) {
+		ids, err := getExpiredUploadSessions(time.Now())
+		if err != nil {
+			log.Println("expiring uploads:", err)
+			continue
+		}
+		for _, id := range ids {
+			unlock := lockUpload(id)
+			if err := removeUpload(id); err != nil {
+				log.Println("expiring upload", id+":", err)
+			}
+			unlock()
+		}
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
@@ -25,10 +28,40 @@ type User struct {
 	Password string    `json:"-"`
 	Date     time.Time `json:"created"`
 	Active   int       `json:"-"`
+	Role     string    `json:"role"`
+}
+
+/*
+Roles a user of the CommComm application can hold. Residents are the default.
+Staff work on reports for the city, moderators additionally police user content
+and admins can do everything.
+*/
+const (
+	RoleResident  = "resident"
+	RoleStaff     = "staff"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var errUnauthenticated = errors.New("Authorization required")
+
+var errBanned = errors.New("User is banned")
+
+func (u *User) isStaff() bool {
+	return u != nil && (u.Role == RoleStaff || u.Role == RoleModerator || u.Role == RoleAdmin)
+}
+
+func (u *User) isModerator() bool {
+	return u != nil && (u.Role == RoleModerator || u.Role == RoleAdmin)
+}
+
+func (u *User) isAdmin() bool {
+	return u != nil && u.Role == RoleAdmin
 }
 
 /*
 GetSpecificUserByID gets a user by their ID
+Staff also see the trust score of the user.
 */
 func GetSpecificUserByID(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
@@ -44,8 +77,16 @@ func GetSpecificUserByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	u.Password = ""
+	resp := struct {
+		*User
+		Trust *int `json:"trust,omitempty"`
+	}{User: u}
+	if requester, err := requestUser(r); err == nil && requester.isStaff() {
+		score := trustScore(id)
+		resp.Trust = &score
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	if err := json.NewEncoder(w).Encode(u); err != nil {
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -153,20 +194,17 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user, err := GetUserByEmail(e)
-	if err != nil || user != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	if err != nil || user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(p), bcrypt.DefaultCost)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(p)); err != nil {
+		http.Error(w, "Supplied username and/or password incorrect", http.StatusForbidden)
 		return
 	}
-	p = string(hash)
-
-	if p != user.Password {
-		http.Error(w, "Supplied username and/or password incorrect", http.StatusForbidden)
+	if user.Active != 1 {
+		http.Error(w, "Account is not active", http.StatusForbidden)
 		return
 	}
 
@@ -176,9 +214,13 @@ func Login(w http.ResponseWriter, r *http.Request) {
 
 	claims["userId"] = user.ID
 	claims["Email"] = user.Email
-	claims["exp"] = time.Now().Add(time.Hour * 24 * 120)
+	claims["exp"] = time.Now().Add(time.Hour * 24 * 120).Unix()
 
-	tokenString, _ := token.SignedString(conf.Secret)
+	tokenString, err := token.SignedString([]byte(conf.Secret))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.Write([]byte(tokenString))
 }
@@ -215,6 +257,111 @@ func DeactivateUser(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+/*
+requestUser returns the user identified by the bearer token in the Authorization
+header of the request. If no token is supplied errUnauthenticated is returned.
+Deactivated users are treated as unauthenticated and users banned by a
+moderator get errBanned.
+*/
+func requestUser(r *http.Request) (*User, error) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return nil, errUnauthenticated
+	}
+	tokenString := strings.TrimPrefix(h, "Bearer ")
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method")
+		}
+		return []byte(conf.Secret), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, errUnauthenticated
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errUnauthenticated
+	}
+	id, ok := claims["userId"].(float64)
+	if !ok {
+		return nil, errUnauthenticated
+	}
+
+	u, err := GetUserByID(int64(id))
+	if err == nil && u.Active == activeHidden {
+		return nil, errBanned
+	}
+	if err != nil || u.Active != activeVisible {
+		return nil, errUnauthenticated
+	}
+	u.Password = ""
+
+	return u, nil
+}
+
+/*
+requestAuthor returns the author of content posted with the request, nil for
+anonymous posts. A token which is sent but invalid is refused with 401 and a
+banned user with 403 rather than posting anonymously, as is anonymous content
+when the content filter rejects it. It writes the error response and returns
+false if the request can't post.
+*/
+func requestAuthor(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	u, err := requestUser(r)
+	switch {
+	case err == nil:
+		return u, true
+	case err == errBanned:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, false
+	case r.Header.Get("Authorization") != "" || anonymousPolicy == AnonymousReject:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	return nil, true
+}
+
+/*
+selfOrAdmin checks that the requesting user is the user in the route or an admin,
+writing the error response if not. It returns the id of the user in the route.
+*/
+func selfOrAdmin(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return 0, false
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["userId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+	if int64(u.ID) != id && !u.isAdmin() {
+		http.Error(w, "Not allowed to access other users", http.StatusForbidden)
+		return 0, false
+	}
+	return id, true
+}
+
+/*
+requireAdmin returns the user of the request if they are an admin. Otherwise it
+writes the error response and returns false.
+*/
+func requireAdmin(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	if !u.isAdmin() {
+		http.Error(w, "Admins only", http.StatusForbidden)
+		return nil, false
+	}
+	return u, true
+}
+
 /*func Validate(call http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		tokenString := req.Header.Get("Authorization")
@@ -2,7 +2,10 @@ package main
 
 import (
 	"errors"
+	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func splitString(s string, delim string) ([]string, error) {
@@ -11,3 +14,40 @@ func splitString(s string, delim string) ([]string, error) {
 	}
 	return nil, errors.New("Substring not found")
 }
+
+/*
+pageParams reads the limit and offset query parameters of a paginated request.
+limit defaults to def and is capped at max.
+*/
+func pageParams(r *http.Request, def, max int) (limit, offset int, err error) {
+	limit = def
+	vals := r.URL.Query()
+	if s := vals.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			return 0, 0, errors.New("Invalid limit")
+		}
+		if limit > max {
+			limit = max
+		}
+	}
+	if s := vals.Get("offset"); s != "" {
+		offset, err = strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("Invalid offset")
+		}
+	}
+	return limit, offset, nil
+}
+
+/*
+nextAt returns the next time the clock strikes hour, for jobs run once a day.
+*/
+func nextAt(hour int) time.Time {
+	now := time.Now()
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
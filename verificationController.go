@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+verificationExpiry is how long a verification token can be used after it was
+sent.
+*/
+const verificationExpiry = 48 * time.Hour
+
+/*
+emailVerification is a token sent to the email address of a user to prove they
+own it. Verified is nil until the token was used.
+*/
+type emailVerification struct {
+	UserID   int64
+	Email    string
+	Token    string
+	Sent     time.Time
+	Verified *time.Time
+}
+
+/*
+SendVerification emails a verification token to the address of the user.
+Sending again replaces the earlier token. Users can only verify themselves
+unless they are an admin. Without a mail server 503 Service Unavailable is
+returned.
+*/
+func SendVerification(w http.ResponseWriter, r *http.Request) {
+	id, ok := selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	if conf.SMTP.Host == "" {
+		http.Error(w, "Email is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	u, err := GetUserByID(id)
+	if err != nil || u.Active == activeDeactivated {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	token, err := randomToken(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	v := &emailVerification{UserID: id, Email: u.Email, Token: token, Sent: time.Now()}
+	if err := insertEmailVerification(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body := "Use this code to verify your email address for CommComm:\r\n\r\n" + token +
+		"\r\n\r\nThe code expires in 48 hours. If you did not ask for it, ignore this email."
+	if err := sendEmail(conf.SMTP, u.Email, "Verify your email address", body); err != nil {
+		log.Println("sending verification email:", err)
+		http.Error(w, "Could not send email", http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+/*
+VerifyEmail marks the email address a token was sent to as verified. Tokens
+expire after 48 hours and are void once the user changed their email address.
+*/
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	v, err := getEmailVerification(mux.Vars(r)["token"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown verification token", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := GetUserByID(v.UserID)
+	if err != nil || u.Active == activeDeactivated || u.Email != v.Email {
+		http.Error(w, "Unknown verification token", http.StatusNotFound)
+		return
+	}
+	if v.Verified == nil {
+		if time.Since(v.Sent) > verificationExpiry {
+			http.Error(w, "Verification token expired", http.StatusGone)
+			return
+		}
+		now := time.Now()
+		if err := markEmailVerified(v.UserID, now); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		v.Verified = &now
+		refreshTrustLater(v.UserID)
+	}
+
+	resp := struct {
+		UserID   int64     `json:"user"`
+		Email    string    `json:"email"`
+		Verified time.Time `json:"verified"`
+	}{v.UserID, v.Email, *v.Verified}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
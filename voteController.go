@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+VoteReport is the handler function for the requesting user supporting a report,
+saying it affects them too. Each user counts once per report. The report's vote
+count is returned.
+*/
+func VoteReport(w http.ResponseWriter, r *http.Request) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["reportId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := getSpecificReport(id)
+	if err != nil {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	if err := insertVote(id, u.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeVotes(w, report)
+}
+
+/*
+UnvoteReport is the handler function for the requesting user taking back their
+vote for a report.
+*/
+func UnvoteReport(w http.ResponseWriter, r *http.Request) {
+	u, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["reportId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := getSpecificReport(id)
+	if err != nil {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	if err := deleteVote(id, u.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeVotes(w, report)
+}
+
+/*
+writeVotes answers with the vote count of a report after it changed, drops the
+cached map tiles showing it and rescores its priority.
+*/
+func writeVotes(w http.ResponseWriter, report *Report) {
+	if lat, lng, err := report.point(); err == nil {
+		tiles.invalidatePoint(lat, lng)
+	}
+	refreshPriorityLater(int64(report.ID))
+	n, err := countVotes(int64(report.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(map[string]int{"votes": n}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
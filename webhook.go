@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+States of a webhook delivery. Pending deliveries are attempted until they are
+delivered or run out of attempts.
+*/
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	webhookTimeout        = 10 * time.Second
+	webhookPollPeriod     = 15 * time.Second
+	webhookBatchSize      = 50
+	webhookMaxAttempts    = 8
+	webhookBaseBackoff    = 30 * time.Second
+	webhookMaxBackoff     = 6 * time.Hour
+	webhookDisableAfter   = 20
+	webhookMaxResponseLog = 1024
+)
+
+/*
+Webhook sends events of the types in Events, or of all types when Events is
+["*"], to a partner system. Each payload is signed with Secret. Webhooks which
+fail webhookDisableAfter times in a row are disabled until an admin enables
+them again.
+*/
+type Webhook struct {
+	ID          int        `json:"id"`
+	URL         string     `json:"url"`
+	Secret      string     `json:"secret,omitempty"`
+	Events      []string   `json:"events"`
+	Description string     `json:"description"`
+	CreatedBy   int        `json:"createdBy"`
+	Date        time.Time  `json:"created"`
+	Active      int        `json:"active"`
+	Failures    int        `json:"failures"`
+	Disabled    *time.Time `json:"disabled,omitempty"`
+}
+
+/*
+WebhookDelivery is one event sent to one webhook, with the outcome of the last
+attempt.
+*/
+type WebhookDelivery struct {
+	ID           int        `json:"id"`
+	WebhookID    int        `json:"webhookId"`
+	Event        string     `json:"event"`
+	Payload      string     `json:"payload"`
+	Status       string     `json:"status"`
+	Attempts     int        `json:"attempts"`
+	ResponseCode int        `json:"responseCode"`
+	Response     string     `json:"response"`
+	NextAttempt  *time.Time `json:"nextAttempt,omitempty"`
+	LastAttempt  *time.Time `json:"lastAttempt,omitempty"`
+	Date         time.Time  `json:"created"`
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+/*
+webhookWake starts a delivery run right away instead of waiting for the next
+poll.
+*/
+var webhookWake = make(chan struct{}, 1)
+
+func wakeWebhooks() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+/*
+wants reports whether the webhook is subscribed to events of type t.
+*/
+func (h *Webhook) wants(t string) bool {
+	for _, e := range h.Events {
+		if e == "*" || e == t {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+webhookSignature signs a payload for a webhook. The timestamp is part of the
+signed content so receivers can reject replayed requests.
+*/
+func webhookSignature(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+webhookBackoff returns how long to wait before the next attempt after the
+given number of failed attempts.
+*/
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookBaseBackoff
+	for i := 1; i < attempts && d < webhookMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > webhookMaxBackoff {
+		d = webhookMaxBackoff
+	}
+	return d
+}
+
+/*
+queueWebhookDeliveries stores a pending delivery of an event for every active
+webhook subscribed to it.
+*/
+func queueWebhookDeliveries(e Event) {
+	hooks, err := getActiveWebhooks()
+	if err != nil {
+		log.Println("loading webhooks:", err)
+		return
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Println("encoding event:", err)
+		return
+	}
+	queued := false
+	for _, h := range hooks {
+		if !h.wants(e.Type) {
+			continue
+		}
+		if _, err := insertWebhookDelivery(h.ID, e.Type, string(payload)); err != nil {
+			log.Println("queueing webhook delivery:", err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		wakeWebhooks()
+	}
+}
+
+/*
+attemptDelivery posts a delivery to its webhook and records the outcome. Failed
+deliveries are retried with exponential backoff, and the webhook is disabled
+after too many failures in a row.
+*/
+func attemptDelivery(h *Webhook, d *WebhookDelivery) {
+	now := time.Now()
+	payload := []byte(d.Payload)
+	code, response, err := postWebhook(h, d, payload, now)
+	d.Attempts++
+	d.LastAttempt = &now
+	d.ResponseCode = code
+	d.Response = response
+	d.NextAttempt = nil
+
+	if err == nil {
+		d.Status = DeliveryDelivered
+		if err := updateWebhookDelivery(d); err != nil {
+			log.Println("recording webhook delivery:", err)
+		}
+		if h.Failures > 0 {
+			if err := setWebhookFailures(h.ID, 0); err != nil {
+				log.Println("resetting webhook failures:", err)
+			}
+		}
+		return
+	}
+
+	if d.Response == "" {
+		d.Response = err.Error()
+	}
+	if d.Attempts >= webhookMaxAttempts {
+		d.Status = DeliveryFailed
+	} else {
+		next := now.Add(webhookBackoff(d.Attempts))
+		d.NextAttempt = &next
+	}
+	if err := updateWebhookDelivery(d); err != nil {
+		log.Println("recording webhook delivery:", err)
+	}
+	h.Failures++
+	if h.Failures >= webhookDisableAfter {
+		log.Printf("disabling webhook %d after %d failed deliveries", h.ID, h.Failures)
+		if err := disableWebhook(h.ID, h.Failures); err != nil {
+			log.Println("disabling webhook:", err)
+		}
+		return
+	}
+	if err := setWebhookFailures(h.ID, h.Failures); err != nil {
+		log.Println("recording webhook failures:", err)
+	}
+}
+
+/*
+postWebhook sends a payload and returns the status code and the start of the
+response body. Anything but a 2xx response is an error.
+*/
+func postWebhook(h *Webhook, d *WebhookDelivery, payload []byte, now time.Time) (int, string, error) {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "CommComm-Webhook")
+	req.Header.Set("X-CommComm-Event", d.Event)
+	req.Header.Set("X-CommComm-Delivery", strconv.Itoa(d.ID))
+	req.Header.Set("X-CommComm-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set("X-CommComm-Signature", webhookSignature(h.Secret, now.Unix(), payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, webhookMaxResponseLog))
+	response := strings.TrimSpace(string(body))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, response, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return resp.StatusCode, response, nil
+}
+
+/*
+deliverWebhooks attempts all deliveries which are due.
+*/
+func deliverWebhooks() {
+	due, err := getDueWebhookDeliveries(time.Now(), webhookBatchSize)
+	if err != nil {
+		log.Println("loading webhook deliveries:", err)
+		return
+	}
+	hooks := map[int]*Webhook{}
+	for i := range due {
+		d := &due[i]
+		h, ok := hooks[d.WebhookID]
+		if !ok {
+			h, err = getWebhook(int64(d.WebhookID))
+			if err != nil {
+				log.Println("loading webhook:", err)
+				continue
+			}
+			hooks[d.WebhookID] = h
+		}
+		if h.Active != 1 {
+			continue
+		}
+		attemptDelivery(h, d)
+	}
+}
+
+/*
+runWebhookDeliveries delivers queued webhook payloads, right after they are
+queued and periodically for retries. It is meant to be run in its own
+goroutine.
+*/
+func runWebhookDeliveries() {
+	ticker := time.NewTicker(webhookPollPeriod)
+	defer ticker.Stop()
+	for {
+		deliverWebhooks()
+		select {
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+	}
+}
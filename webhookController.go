@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+validate checks the address and events of a webhook and creates a secret if
+none was given.
+*/
+func (h *Webhook) validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("Webhook needs an http or https URL")
+	}
+	if len(h.URL) > 2048 || len(h.Description) > 255 {
+		return errors.New("Webhook URL or description too long")
+	}
+	if len(h.Events) == 0 {
+		return errors.New("Webhook needs at least one event type or \"*\"")
+	}
+	for _, e := range h.Events {
+		if e != "*" && !eventTypes[e] {
+			return errors.New("Unknown event type " + e)
+		}
+	}
+	if h.Secret == "" {
+		secret, err := randomToken(32)
+		if err != nil {
+			return err
+		}
+		h.Secret = secret
+	}
+	if len(h.Secret) < 16 || len(h.Secret) > 128 {
+		return errors.New("Webhook secrets must have 16 to 128 characters")
+	}
+	return nil
+}
+
+/*
+webhookFromRequest reads a webhook from the request body into h. Fields missing
+in the body keep their value.
+*/
+func webhookFromRequest(w http.ResponseWriter, r *http.Request, h *Webhook) bool {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if err := json.Unmarshal(body, h); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return false
+	}
+	return true
+}
+
+/*
+webhookFromRoute loads the webhook named in the route.
+*/
+func webhookFromRoute(w http.ResponseWriter, r *http.Request) (*Webhook, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["webhookId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	h, err := getWebhook(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return h, true
+}
+
+/*
+WebhookIndex lists all webhooks, without their secrets.
+*/
+func WebhookIndex(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	hooks, err := getWebhooks(false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if hooks == nil {
+		hooks = []Webhook{}
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(hooks); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+WebhookCreate adds a webhook. The response contains the secret payloads are
+signed with; it is not shown again.
+*/
+func WebhookCreate(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	h := &Webhook{}
+	if !webhookFromRequest(w, r, h) {
+		return
+	}
+	if err := h.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	h.CreatedBy = u.ID
+
+	created, err := insertWebhook(h)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+WebhookUpdate changes a webhook. Fields which are not sent are kept. Setting
+active to 1 enables a disabled webhook again, and its pending deliveries are
+retried.
+*/
+func WebhookUpdate(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	h, ok := webhookFromRoute(w, r)
+	if !ok {
+		return
+	}
+	id := h.ID
+	if !webhookFromRequest(w, r, h) {
+		return
+	}
+	if err := h.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if h.Active != 0 && h.Active != 1 {
+		http.Error(w, "active must be 0 or 1", http.StatusUnprocessableEntity)
+		return
+	}
+	h.ID = id
+	if err := updateWebhook(h); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if h.Active == 1 {
+		wakeWebhooks()
+	}
+
+	updated, err := getWebhook(int64(h.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	updated.Secret = ""
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(updated); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+WebhookDelete removes a webhook. Its delivery log is kept.
+*/
+func WebhookDelete(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["webhookId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := deleteWebhook(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+WebhookDeliveries returns the delivery log of a webhook, newest first. status
+filters by delivery status, limit and offset page through the log.
+*/
+func WebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	h, ok := webhookFromRoute(w, r)
+	if !ok {
+		return
+	}
+	limit, offset, err := pageParams(r, 50, 200)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deliveries, err := getWebhookDeliveries(int64(h.ID), r.URL.Query().Get("status"), limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []WebhookDelivery{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(deliveries); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+WebhookRedeliver queues a delivery again with the same payload. The new
+delivery is attempted right away if the webhook is enabled.
+*/
+func WebhookRedeliver(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	h, ok := webhookFromRoute(w, r)
+	if !ok {
+		return
+	}
+	deliveryID, err := strconv.ParseInt(mux.Vars(r)["deliveryId"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d, err := getWebhookDelivery(int64(h.ID), deliveryID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	queued, err := insertWebhookDelivery(h.ID, d.Event, d.Payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wakeWebhooks()
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(queued); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}